@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// normalizeAddress trims the fields of an address and upper-cases its
+// country and region codes
+func normalizeAddress(address PostalAddress) PostalAddress {
+	address.Name = strings.TrimSpace(address.Name)
+	address.Line1 = strings.TrimSpace(address.Line1)
+	address.Line2 = strings.TrimSpace(address.Line2)
+	address.City = strings.TrimSpace(address.City)
+	address.Region = strings.ToUpper(strings.TrimSpace(address.Region))
+	address.PostalCode = strings.TrimSpace(address.PostalCode)
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+	address.Phone = strings.TrimSpace(address.Phone)
+	return address
+}
+
+// validateAddress checks an address has everything needed to deliver to it
+func validateAddress(address PostalAddress) error {
+	if address.Name == "" || address.Line1 == "" || address.City == "" || address.PostalCode == "" {
+		return errors.New("name, line1, city and postal_code cannot be blank")
+	}
+	if len(address.Country) != 2 || strings.Trim(address.Country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return errors.New("country must be a two-letter ISO 3166 code")
+	}
+	return nil
+}
+
+// findAddress loads one of a user's addresses, or their default address when
+// id is nil. It returns nil without an error when the user has no default
+// address, and gorm.ErrRecordNotFound when id is not one of theirs.
+func findAddress(db *gorm.DB, userID uint, id *uint) (*Address, error) {
+	var address Address
+	if id != nil {
+		if err := db.Where("id = ? AND user_id = ?", *id, userID).First(&address).Error; err != nil {
+			return nil, err
+		}
+		return &address, nil
+	}
+
+	err := db.Where("user_id = ? AND is_default = ?", userID, true).First(&address).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// makeDefaultAddress makes an address its user's only default address
+func makeDefaultAddress(tx *gorm.DB, address *Address) error {
+	err := tx.Model(&Address{}).Where("user_id = ? AND id <> ? AND is_default = ?", address.UserID, address.ID, true).Update("is_default", false).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(address).Update("is_default", true).Error; err != nil {
+		return err
+	}
+	address.IsDefault = true
+	return nil
+}
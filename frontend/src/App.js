@@ -1,10 +1,11 @@
-import React, { useState, useEffect, useCallback } from 'react';
+import React, { useState, useEffect, useCallback, useRef } from 'react';
 import { ToastContainer, toast } from 'react-toastify';
 import 'react-toastify/dist/ReactToastify.css';
 import axios from 'axios';
 import Login from './components/Login';
 import ItemList from './components/ItemList';
 import Cart from './components/Cart';
+import { formatMoney } from './money';
 
 // Configure axios defaults
 axios.defaults.baseURL = 'http://localhost:8080/api';
@@ -14,6 +15,9 @@ function App() {
   const [token, setToken] = useState(localStorage.getItem('token'));
   const [isCartOpen, setIsCartOpen] = useState(false);
   const [cartItemCount, setCartItemCount] = useState(0);
+  // Checkout attempts share an Idempotency-Key until one finishes, so a
+  // double-click cannot place the order twice
+  const checkoutKey = useRef(null);
 
   const fetchCartCount = useCallback(async () => {
     if (!token) return;
@@ -35,6 +39,48 @@ function App() {
     }
   }, [token]);
 
+  const clearSession = useCallback(() => {
+    setToken(null);
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    setIsLoggedIn(false);
+    setCartItemCount(0);
+  }, []);
+
+  useEffect(() => {
+    // Access tokens are short-lived: when a request is rejected, swap the
+    // refresh token for a new pair and retry the request once
+    const interceptor = axios.interceptors.response.use(
+      response => response,
+      async (error) => {
+        const original = error.config;
+        const refreshToken = localStorage.getItem('refreshToken');
+
+        if (error.response?.status !== 401 || !original || original._retried ||
+            original.url === '/users/refresh' || !refreshToken) {
+          return Promise.reject(error);
+        }
+        original._retried = true;
+
+        try {
+          const response = await axios.post('/users/refresh', { refresh_token: refreshToken });
+          localStorage.setItem('token', response.data.token);
+          localStorage.setItem('refreshToken', response.data.refresh_token);
+          setToken(response.data.token);
+
+          original.headers['Authorization'] = `Bearer ${response.data.token}`;
+          return axios(original);
+        } catch (refreshError) {
+          clearSession();
+          toast.info('Your session has expired, please log in again');
+          return Promise.reject(error);
+        }
+      }
+    );
+
+    return () => axios.interceptors.response.eject(interceptor);
+  }, [clearSession]);
+
   useEffect(() => {
     // Check if user is logged in on app start
     if (token) {
@@ -43,27 +89,30 @@ function App() {
     }
   }, [token, fetchCartCount]);
 
-  const handleLogin = (userData, userToken) => {
+  const handleLogin = (userData, userToken, refreshToken) => {
     console.log('Login successful:', userData);
-    console.log('Token received:', userToken);
     setToken(userToken);
     localStorage.setItem('token', userToken);
+    localStorage.setItem('refreshToken', refreshToken);
     setIsLoggedIn(true);
     toast.success('Login successful!');
   };
 
-  const handleLogout = () => {
-    setToken(null);
-    localStorage.removeItem('token');
-    setIsLoggedIn(false);
-    setCartItemCount(0);
+  const handleLogout = async () => {
+    try {
+      await axios.post('/users/logout', {}, {
+        headers: { 'Authorization': `Bearer ${token}` }
+      });
+    } catch (error) {
+      console.error('Error logging out:', error);
+    }
+    clearSession();
     toast.info('Logged out successfully');
   };
 
-  const handleAddToCart = async (itemId) => {
+  const handleAddToCart = async (itemId, variantId) => {
     try {
-      console.log('Adding item to cart:', itemId);
-      console.log('Token:', token);
+      console.log('Adding item to cart:', itemId, variantId);
       
       if (!token) {
         toast.error('Please login first');
@@ -71,7 +120,7 @@ function App() {
       }
 
       const response = await axios.post('/carts', 
-        { item_id: itemId },
+        { item_id: itemId, variant_id: variantId },
         { 
           headers: { 
             'Authorization': `Bearer ${token}`,
@@ -85,11 +134,21 @@ function App() {
     } catch (error) {
       console.error('Error adding item to cart:', error);
       console.error('Error response:', error.response?.data);
-      toast.error('Failed to add item to cart');
+      if (error.response?.status === 409) {
+        toast.error(`Not enough stock: only ${error.response.data.available} left`);
+      } else {
+        toast.error('Failed to add item to cart');
+      }
     }
   };
 
-  const handleCheckout = async () => {
+  // cartVersion acknowledges the cart's current prices after some changed
+  const handleCheckout = async (cartVersion) => {
+    if (!checkoutKey.current) {
+      checkoutKey.current = crypto.randomUUID();
+    }
+
+    let cart;
     try {
       // First get the user's cart
       const cartResponse = await axios.get('/carts', {
@@ -101,24 +160,61 @@ function App() {
         return;
       }
 
-      const cart = cartResponse.data[0]; // Get the first cart
+      cart = cartResponse.data[0]; // Get the first cart
 
-      // Create order from cart
-      await axios.post('/orders', 
-        { cart_id: cart.id },
+      // Create order from cart. The backend charges through its fake
+      // payment provider, which approves this test card.
+      const orderResponse = await axios.post('/orders', 
+        { cart_id: cart.id, payment_source: 'tok_visa', cart_version: cartVersion },
         { 
           headers: { 
             'Authorization': `Bearer ${token}`,
-            'Content-Type': 'application/json'
+            'Content-Type': 'application/json',
+            'Idempotency-Key': checkoutKey.current
           } 
         }
       );
+      checkoutKey.current = null;
+
+      // The payment provider may ask the customer to authenticate first
+      if (orderResponse.status === 202) {
+        const challengeResponse = window.prompt('Your bank needs to verify this payment. Enter the verification code:');
+        await axios.post(`/orders/${orderResponse.data.id}/payment`,
+          { challenge_response: challengeResponse || '' },
+          { headers: { 'Authorization': `Bearer ${token}` } }
+        );
+      }
 
       toast.success('Order placed successfully!');
       setCartItemCount(0); // Reset cart count
     } catch (error) {
       console.error('Error creating order:', error);
-      toast.error('Failed to place order');
+      if (error.response?.status === 409 && error.config?.url === '/orders' && !error.response.data.step) {
+        // The first click is still placing the order
+        return;
+      }
+      checkoutKey.current = null;
+      if (error.response?.status === 409 && error.response.data.step === 'check_prices') {
+        // Ask before charging prices that changed since the items were added
+        const changes = (error.response.data.price_changes || []).map(change => {
+          const line = cart?.items.find(cartItem => cartItem.item_id === change.item_id);
+          return `${line ? line.item.name : 'Item'}: ${formatMoney(change.price)} → ${formatMoney(change.current_price)}`;
+        });
+        const question = changes.length > 0
+          ? `Prices in your cart have changed:\n${changes.join('\n')}\n\nPlace the order at the new prices?`
+          : 'Your cart has changed. Place the order as it is now?';
+        if (window.confirm(question)) {
+          handleCheckout(error.response.data.cart_version);
+        }
+      } else if (error.response?.status === 409) {
+        toast.error(`Some items sold out: only ${error.response.data.available} left`);
+      } else if (error.response?.status === 402) {
+        toast.error('Payment declined. Your items are back in your cart.');
+      } else if (error.response?.status === 504) {
+        toast.error('The payment provider did not respond. Your items are back in your cart.');
+      } else {
+        toast.error('Failed to place order');
+      }
     }
   };
 
@@ -133,7 +229,7 @@ function App() {
         return;
       }
 
-      const orderIds = response.data.map(order => `Order ID: ${order.id}`).join('\n');
+      const orderIds = response.data.map(order => `Order ID: ${order.id} (${order.status})`).join('\n');
       alert(`Your Orders:\n${orderIds}`);
     } catch (error) {
       console.error('Error fetching orders:', error);
@@ -172,7 +268,7 @@ function App() {
                   <button className="btn btn-secondary" onClick={handleViewOrders}>
                     📋 Order History
                   </button>
-                  <button className="btn btn-success" onClick={handleCheckout}>
+                  <button className="btn btn-success" onClick={() => handleCheckout()}>
                     💳 Checkout
                   </button>
                   <button className="btn btn-primary" onClick={handleLogout}>
@@ -1,149 +1,99 @@
-import React, { useState, useEffect } from 'react';
+import React, { useState, useEffect, useCallback } from 'react';
 import axios from 'axios';
+import { formatMoney } from '../money';
+import { thumbnailUrl } from '../images';
+import { variantLabel } from '../variants';
+
+const PAGE_SIZE = 20;
+
+// Orders the item list can be shown in, as sent to the API
+const SORT_OPTIONS = {
+  newest: { label: 'Newest', params: {} },
+  rating: { label: 'Top rated', params: { sort: 'rating', order: 'desc' } }
+};
 
 const ItemList = ({ onAddToCart }) => {
   const [items, setItems] = useState([]);
   const [loading, setLoading] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
   const [error, setError] = useState(null);
   const [selectedCategory, setSelectedCategory] = useState('All');
   const [categories, setCategories] = useState([]);
-  const [itemImages, setItemImages] = useState({});
+  const [nextCursor, setNextCursor] = useState(null);
+  const [totalCount, setTotalCount] = useState(0);
+  const [selectedVariants, setSelectedVariants] = useState({});
+  const [sortBy, setSortBy] = useState('newest');
 
-  useEffect(() => {
-    fetchItems();
-  }, []);
+  const fetchCategories = async () => {
+    try {
+      const response = await axios.get('/categories');
+      const topLevel = response.data.filter(category => !category.parent_id);
+      const allCount = topLevel.reduce((sum, category) => sum + category.item_count, 0);
+      setCategories([
+        { name: 'All', slug: null, item_count: allCount },
+        ...topLevel
+      ]);
+    } catch (error) {
+      console.error('Error fetching categories:', error);
+    }
+  };
 
-  const fetchItems = async () => {
+  // Items with variants show the chosen variant's price
+  const itemPrice = (item) => {
+    const variant = item.variants?.find(v => v.id === selectedVariants[item.id]);
+    return variant ? variant.price : item.price;
+  };
+
+  // Fetch one page of items, starting over when no cursor is given
+  const fetchItems = useCallback(async (category, cursor, sort) => {
     try {
-      setLoading(true);
-      const response = await axios.get('/items');
-      setItems(response.data);
-      
-      // Extract unique categories
-      const uniqueCategories = [...new Set(response.data.map(item => item.category))];
-      setCategories(['All', ...uniqueCategories]);
+      if (cursor) {
+        setLoadingMore(true);
+      } else {
+        setLoading(true);
+      }
+
+      const params = { limit: PAGE_SIZE, ...SORT_OPTIONS[sort].params };
+      if (category && category.slug) {
+        params.category = category.slug;
+      }
+      if (cursor) {
+        params.cursor = cursor;
+      }
 
-      // Fetch images for each item
-      await fetchItemImages(response.data);
+      const response = await axios.get('/items', { params });
+      setItems(previous => cursor ? [...previous, ...response.data] : response.data);
+      setNextCursor(response.headers['x-next-cursor'] || null);
+      setTotalCount(parseInt(response.headers['x-total-count'], 10) || response.data.length);
     } catch (error) {
       console.error('Error fetching items:', error);
       setError('Failed to load items');
     } finally {
       setLoading(false);
+      setLoadingMore(false);
     }
+  }, []);
+
+  useEffect(() => {
+    fetchCategories();
+    fetchItems(null, null, 'newest');
+  }, [fetchItems]);
+
+  const selectCategory = (category) => {
+    setSelectedCategory(category.name);
+    fetchItems(category, null, sortBy);
   };
 
-  const fetchItemImages = async (itemsList) => {
-    const images = {};
-    
-    // Product-specific image mapping
-    const productImages = {
-      // Electronics
-      'MacBook Pro': 'https://images.unsplash.com/photo-1517336714731-489689fd1ca8?w=400&h=300&fit=crop',
-      'iPhone 15': 'https://images.unsplash.com/photo-1592750475338-74b7b21085ab?w=400&h=300&fit=crop',
-      'Sony WH-1000XM4': 'https://images.unsplash.com/photo-1505740420928-5e560c06d30e?w=400&h=300&fit=crop',
-      'Samsung Galaxy S24': 'https://images.unsplash.com/photo-1610945265064-0e34e5519bbf?w=400&h=300&fit=crop',
-      'iPad Pro': 'https://images.unsplash.com/photo-1544244015-0df4b3ffc6b0?w=400&h=300&fit=crop',
-      'Dell XPS 13': 'https://images.unsplash.com/photo-1588872657578-7efd1f1555ed?w=400&h=300&fit=crop',
-      'AirPods Pro': 'https://images.unsplash.com/photo-1606220945770-b5b6c2c55bf1?w=400&h=300&fit=crop',
-      'Nintendo Switch': 'https://images.unsplash.com/photo-1578303512597-81e6cc155b3e?w=400&h=300&fit=crop',
-      'GoPro Hero 11': 'https://images.unsplash.com/photo-1526170375885-4d8ecf77b99f?w=400&h=300&fit=crop',
-      'Canon EOS R5': 'https://images.unsplash.com/photo-1516035069371-29a1b244cc32?w=400&h=300&fit=crop',
-      
-      // Clothing
-      'Nike Air Max': 'https://images.unsplash.com/photo-1542291026-7eec264c27ff?w=400&h=300&fit=crop',
-      'Levi\'s 501 Jeans': 'https://images.unsplash.com/photo-1542272604-787c3835535d?w=400&h=300&fit=crop',
-      'Adidas Ultraboost': 'https://images.unsplash.com/photo-1608231387042-66d1773070a5?w=400&h=300&fit=crop',
-      'Ray-Ban Aviator': 'https://images.unsplash.com/photo-1572635196237-14b3f281503f?w=400&h=300&fit=crop',
-      'Rolex Submariner': 'https://images.unsplash.com/photo-1524592094714-0f0654e20314?w=400&h=300&fit=crop',
-      'Hermès Birkin': 'https://images.unsplash.com/photo-1584917865442-de89df76afd3?w=400&h=300&fit=crop',
-      'Gucci Sneakers': 'https://images.unsplash.com/photo-1606107557195-0e29a4b5b4aa?w=400&h=300&fit=crop',
-      'Chanel No. 5': 'https://images.unsplash.com/photo-1541643600914-78b084683601?w=400&h=300&fit=crop',
-      'Prada Bag': 'https://images.unsplash.com/photo-1594223274512-ad4803739b7c?w=400&h=300&fit=crop',
-      'Supreme Hoodie': 'https://images.unsplash.com/photo-1556821840-3a63f95609a7?w=400&h=300&fit=crop',
-      'T-Shirt': 'https://images.unsplash.com/photo-1521572163474-6864f9cf17ab?w=400&h=300&fit=crop',
-      'Dress': 'https://images.unsplash.com/photo-1595777457583-95e059d581b8?w=400&h=300&fit=crop',
-      'Jacket': 'https://images.unsplash.com/photo-1551028719-00167b16eac5?w=400&h=300&fit=crop',
-      'Sweater': 'https://images.unsplash.com/photo-1434389677669-e08b4cac3105?w=400&h=300&fit=crop',
-      'Shorts': 'https://images.unsplash.com/photo-1542272604-787c3835535d?w=400&h=300&fit=crop',
-      
-      // Home & Garden
-      'IKEA Billy Bookcase': 'https://images.unsplash.com/photo-1586023492125-27b2c045efd7?w=400&h=300&fit=crop',
-      'Philips Hue Bulbs': 'https://images.unsplash.com/photo-1507473885765-e6ed057f782c?w=400&h=300&fit=crop',
-      'Dyson V15': 'https://images.unsplash.com/photo-1581578731548-c64695cc6952?w=400&h=300&fit=crop',
-      'KitchenAid Mixer': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Nest Thermostat': 'https://images.unsplash.com/photo-1558618666-fcd25c85cd64?w=400&h=300&fit=crop',
-      'Weber Grill': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Roomba i7+': 'https://images.unsplash.com/photo-1581578731548-c64695cc6952?w=400&h=300&fit=crop',
-      'Samsung Smart TV': 'https://images.unsplash.com/photo-1593359677879-a4bb92f829d1?w=400&h=300&fit=crop',
-      'Bose Soundbar': 'https://images.unsplash.com/photo-1545454675-3531b543be5d?w=400&h=300&fit=crop',
-      'Instant Pot': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Coffee Maker': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Blender': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Toaster': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Microwave': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      'Refrigerator': 'https://images.unsplash.com/photo-1556909114-f6e7ad7d3136?w=400&h=300&fit=crop',
-      
-      // Books
-      'The Great Gatsby': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'Harry Potter Set': 'https://images.unsplash.com/photo-1603871165848-0aa92c869fa1?w=400&h=300&fit=crop',
-      '1984 by Orwell': 'https://images.unsplash.com/photo-1544947950-fa07a98d237f?w=400&h=300&fit=crop',
-      'Pride and Prejudice': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'The Hobbit': 'https://images.unsplash.com/photo-1603871165848-0aa92c869fa1?w=400&h=300&fit=crop',
-      'To Kill a Mockingbird': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'The Catcher in the Rye': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'Lord of the Rings': 'https://images.unsplash.com/photo-1603871165848-0aa92c869fa1?w=400&h=300&fit=crop',
-      'The Alchemist': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'Rich Dad Poor Dad': 'https://images.unsplash.com/photo-1543002588-bfa74002ed7e?w=400&h=300&fit=crop',
-      'Programming Guide': 'https://images.unsplash.com/photo-1517077304055-6e89abbf09b0?w=400&h=300&fit=crop',
-      
-      // Sports
-      'Nike Basketball': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Adidas Soccer Cleats': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Wilson Tennis Racket': 'https://images.unsplash.com/photo-1551698618-1dfe5d97d256?w=400&h=300&fit=crop',
-      'Callaway Golf Clubs': 'https://images.unsplash.com/photo-1551698618-1dfe5d97d256?w=400&h=300&fit=crop',
-      'Yoga Mat': 'https://images.unsplash.com/photo-1544367567-0f2fcb009e0b?w=400&h=300&fit=crop',
-      'Dumbbells Set': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Bicycle': 'https://images.unsplash.com/photo-1532298229144-0ec0c57515c7?w=400&h=300&fit=crop',
-      'Skateboard': 'https://images.unsplash.com/photo-1572776685600-c7d034c8b89f?w=400&h=300&fit=crop',
-      'Surfboard': 'https://images.unsplash.com/photo-1502680390469-be75c86b636f?w=400&h=300&fit=crop',
-      'Treadmill': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Basketball': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Soccer Ball': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop',
-      'Tennis Ball': 'https://images.unsplash.com/photo-1551698618-1dfe5d97d256?w=400&h=300&fit=crop',
-      'Golf Ball': 'https://images.unsplash.com/photo-1551698618-1dfe5d97d256?w=400&h=300&fit=crop',
-      'Running Shoes': 'https://images.unsplash.com/photo-1542291026-7eec264c27ff?w=400&h=300&fit=crop'
-    };
-    
-    for (const item of itemsList) {
-      try {
-        // Check if we have a specific image for this product
-        if (productImages[item.name]) {
-          images[item.id] = productImages[item.name];
-        } else {
-          // Fallback: search for category-specific images
-          const categoryImages = {
-            'Electronics': 'https://images.unsplash.com/photo-1498049794561-7780e7231661?w=400&h=300&fit=crop',
-            'Clothing': 'https://images.unsplash.com/photo-1441986300917-64674bd600d8?w=400&h=300&fit=crop',
-            'Home & Garden': 'https://images.unsplash.com/photo-1586023492125-27b2c045efd7?w=400&h=300&fit=crop',
-            'Books': 'https://images.unsplash.com/photo-1544947950-fa07a98d237f?w=400&h=300&fit=crop',
-            'Sports': 'https://images.unsplash.com/photo-1571019613454-1cb2f99b2d8b?w=400&h=300&fit=crop'
-          };
-          images[item.id] = categoryImages[item.category] || 'https://images.unsplash.com/photo-1498049794561-7780e7231661?w=400&h=300&fit=crop';
-        }
-      } catch (error) {
-        console.error(`Error fetching image for ${item.name}:`, error);
-        // Final fallback
-        images[item.id] = 'https://images.unsplash.com/photo-1498049794561-7780e7231661?w=400&h=300&fit=crop';
-      }
-    }
-    
-    setItemImages(images);
+  const selectSort = (sort) => {
+    setSortBy(sort);
+    const category = categories.find(category => category.name === selectedCategory);
+    fetchItems(category, null, sort);
   };
 
-  const filteredItems = selectedCategory === 'All' 
-    ? items 
-    : items.filter(item => item.category === selectedCategory);
+  const loadMore = () => {
+    const category = categories.find(category => category.name === selectedCategory);
+    fetchItems(category, nextCursor, sortBy);
+  };
 
   const getCategoryIcon = (category) => {
     const icons = {
@@ -195,28 +145,25 @@ const ItemList = ({ onAddToCart }) => {
         <div className="categories-grid">
           {categories.map(category => (
             <div
-              key={category}
+              key={category.name}
               className="category-card"
-              onClick={() => setSelectedCategory(category)}
+              onClick={() => selectCategory(category)}
               style={{
-                border: selectedCategory === category ? '3px solid #667eea' : '1px solid rgba(255, 255, 255, 0.2)',
-                transform: selectedCategory === category ? 'translateY(-5px)' : 'translateY(0)'
+                border: selectedCategory === category.name ? '3px solid #667eea' : '1px solid rgba(255, 255, 255, 0.2)',
+                transform: selectedCategory === category.name ? 'translateY(-5px)' : 'translateY(0)'
               }}
             >
               <div className="category-title">
                 <div 
                   className="category-icon"
-                  style={{ background: getCategoryColor(category) }}
+                  style={{ background: getCategoryColor(category.name) }}
                 >
-                  {getCategoryIcon(category)}
+                  {getCategoryIcon(category.name)}
                 </div>
-                {category}
+                {category.name}
               </div>
               <div style={{ color: '#666', fontSize: '0.9rem' }}>
-                {category === 'All' 
-                  ? `${items.length} items` 
-                  : `${items.filter(item => item.category === category).length} items`
-                }
+                {`${category.item_count} items`}
               </div>
             </div>
           ))}
@@ -226,15 +173,24 @@ const ItemList = ({ onAddToCart }) => {
       {/* Items Section */}
       <div>
         <h2 className="categories-title">
-          {selectedCategory === 'All' ? 'All Products' : `${selectedCategory} Products`} ({filteredItems.length} items)
+          {selectedCategory === 'All' ? 'All Products' : `${selectedCategory} Products`} ({totalCount} items)
         </h2>
+        <select
+          className="sort-select"
+          value={sortBy}
+          onChange={(e) => selectSort(e.target.value)}
+        >
+          {Object.entries(SORT_OPTIONS).map(([value, option]) => (
+            <option key={value} value={value}>{option.label}</option>
+          ))}
+        </select>
         <div className="items-grid">
-          {filteredItems.map(item => (
+          {items.map(item => (
             <div key={item.id} className="item-card">
               <div className="item-image">
-                {itemImages[item.id] ? (
-                  <img 
-                    src={itemImages[item.id]} 
+                {thumbnailUrl(item) ? (
+                  <img
+                    src={thumbnailUrl(item)}
                     alt={item.name}
                     style={{
                       width: '100%',
@@ -247,27 +203,13 @@ const ItemList = ({ onAddToCart }) => {
                       e.target.nextSibling.style.display = 'flex';
                     }}
                   />
-                ) : (
-                  <div style={{
-                    width: '100%',
-                    height: '100%',
-                    background: 'linear-gradient(135deg, #667eea, #764ba2)',
-                    display: 'flex',
-                    alignItems: 'center',
-                    justifyContent: 'center',
-                    fontSize: '4rem',
-                    color: 'white',
-                    fontWeight: '700'
-                  }}>
-                    {item.name.charAt(0)}
-                  </div>
-                )}
-                {/* Fallback placeholder */}
+                ) : null}
+                {/* Placeholder for items without images */}
                 <div style={{
                   width: '100%',
                   height: '100%',
                   background: 'linear-gradient(135deg, #667eea, #764ba2)',
-                  display: itemImages[item.id] ? 'none' : 'flex',
+                  display: thumbnailUrl(item) ? 'none' : 'flex',
                   alignItems: 'center',
                   justifyContent: 'center',
                   fontSize: '4rem',
@@ -283,11 +225,31 @@ const ItemList = ({ onAddToCart }) => {
               <div className="item-details">
                 <div className="item-category">{item.category}</div>
                 <div className="item-name">{item.name}</div>
+                {item.review_count > 0 && (
+                  <div className="item-rating">
+                    ★ {item.rating.toFixed(1)} ({item.review_count} {item.review_count === 1 ? 'review' : 'reviews'})
+                  </div>
+                )}
                 <div className="item-description">{item.description}</div>
-                <div className="item-price">${item.price.toFixed(2)}</div>
+                <div className="item-price">{formatMoney(itemPrice(item))}</div>
+                {item.variants?.length > 0 && (
+                  <select
+                    className="variant-select"
+                    value={selectedVariants[item.id] || ''}
+                    onChange={(e) => setSelectedVariants({ ...selectedVariants, [item.id]: Number(e.target.value) })}
+                  >
+                    <option value="" disabled>Choose an option</option>
+                    {item.variants.map(variant => (
+                      <option key={variant.id} value={variant.id} disabled={variant.stock === 0}>
+                        {variantLabel(variant)}{variant.stock === 0 ? ' (sold out)' : ''}
+                      </option>
+                    ))}
+                  </select>
+                )}
                 <button
                   className="add-to-cart-btn"
-                  onClick={() => onAddToCart(item.id)}
+                  onClick={() => onAddToCart(item.id, selectedVariants[item.id])}
+                  disabled={item.variants?.length > 0 && !selectedVariants[item.id]}
                 >
                   🛒 Add to Cart
                 </button>
@@ -295,8 +257,20 @@ const ItemList = ({ onAddToCart }) => {
             </div>
           ))}
         </div>
+
+        {nextCursor && (
+          <div style={{ textAlign: 'center', padding: '30px' }}>
+            <button
+              className="btn btn-primary"
+              onClick={loadMore}
+              disabled={loadingMore}
+            >
+              {loadingMore ? '🔄 Loading...' : `Load more (${items.length} of ${totalCount})`}
+            </button>
+          </div>
+        )}
         
-        {filteredItems.length === 0 && (
+        {items.length === 0 && (
           <div style={{ 
             textAlign: 'center', 
             color: 'white', 
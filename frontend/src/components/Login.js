@@ -16,7 +16,7 @@ const Login = ({ onLogin }) => {
         password
       });
 
-      onLogin(response.data.user, response.data.token);
+      onLogin(response.data.user, response.data.token, response.data.refresh_token);
     } catch (error) {
       console.error('Login error:', error);
       if (error.response && error.response.status === 401) {
@@ -0,0 +1,12 @@
+import axios from 'axios';
+
+// Image URLs from the API are paths on the API's server, such as
+// "/api/images/item-1-3f2a….jpg". thumbnailUrl resolves the item's first
+// thumbnail against that server, or returns null when it has no images.
+export const thumbnailUrl = (item) => {
+  const image = item?.images?.[0];
+  if (!image) return null;
+
+  const server = new URL(axios.defaults.baseURL || '/', window.location.href);
+  return new URL(image.thumbnail_url, server).href;
+};
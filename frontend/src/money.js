@@ -0,0 +1,15 @@
+// Prices come from the API as { amount: "12.99", currency: "USD" }. The amount
+// is a decimal string so that it is never rounded on its way to the browser.
+export const formatMoney = (money) => {
+  if (!money) return '';
+
+  const amount = Number(money.amount);
+  try {
+    return new Intl.NumberFormat(undefined, {
+      style: 'currency',
+      currency: money.currency,
+    }).format(amount);
+  } catch (error) {
+    return `${money.amount} ${money.currency}`;
+  }
+};
@@ -0,0 +1,10 @@
+// Variants name their options as { size: "M", colour: "Black" }. The label
+// lists the values in option name order, as in "Black / M".
+export const variantLabel = (variant) => {
+  if (!variant?.options) return '';
+
+  return Object.keys(variant.options)
+    .sort()
+    .map(name => variant.options[name])
+    .join(' / ');
+};
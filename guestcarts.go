@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Guest carts are named by a signed guest cart token, sent back in this
+// header or cookie
+const (
+	CartTokenHeader = "X-Cart-Token"
+	CartTokenCookie = "cart_token"
+)
+
+// Reasons a guest cart line could not be merged in full
+const (
+	MergeMaxQuantity = "max_quantity"
+	MergeStock       = "stock"
+	MergeCurrency    = "currency"
+)
+
+// CartAdjustment reports a guest cart line that did not fit into the user's
+// cart. Quantity is what the user's cart holds of the item after the merge,
+// and Requested what it would have held.
+type CartAdjustment struct {
+	ItemID    uint   `json:"item_id"`
+	VariantID *uint  `json:"variant_id,omitempty"`
+	Requested uint   `json:"requested"`
+	Quantity  uint   `json:"quantity"`
+	Reason    string `json:"reason"`
+}
+
+// cartOwner lets guests use the cart routes as well as signed-in users.
+// Requests with an Authorization header go through authMiddleware. Other
+// requests belong to the guest named by their guest cart token, and a guest
+// without a valid token is given a new one. The guest's ID is available as
+// "guest_id".
+func cartOwner(tokens *TokenService) gin.HandlerFunc {
+	auth := authMiddleware(tokens)
+
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			auth(c)
+			return
+		}
+
+		guestID, err := tokens.ParseGuestCart(guestCartToken(c))
+		if err != nil {
+			var token string
+			token, guestID, err = tokens.IssueGuestCart()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start guest cart"})
+				c.Abort()
+				return
+			}
+			setGuestCartToken(c, token, int(GuestCartTTL.Seconds()))
+		}
+
+		c.Set("guest_id", guestID)
+		c.Next()
+	}
+}
+
+// guestCartToken returns the guest cart token sent with the request, if any
+func guestCartToken(c *gin.Context) string {
+	if token := c.GetHeader(CartTokenHeader); token != "" {
+		return token
+	}
+	token, _ := c.Cookie(CartTokenCookie)
+	return token
+}
+
+// setGuestCartToken hands token to the client in both the header and the
+// cookie. A negative maxAge clears the cookie.
+func setGuestCartToken(c *gin.Context, token string, maxAge int) {
+	c.Header(CartTokenHeader, token)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(CartTokenCookie, token, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+// ownedCart scopes db to the cart of the requesting user or guest
+func ownedCart(db *gorm.DB, c *gin.Context) *gorm.DB {
+	if userID := c.GetUint("user_id"); userID != 0 {
+		return db.Where("user_id = ?", userID)
+	}
+	return db.Where("user_id = 0 AND guest_id = ?", c.GetString("guest_id"))
+}
+
+// mergeGuestCart moves guestID's cart into userID's cart. A user without a
+// cart simply takes the guest cart over. Otherwise quantities of the same
+// item and variant are summed, up to the item's per-cart limit and the stock available,
+// and the guest's coupon is kept when the user's cart has none. Lines priced
+// in another currency than the user's cart are dropped. Lines that did not
+// fit in full are returned. Call it inside a transaction.
+func mergeGuestCart(tx *gorm.DB, guestID string, userID uint) ([]CartAdjustment, error) {
+	var guest Cart
+	err := tx.Where("user_id = 0 AND guest_id = ?", guestID).Preload("Items.Item").Preload("Items.Variant").First(&guest).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cart Cart
+	err = tx.Where("user_id = ?", userID).Preload("Items.Item").Preload("Items.Variant").First(&cart).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, tx.Model(&guest).Updates(map[string]interface{}{"user_id": userID, "guest_id": ""}).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Lines are keyed by item and variant; lines without a variant use 0
+	type lineKey struct{ itemID, variantID uint }
+	keyOf := func(line CartItem) lineKey {
+		if line.VariantID == nil {
+			return lineKey{line.ItemID, 0}
+		}
+		return lineKey{line.ItemID, *line.VariantID}
+	}
+
+	lines := map[lineKey]CartItem{}
+	currency := ""
+	for _, line := range cart.Items {
+		lines[keyOf(line)] = line
+		currency = line.UnitPrice().Currency
+	}
+
+	adjustments := []CartAdjustment{}
+	for _, guestLine := range guest.Items {
+		// Release the guest's reservation first so its units can move over
+		if err := tx.Delete(&guestLine).Error; err != nil {
+			return nil, err
+		}
+
+		line, ok := lines[keyOf(guestLine)]
+		if !ok {
+			line = CartItem{CartID: cart.ID, ItemID: guestLine.ItemID, VariantID: guestLine.VariantID, Price: guestLine.Price}
+		}
+		requested := line.Quantity + guestLine.Quantity
+		adjustment := CartAdjustment{ItemID: guestLine.ItemID, VariantID: guestLine.VariantID, Requested: requested}
+
+		if currency != "" && guestLine.UnitPrice().Currency != currency {
+			adjustment.Quantity, adjustment.Reason = line.Quantity, MergeCurrency
+			adjustments = append(adjustments, adjustment)
+			continue
+		}
+
+		quantity, reason := requested, ""
+		if limit := guestLine.Item.QuantityLimit(); quantity > limit {
+			quantity, reason = limit, MergeMaxQuantity
+		}
+		available, err := availableStock(tx, guestLine.ItemID, guestLine.VariantID, cart.ID)
+		if err != nil {
+			return nil, err
+		}
+		if quantity > available {
+			quantity, reason = available, MergeStock
+		}
+
+		// The user's own line is never shrunk by the merge
+		if quantity > line.Quantity {
+			if err := reserveStock(tx, &line, quantity); err != nil {
+				return nil, err
+			}
+			currency = guestLine.UnitPrice().Currency
+		}
+		if reason != "" {
+			adjustment.Quantity, adjustment.Reason = line.Quantity, reason
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+
+	if cart.PromotionID == nil && guest.PromotionID != nil {
+		if err := tx.Model(&cart).Update("promotion_id", *guest.PromotionID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return adjustments, tx.Delete(&guest).Error
+}
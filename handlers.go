@@ -1,10 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -14,54 +21,308 @@ import (
 
 // Handler structs
 type UserHandler struct {
-	db *gorm.DB
+	db     *gorm.DB
+	tokens *TokenService
 }
 
+// ItemHandler keeps the full-text search index in step with item changes
+// when fullTextSearch is set
 type ItemHandler struct {
+	db             *gorm.DB
+	fullTextSearch bool
+	images         ImageStore
+}
+
+type CategoryHandler struct {
 	db *gorm.DB
 }
 
+// CartHandler prices carts with taxes and quotes shipping through shipping
 type CartHandler struct {
+	db       *gorm.DB
+	taxes    TaxCalculator
+	shipping ShippingRateProvider
+}
+
+type AddressHandler struct {
 	db *gorm.DB
 }
 
-type OrderHandler struct {
+// WishlistHandler prices the carts items move in and out of with taxes
+type WishlistHandler struct {
+	db    *gorm.DB
+	taxes TaxCalculator
+}
+
+type PromotionHandler struct {
 	db *gorm.DB
 }
 
+type ReviewHandler struct {
+	db *gorm.DB
+}
+
+// OrderHandler taxes orders with taxes, ships them through shipping and
+// charges them through payments, giving every provider call paymentTimeout
+// to answer
+type OrderHandler struct {
+	db             *gorm.DB
+	taxes          TaxCalculator
+	shipping       ShippingRateProvider
+	payments       PaymentProvider
+	paymentTimeout time.Duration
+}
+
 // Request/Response structs
 type CreateUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
 
+// LoginRequest may name the device signing in, so it can be told apart in
+// the session list
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Device   string `json:"device"`
 }
 
+// LoginResponse lists the guest cart lines that did not fit into the user's
+// cart when signing in merged their guest cart
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token            string           `json:"token"`
+	ExpiresAt        time.Time        `json:"expires_at"`
+	RefreshToken     string           `json:"refresh_token"`
+	RefreshExpiresAt time.Time        `json:"refresh_expires_at"`
+	User             User             `json:"user"`
+	CartAdjustments  []CartAdjustment `json:"cart_adjustments,omitempty"`
+}
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 type CreateItemRequest struct {
-	Name        string  `json:"name" binding:"required"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price" binding:"required"`
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Price       Money  `json:"price"`
+	Category    string `json:"category"`
+	CategoryID  *uint  `json:"category_id"`
+	MaxQuantity uint   `json:"max_quantity"`
+	WeightGrams uint   `json:"weight_grams"`
+	Stock       uint   `json:"stock"`
+}
+
+// UpdateItemRequest only changes the fields that are present, so it serves
+// both PUT and PATCH
+type UpdateItemRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Price       *Money  `json:"price"`
+	Category    *string `json:"category"`
+	CategoryID  *uint   `json:"category_id"`
+	MaxQuantity *uint   `json:"max_quantity"`
+	WeightGrams *uint   `json:"weight_grams"`
+	Stock       *uint   `json:"stock"`
+}
+
+// VariantRequest describes a new variant of an item. PriceOverride replaces
+// the item's price when it is given.
+type VariantRequest struct {
+	SKU           string         `json:"sku" binding:"required"`
+	Options       VariantOptions `json:"options" binding:"required"`
+	PriceOverride *Money         `json:"price_override"`
+	Stock         uint           `json:"stock"`
+}
+
+// UpdateVariantRequest only changes the fields that are present, so it
+// serves both PUT and PATCH. A zero price_override removes the override.
+type UpdateVariantRequest struct {
+	SKU           *string        `json:"sku"`
+	Options       VariantOptions `json:"options"`
+	PriceOverride *Money         `json:"price_override"`
+	Stock         *uint          `json:"stock"`
 }
 
+type CreateCategoryRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Slug     string `json:"slug"`
+	ParentID *uint  `json:"parent_id"`
+}
+
+// CreateCartRequest adds one unit of an item to the cart. Items with
+// variants need VariantID.
 type CreateCartRequest struct {
-	ItemID uint `json:"item_id" binding:"required"`
+	ItemID    uint  `json:"item_id" binding:"required"`
+	VariantID *uint `json:"variant_id"`
+}
+
+type ApplyCouponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// AcknowledgePricesRequest names the version of the cart the user reviewed
+type AcknowledgePricesRequest struct {
+	CartVersion string `json:"cart_version" binding:"required"`
+}
+
+// CreatePromotionRequest describes a new promotion. Only the fields its type
+// uses are needed; ItemIDs and CategoryIDs restrict it to those items and
+// categories.
+type CreatePromotionRequest struct {
+	Code         string     `json:"code" binding:"required"`
+	Description  string     `json:"description"`
+	Type         string     `json:"type" binding:"required"`
+	PercentOff   uint       `json:"percent_off"`
+	AmountOff    Money      `json:"amount_off"`
+	BuyQuantity  uint       `json:"buy_quantity"`
+	GetQuantity  uint       `json:"get_quantity"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	UsageLimit   uint       `json:"usage_limit"`
+	PerUserLimit uint       `json:"per_user_limit"`
+	ItemIDs      []uint     `json:"item_ids"`
+	CategoryIDs  []uint     `json:"category_ids"`
 }
 
+type UpdateCartItemRequest struct {
+	Quantity *uint `json:"quantity" binding:"required"`
+}
+
+// CreateOrderRequest names the cart to check out and the payment source,
+// such as a card token, to charge for it. The order ships to the user's
+// default address and bills the shipping address unless told otherwise,
+// using the cheapest shipping method when none is chosen. It is taxed in
+// TaxRegion, or else the region of the shipping address or the default
+// region. CartVersion is the version of the cart the user reviewed; it is
+// needed once a price in the cart changed.
 type CreateOrderRequest struct {
-	CartID uint `json:"cart_id" binding:"required"`
+	CartID            uint   `json:"cart_id" binding:"required"`
+	PaymentSource     string `json:"payment_source" binding:"required"`
+	ShippingAddressID *uint  `json:"shipping_address_id"`
+	BillingAddressID  *uint  `json:"billing_address_id"`
+	ShippingMethod    string `json:"shipping_method"`
+	TaxRegion         string `json:"tax_region"`
+	CartVersion       string `json:"cart_version"`
+}
+
+// AddressRequest creates or replaces an address. Setting IsDefault makes it
+// the user's default address.
+type AddressRequest struct {
+	Name       string `json:"name" binding:"required"`
+	Line1      string `json:"line1" binding:"required"`
+	Line2      string `json:"line2"`
+	City       string `json:"city" binding:"required"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code" binding:"required"`
+	Country    string `json:"country" binding:"required"`
+	Phone      string `json:"phone"`
+	IsDefault  bool   `json:"is_default"`
+}
+
+func (req AddressRequest) postalAddress() PostalAddress {
+	return PostalAddress{
+		Name:       req.Name,
+		Line1:      req.Line1,
+		Line2:      req.Line2,
+		City:       req.City,
+		Region:     req.Region,
+		PostalCode: req.PostalCode,
+		Country:    req.Country,
+		Phone:      req.Phone,
+	}
+}
+
+// WishlistRequest creates or updates a wishlist. Making it public gives it a
+// share link; making it private revokes the link.
+type WishlistRequest struct {
+	Name     string `json:"name" binding:"required"`
+	IsPublic bool   `json:"is_public"`
+}
+
+// AddWishlistItemRequest saves Quantity units of an item, one when it is
+// not given. VariantID may pick one of the item's variants.
+type AddWishlistItemRequest struct {
+	ItemID    uint  `json:"item_id" binding:"required"`
+	VariantID *uint `json:"variant_id"`
+	Quantity  uint  `json:"quantity"`
+}
+
+// MoveToWishlistRequest may name the wishlist a cart line is saved to
+type MoveToWishlistRequest struct {
+	WishlistID *uint `json:"wishlist_id"`
+}
+
+// ReviewRequest writes or rewrites a review with a rating from 1 to 5
+type ReviewRequest struct {
+	Rating int    `json:"rating" binding:"required"`
+	Title  string `json:"title" binding:"required"`
+	Body   string `json:"body"`
+}
+
+// FlagReviewRequest tells the moderators what is wrong with a review
+type FlagReviewRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// ModerateReviewRequest approves or hides a review
+type ModerateReviewRequest struct {
+	Status string `json:"status" binding:"required"`
+}
+
+// ConfirmPaymentRequest carries the customer's answer to a payment challenge
+type ConfirmPaymentRequest struct {
+	ChallengeResponse string `json:"challenge_response" binding:"required"`
+}
+
+// CancelOrderRequest may ask for the order's items to be put back in the
+// user's cart so they can be changed and checked out again
+type CancelOrderRequest struct {
+	Reason      string `json:"reason" binding:"required"`
+	RestoreCart bool   `json:"restore_cart"`
+}
+
+type UpdateOrderStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Note   string `json:"note"`
+}
+
+// CheckoutError reports which step of checkout failed. It is returned from
+// inside the checkout transaction so that the whole checkout rolls back.
+// Payment failures happen after the order was placed, so they carry the
+// cancelled order's ID and the provider's decline code. A cart whose prices
+// changed comes back with the changes and its current version.
+type CheckoutError struct {
+	Status    int    `json:"-"`
+	Step      string `json:"step"`
+	Message   string `json:"error"`
+	ItemID    uint   `json:"item_id,omitempty"`
+	VariantID *uint  `json:"variant_id,omitempty"`
+	Available *uint  `json:"available,omitempty"`
+	OrderID   uint   `json:"order_id,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Err       error  `json:"-"`
+
+	PriceChanges []PriceChange `json:"price_changes,omitempty"`
+	CartVersion  string        `json:"cart_version,omitempty"`
+}
+
+func (e *CheckoutError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("checkout failed at %s: %s: %v", e.Step, e.Message, e.Err)
+	}
+	return fmt.Sprintf("checkout failed at %s: %s", e.Step, e.Message)
 }
 
 // JWT Claims
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID    uint   `json:"user_id"`
+	SessionID uint   `json:"session_id"`
+	TokenType string `json:"token_type"`
 	jwt.RegisteredClaims
 }
 
@@ -87,13 +348,10 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
-	// Generate token
-	token := generateToken()
-
 	user := User{
 		Username: req.Username,
 		Password: string(hashedPassword),
-		Token:    token,
+		Role:     RoleCustomer,
 	}
 
 	if err := h.db.Create(&user).Error; err != nil {
@@ -101,9 +359,22 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
-	// Don't return password
-	user.Password = ""
-	c.JSON(http.StatusCreated, user)
+	// Keep what they put in their cart before signing up
+	adjustments, err := h.claimGuestCart(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge guest cart"})
+		return
+	}
+
+	// Sign the new user in straight away, answering as Login does
+	response, err := h.startSession(c, user, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	response.CartAdjustments = adjustments
+
+	c.JSON(http.StatusCreated, response)
 }
 
 func (h *UserHandler) ListUsers(c *gin.Context) {
@@ -140,259 +411,3128 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Generate new token
-	token := generateToken()
-	user.Token = token
-	h.db.Save(&user)
-
-	// Don't return password
-	user.Password = ""
+	// Bring along what they put in their cart before signing in
+	adjustments, err := h.claimGuestCart(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge guest cart"})
+		return
+	}
 
-	response := LoginResponse{
-		Token: token,
-		User:  user,
+	response, err := h.startSession(c, user, req.Device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
 	}
+	response.CartAdjustments = adjustments
 
 	c.JSON(http.StatusOK, response)
 }
 
-// Item Handlers
-func (h *ItemHandler) CreateItem(c *gin.Context) {
-	var req CreateItemRequest
+// UpdateUserRole grants a user a role, replacing their current one. The last
+// admin cannot be demoted, so the store always keeps someone who can manage it.
+func (h *UserHandler) UpdateUserRole(c *gin.Context) {
+	var req UpdateUserRoleRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	item := Item{
-		Name:        req.Name,
-		Description: req.Description,
-		Price:       req.Price,
+	if !(User{Role: req.Role}).HasRole(validRoles...) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of " + strings.Join(validRoles, ", ")})
+		return
 	}
 
-	if err := h.db.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+	var user User
+	if err := h.db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, item)
-}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if user.Role == RoleAdmin && req.Role != RoleAdmin {
+			var admins int
+			if err := tx.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error; err != nil {
+				return err
+			}
+			if admins <= 1 {
+				return errLastAdmin
+			}
+		}
 
-func (h *ItemHandler) ListItems(c *gin.Context) {
-	var items []Item
-	if err := h.db.Find(&items).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch items"})
+		return tx.Model(&user).Update("role", req.Role).Error
+	})
+	if errors.Is(err, errLastAdmin) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
 		return
 	}
 
-	c.JSON(http.StatusOK, items)
+	// Don't return password
+	user.Password = ""
+	c.JSON(http.StatusOK, user)
 }
 
-// Cart Handlers
-func (h *CartHandler) CreateCart(c *gin.Context) {
-	var req CreateCartRequest
+// Refresh exchanges a valid refresh token for a new access and refresh token
+func (h *UserHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	userID := c.GetUint("user_id")
-
-	// Check if item exists
-	var item Item
-	if err := h.db.First(&item, req.ItemID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	claims, err := h.tokens.Parse(req.RefreshToken, RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		return
 	}
 
-	// Get or create cart for user
-	var cart Cart
-	if err := h.db.Where("user_id = ?", userID).First(&cart).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create new cart
-			cart = Cart{UserID: userID}
-			if err := h.db.Create(&cart).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
-				return
-			}
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart"})
-			return
-		}
+	// Make sure the session has not been revoked and the user still exists
+	session, ok := findActiveSession(h.db, claims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
 	}
 
-	// Check if item already exists in cart
-	var existingCartItem CartItem
-	if err := h.db.Where("cart_id = ? AND item_id = ?", cart.ID, req.ItemID).First(&existingCartItem).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Item doesn't exist in cart, create new cart item
-			cartItem := CartItem{
-				CartID:   cart.ID,
-				ItemID:   req.ItemID,
-				Quantity: 1,
-			}
+	var user User
+	if err := h.db.First(&user, claims.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
 
-			if err := h.db.Create(&cartItem).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to cart"})
-				return
-			}
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check cart"})
-			return
-		}
-	} else {
-		// Item exists, increment quantity
-		existingCartItem.Quantity++
-		if err := h.db.Save(&existingCartItem).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
-			return
-		}
+	response, err := h.issueTokens(user, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
 	}
 
-	// Load cart with items
-	h.db.Preload("Items.Item").First(&cart, cart.ID)
+	// The session lives as long as its newest refresh token
+	h.db.Model(&session).Updates(map[string]interface{}{
+		"expires_at":   response.RefreshExpiresAt,
+		"last_seen_at": time.Now(),
+		"ip_address":   c.ClientIP(),
+	})
 
-	c.JSON(http.StatusCreated, cart)
+	c.JSON(http.StatusOK, response)
 }
 
-func (h *CartHandler) ListCarts(c *gin.Context) {
-	userID := c.GetUint("user_id")
-
-	var carts []Cart
-	if err := h.db.Where("user_id = ?", userID).Preload("Items.Item").Find(&carts).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch carts"})
+// Logout revokes the session of the token used for the request
+func (h *UserHandler) Logout(c *gin.Context) {
+	if err := revokeSessions(h.tokens, h.db.Where("id = ?", c.GetUint("session_id"))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
 		return
 	}
 
-	c.JSON(http.StatusOK, carts)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
 }
 
-func (h *CartHandler) RemoveFromCart(c *gin.Context) {
-	userID := c.GetUint("user_id")
-	itemID := c.Param("item_id")
+// ListSessions lists the current user's active sessions, most recently used
+// first
+func (h *UserHandler) ListSessions(c *gin.Context) {
+	var sessions []Session
+	if err := activeSessions(h.db, c.GetUint("user_id")).Order("last_seen_at DESC, id DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
 
-	// Get user's cart
-	var cart Cart
-	if err := h.db.Where("user_id = ?", userID).First(&cart).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == c.GetUint("session_id")
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs out one of the current user's sessions
+func (h *UserHandler) RevokeSession(c *gin.Context) {
+	var session Session
+	if err := activeSessions(h.db, c.GetUint("user_id")).Where("id = ?", c.Param("id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 		return
 	}
 
-	// Remove the specific item from cart
-	if err := h.db.Where("cart_id = ? AND item_id = ?", cart.ID, itemID).Delete(&CartItem{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+	if err := revokeSessions(h.tokens, h.db.Where("id = ?", session.ID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Item removed from cart"})
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
 }
 
-// Order Handlers
-func (h *OrderHandler) CreateOrder(c *gin.Context) {
-	var req CreateOrderRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// RevokeAllSessions signs out every session of the current user, including
+// the one making the request
+func (h *UserHandler) RevokeAllSessions(c *gin.Context) {
+	if err := revokeSessions(h.tokens, activeSessions(h.db, c.GetUint("user_id"))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
 		return
 	}
 
-	userID := c.GetUint("user_id")
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked"})
+}
 
-	// Get cart
-	var cart Cart
-	if err := h.db.Where("id = ? AND user_id = ?", req.CartID, userID).Preload("Items.Item").First(&cart).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
-		return
+// startSession records a new session for user on the requesting device and
+// issues its tokens
+func (h *UserHandler) startSession(c *gin.Context, user User, device string) (LoginResponse, error) {
+	now := time.Now()
+	session := Session{
+		UserID:     user.ID,
+		Device:     device,
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+	if err := h.db.Create(&session).Error; err != nil {
+		return LoginResponse{}, err
 	}
 
-	if len(cart.Items) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart is empty"})
-		return
+	return h.issueTokens(user, session)
+}
+
+// claimGuestCart merges the cart named by the request's guest cart token into
+// user's cart and clears the token. Requests without a valid token have
+// nothing to merge.
+func (h *UserHandler) claimGuestCart(c *gin.Context, user User) ([]CartAdjustment, error) {
+	guestID, err := h.tokens.ParseGuestCart(guestCartToken(c))
+	if err != nil {
+		return nil, nil
 	}
 
-	// Calculate total
-	var total float64
-	for _, cartItem := range cart.Items {
-		total += cartItem.Item.Price
+	var adjustments []CartAdjustment
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		adjustments, err = mergeGuestCart(tx, guestID, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setGuestCartToken(c, "", -1)
+	return adjustments, nil
+}
+
+// issueTokens signs a new access and refresh token pair for a user's session
+func (h *UserHandler) issueTokens(user User, session Session) (LoginResponse, error) {
+	token, expiresAt, err := h.tokens.Issue(session, AccessToken)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	refreshToken, refreshExpiresAt, err := h.tokens.Issue(session, RefreshToken)
+	if err != nil {
+		return LoginResponse{}, err
 	}
 
-	// Create order
-	order := Order{
-		UserID: userID,
-		Total:  total,
+	// Don't return password
+	user.Password = ""
+	user.Token = token
+
+	return LoginResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+		User:             user,
+	}, nil
+}
+
+// Item Handlers
+func (h *ItemHandler) CreateItem(c *gin.Context) {
+	var req CreateItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := h.db.Create(&order).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+	if !req.Price.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Price must be positive"})
 		return
 	}
 
-	// Create order items
-	for _, cartItem := range cart.Items {
-		orderItem := OrderItem{
-			OrderID: order.ID,
-			ItemID:  cartItem.ItemID,
-			Price:   cartItem.Item.Price,
-		}
-		h.db.Create(&orderItem)
+	item := Item{
+		Name:        req.Name,
+		Description: req.Description,
+		Price:       req.Price,
+		MaxQuantity: req.MaxQuantity,
+		WeightGrams: req.WeightGrams,
+		Stock:       req.Stock,
 	}
 
-	// Delete cart and cart items
-	h.db.Where("cart_id = ?", cart.ID).Delete(&CartItem{})
-	h.db.Delete(&cart)
+	category, err := resolveCategory(h.db, req.CategoryID, req.Category)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if category != nil {
+		item.Category = category.Name
+		item.CategoryID = &category.ID
+	}
 
-	// Load order with items
-	h.db.Preload("Items.Item").First(&order, order.ID)
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+		if h.fullTextSearch {
+			return indexItem(tx, item)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
 
-	c.JSON(http.StatusCreated, order)
+	c.JSON(http.StatusCreated, item)
 }
 
-func (h *OrderHandler) ListOrders(c *gin.Context) {
-	userID := c.GetUint("user_id")
+// ListItems returns one page of items. Pages are ordered by the sort column
+// with the item ID breaking ties, and the X-Next-Cursor header carries the
+// cursor for the following page. X-Total-Count counts every matching item.
+func (h *ItemHandler) ListItems(c *gin.Context) {
+	limit, err := parsePageSize(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	var orders []Order
-	if err := h.db.Where("user_id = ?", userID).Preload("Items.Item").Find(&orders).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+	sortBy := c.DefaultQuery("sort", "created_at")
+	column, ok := itemSortColumns[sortBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of price, name, created_at or rating"})
 		return
 	}
 
-	c.JSON(http.StatusOK, orders)
-}
+	order := c.DefaultQuery("order", "asc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
 
-// Helper functions
-func generateToken() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
-}
+	query := h.db.Model(&Item{})
+	if c.Query("include_archived") == "true" {
+		query = query.Unscoped()
+	}
 
-func authMiddleware(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		fmt.Printf("Auth middleware - Authorization header: %s\n", token)
-		
-		if token == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
+	// Filter by price range, in the given currency
+	currency := c.DefaultQuery("currency", DefaultCurrency)
+	if minPrice := c.Query("min_price"); minPrice != "" {
+		price, err := ParseMoney(minPrice, currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "min_price must be an amount: " + err.Error()})
 			return
 		}
+		query = query.Where("price_amount >= ? AND price_currency = ?", price.Amount, price.Currency)
+	}
+	if maxPrice := c.Query("max_price"); maxPrice != "" {
+		price, err := ParseMoney(maxPrice, currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_price must be an amount: " + err.Error()})
+			return
+		}
+		query = query.Where("price_amount <= ? AND price_currency = ?", price.Amount, price.Currency)
+	}
 
-		// Remove "Bearer " prefix if present
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
+	// Filter by category, including its subcategories
+	if slug := c.Query("category"); slug != "" {
+		var categories []Category
+		if err := h.db.Find(&categories).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch categories"})
+			return
 		}
-		
-		fmt.Printf("Auth middleware - Token after processing: %s\n", token)
 
-		var user User
-		if err := db.Where("token = ?", token).First(&user).Error; err != nil {
-			fmt.Printf("Auth middleware - Token not found in database: %s\n", token)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+		var categoryID uint
+		for _, category := range categories {
+			if category.Slug == slug {
+				categoryID = category.ID
+			}
+		}
+		if categoryID == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
 			return
 		}
 
-		fmt.Printf("Auth middleware - User found: %d\n", user.ID)
-		c.Set("user_id", user.ID)
-		c.Next()
+		query = query.Where("category_id IN (?)", categoryWithDescendants(categories, categoryID))
 	}
-} 
\ No newline at end of file
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count items"})
+		return
+	}
+
+	// Continue after the last item of the previous page
+	if encoded := c.Query("cursor"); encoded != "" {
+		cursor, err := decodePageCursor(encoded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if cursor.Sort != sortBy || cursor.Order != order {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cursor does not match the requested sort"})
+			return
+		}
+
+		value, err := itemCursorValue(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		comparison := ">"
+		if order == "desc" {
+			comparison = "<"
+		}
+		query = query.Where(fmt.Sprintf("(%s %s ?) OR (%s = ? AND id %s ?)", column, comparison, column, comparison), value, value, cursor.ID)
+	}
+
+	// Fetch one extra item to find out whether there is another page
+	var items []Item
+	if err := query.Preload("Variants").Preload("Images", orderedImages).Order(column + " " + order).Order("id " + order).Limit(limit + 1).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch items"})
+		return
+	}
+	for i := range items {
+		items[i].fillVariantPrices()
+	}
+
+	if len(items) > limit {
+		items = items[:limit]
+		c.Header("X-Next-Cursor", itemCursor(items[limit-1], sortBy, order).encode())
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *ItemHandler) GetItem(c *gin.Context) {
+	query := h.db
+	if c.Query("include_archived") == "true" {
+		query = query.Unscoped()
+	}
+
+	var item Item
+	if err := query.Preload("Variants").Preload("Images", orderedImages).First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	item.fillVariantPrices()
+
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *ItemHandler) UpdateItem(c *gin.Context) {
+	var req UpdateItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		if *req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+			return
+		}
+		updates["name"] = *req.Name
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.Price != nil {
+		if !req.Price.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Price must be positive"})
+			return
+		}
+		updates["price_amount"] = req.Price.Amount
+		updates["price_currency"] = req.Price.Currency
+	}
+	if req.MaxQuantity != nil {
+		updates["max_quantity"] = *req.MaxQuantity
+	}
+	if req.WeightGrams != nil {
+		updates["weight_grams"] = *req.WeightGrams
+	}
+	if req.Stock != nil {
+		updates["stock"] = *req.Stock
+	}
+	if req.CategoryID != nil || req.Category != nil {
+		var name string
+		if req.Category != nil {
+			name = *req.Category
+		}
+
+		category, err := resolveCategory(h.db, req.CategoryID, name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if category != nil {
+			updates["category"] = category.Name
+			updates["category_id"] = category.ID
+		}
+	}
+
+	if len(updates) > 0 {
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&item).Updates(updates).Error; err != nil {
+				return err
+			}
+			if h.fullTextSearch {
+				if err := tx.First(&item, item.ID).Error; err != nil {
+					return err
+				}
+				return indexItem(tx, item)
+			}
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+			return
+		}
+	}
+
+	h.db.First(&item, item.ID)
+
+	c.JSON(http.StatusOK, item)
+}
+
+// DeleteItem archives an item. It stays available to the orders that reference
+// it but is removed from every cart so it can no longer be bought.
+func (h *ItemHandler) DeleteItem(c *gin.Context) {
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("item_id = ?", item.ID).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		if h.fullTextSearch {
+			if err := unindexItem(tx, item.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item archived"})
+}
+
+// CreateVariant adds a variant to an item. Once an item has variants it is
+// bought by variant, so cart lines of the item without one are removed.
+func (h *ItemHandler) CreateVariant(c *gin.Context) {
+	var req VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	variant := ItemVariant{ItemID: item.ID, SKU: strings.TrimSpace(req.SKU), Stock: req.Stock}
+	if variant.SKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SKU cannot be empty"})
+		return
+	}
+	options, err := normalizeVariantOptions(req.Options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	variant.Options = options
+	if req.PriceOverride != nil {
+		if err := checkPriceOverride(item, *req.PriceOverride); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		variant.PriceOverride = *req.PriceOverride
+	}
+
+	if !h.saveVariant(c, &variant, "Failed to create variant", func(tx *gorm.DB) error {
+		return tx.Where("item_id = ? AND variant_id IS NULL", item.ID).Delete(&CartItem{}).Error
+	}) {
+		return
+	}
+
+	variant.Price = variant.priceFor(item)
+	c.JSON(http.StatusCreated, variant)
+}
+
+// UpdateVariant changes one of an item's variants
+func (h *ItemHandler) UpdateVariant(c *gin.Context) {
+	var req UpdateVariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	var variant ItemVariant
+	if err := h.db.Where("id = ? AND item_id = ?", c.Param("variant_id"), item.ID).First(&variant).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+		return
+	}
+
+	if req.SKU != nil {
+		variant.SKU = strings.TrimSpace(*req.SKU)
+		if variant.SKU == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "SKU cannot be empty"})
+			return
+		}
+	}
+	if req.Options != nil {
+		options, err := normalizeVariantOptions(req.Options)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		variant.Options = options
+	}
+	if req.PriceOverride != nil {
+		if err := checkPriceOverride(item, *req.PriceOverride); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		variant.PriceOverride = *req.PriceOverride
+	}
+	if req.Stock != nil {
+		variant.Stock = *req.Stock
+	}
+
+	if !h.saveVariant(c, &variant, "Failed to update variant", nil) {
+		return
+	}
+
+	variant.Price = variant.priceFor(item)
+	c.JSON(http.StatusOK, variant)
+}
+
+// saveVariant checks variant for conflicts and saves it, running also in the
+// same transaction when it is given. It writes the error response and
+// returns false when the variant was not saved.
+func (h *ItemHandler) saveVariant(c *gin.Context, variant *ItemVariant, message string, also func(tx *gorm.DB) error) bool {
+	conflict := ""
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if conflict, err = variantConflict(tx, *variant); err != nil || conflict != "" {
+			return err
+		}
+		if err := tx.Save(variant).Error; err != nil {
+			return err
+		}
+		if also != nil {
+			return also(tx)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+		return false
+	case conflict != "":
+		c.JSON(http.StatusConflict, gin.H{"error": conflict})
+		return false
+	}
+	return true
+}
+
+// DeleteVariant archives one of an item's variants. Orders keep its SKU and
+// options, but it is removed from every cart so it can no longer be bought.
+func (h *ItemHandler) DeleteVariant(c *gin.Context) {
+	var variant ItemVariant
+	if err := h.db.Where("id = ? AND item_id = ?", c.Param("variant_id"), c.Param("id")).First(&variant).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("variant_id = ?", variant.ID).Delete(&CartItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&variant).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete variant"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Variant archived"})
+}
+
+// UploadItemImage stores the image uploaded in the "image" field of a
+// multipart form along with its thumbnail. The file's type is sniffed from
+// its content, and files over MaxImageBytes are refused with 413.
+func (h *ItemHandler) UploadItemImage(c *gin.Context) {
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	// Leave room for the rest of the form around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxImageBytes+64<<10)
+	header, err := c.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Images may be at most %d MB", MaxImageBytes>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the image in the image field of a multipart form"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, MaxImageBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image"})
+		return
+	}
+
+	processed, err := processImage(data)
+	if err != nil {
+		var imageErr *ImageError
+		if errors.As(err, &imageErr) {
+			c.JSON(imageErr.Status, gin.H{"error": imageErr.Message})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to make thumbnail"})
+		return
+	}
+
+	key, thumbnailKey, err := newImageKeys(item.ID, processed.Extension, processed.ThumbnailType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+		return
+	}
+	if err := h.images.Save(key, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+		return
+	}
+	if err := h.images.Save(thumbnailKey, processed.Thumbnail); err != nil {
+		h.images.Delete(key)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+		return
+	}
+
+	image := ItemImage{
+		ItemID:       item.ID,
+		Key:          key,
+		ThumbnailKey: thumbnailKey,
+		URL:          h.images.URL(key),
+		ThumbnailURL: h.images.URL(thumbnailKey),
+		ContentType:  processed.ContentType,
+		Size:         len(data),
+		Width:        processed.Width,
+		Height:       processed.Height,
+	}
+	if err := h.db.Create(&image).Error; err != nil {
+		h.images.Delete(key)
+		h.images.Delete(thumbnailKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, image)
+}
+
+// DeleteItemImage removes one of an item's images and its stored files
+func (h *ItemHandler) DeleteItemImage(c *gin.Context) {
+	var image ItemImage
+	if err := h.db.Where("id = ? AND item_id = ?", c.Param("image_id"), c.Param("id")).First(&image).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if err := h.db.Delete(&image).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
+		return
+	}
+
+	// The image is gone once its row is; a file left behind is only clutter
+	for _, key := range []string{image.Key, image.ThumbnailKey} {
+		if err := h.images.Delete(key); err != nil {
+			log.Printf("Failed to delete image file %s: %v", key, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image deleted"})
+}
+
+// ServeImage sends a stored image file. Keys are never reused, so clients
+// may cache them for good.
+func (h *ItemHandler) ServeImage(c *gin.Context) {
+	key := c.Param("key")
+	file, err := h.images.Open(key)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+	defer file.Close()
+
+	contentType := "application/octet-stream"
+	for imageType, extension := range imageTypes {
+		if strings.HasSuffix(key, extension) {
+			contentType = imageType
+		}
+	}
+	c.DataFromReader(http.StatusOK, -1, contentType, file, map[string]string{
+		"Cache-Control":          "public, max-age=31536000, immutable",
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
+// SearchItems finds items whose name, description or category match every
+// word of the q parameter, best matches first. Archived items are not found.
+func (h *ItemHandler) SearchItems(c *gin.Context) {
+	terms := searchTerms(c.Query("q"))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+
+	limit, err := parsePageSize(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var results []ItemSearchResult
+	if h.fullTextSearch {
+		results, err = searchItemsFTS(h.db, terms, limit)
+	} else {
+		results, err = searchItemsLike(h.db, terms, limit)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// Category Handlers
+func (h *CategoryHandler) CreateCategory(c *gin.Context) {
+	var req CreateCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slug := req.Slug
+	if slug == "" {
+		slug = slugify(req.Name)
+	}
+	if slug == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Category slug cannot be empty"})
+		return
+	}
+
+	// Check the parent exists
+	if req.ParentID != nil {
+		var parent Category
+		if err := h.db.First(&parent, *req.ParentID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parent category not found"})
+			return
+		}
+	}
+
+	// Check if slug is already taken
+	var existingCategory Category
+	if err := h.db.Where("slug = ?", slug).First(&existingCategory).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category already exists"})
+		return
+	}
+
+	category := Category{
+		Slug:     slug,
+		Name:     req.Name,
+		ParentID: req.ParentID,
+	}
+
+	if err := h.db.Create(&category).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create category"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, category)
+}
+
+// ListCategories returns every category with the number of items in it and
+// its subcategories. Archived items are not counted.
+func (h *CategoryHandler) ListCategories(c *gin.Context) {
+	var categories []Category
+	if err := h.db.Order("name").Find(&categories).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch categories"})
+		return
+	}
+
+	var counts []struct {
+		CategoryID uint
+		Count      int
+	}
+	if err := h.db.Model(&Item{}).Select("category_id, count(*) as count").Where("category_id IS NOT NULL").Group("category_id").Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count items"})
+		return
+	}
+
+	itemCounts := make(map[uint]int, len(counts))
+	for _, count := range counts {
+		itemCounts[count.CategoryID] = count.Count
+	}
+
+	for i := range categories {
+		for _, id := range categoryWithDescendants(categories, categories[i].ID) {
+			categories[i].ItemCount += itemCounts[id]
+		}
+	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+// Cart Handlers
+func (h *CartHandler) CreateCart(c *gin.Context) {
+	var req CreateCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+	guestID := c.GetString("guest_id")
+
+	// Check if item exists
+	var item Item
+	if err := h.db.First(&item, req.ItemID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	// Items with variants are bought by variant
+	variant, err := findVariant(h.db, item, req.VariantID)
+	if err != nil {
+		respondVariantError(c, err)
+		return
+	}
+	price := item.Price
+	if variant != nil {
+		price = variant.Price
+	}
+
+	// Find the cart and line, check the limits and reserve the units in one
+	// transaction, so concurrent adds cannot go over the limit or lose units
+	var cart Cart
+	var limitReached, otherCurrency bool
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// Get or create cart for the user or guest
+		if err := ownedCart(tx, c).First(&cart).Error; err == gorm.ErrRecordNotFound {
+			cart = Cart{UserID: userID, GuestID: guestID}
+			if err := tx.Create(&cart).Error; err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// Check if item already exists in cart
+		cartItem := CartItem{CartID: cart.ID, ItemID: req.ItemID, VariantID: req.VariantID, Price: price}
+		if err := sameVariant(tx, req.VariantID).Where("cart_id = ? AND item_id = ?", cart.ID, req.ItemID).First(&cartItem).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		// Increment quantity up to the item's limit
+		if cartItem.Quantity >= item.QuantityLimit() {
+			limitReached = true
+			return nil
+		}
+
+		// A cart is paid for in one currency
+		if pricedInOtherCurrency(tx, cart.ID, price.Currency) {
+			otherCurrency = true
+			return nil
+		}
+
+		// Reserve the units for this cart
+		return reserveStock(tx, &cartItem, cartItem.Quantity+1)
+	})
+	if err != nil {
+		respondStockError(c, err, "Failed to add item to cart")
+		return
+	}
+	if limitReached {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum quantity for this item reached", "max_quantity": item.QuantityLimit()})
+		return
+	}
+	if otherCurrency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart items must all be priced in " + price.Currency})
+		return
+	}
+
+	// Load cart with items
+	h.db.Scopes(preloadLines).First(&cart, cart.ID)
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, cart)
+}
+
+func (h *CartHandler) ListCarts(c *gin.Context) {
+	var carts []Cart
+	if err := ownedCart(h.db, c).Scopes(preloadLines).Find(&carts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch carts"})
+		return
+	}
+
+	// Preview the tax for the region asked for
+	for i := range carts {
+		err := priceCart(h.db, h.taxes, c.Query("tax_region"), &carts[i])
+		var regionErr *TaxRegionError
+		if errors.As(err, &regionErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tax region", "tax_region": regionErr.Region})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, carts)
+}
+
+// UpdateCartItem sets the quantity of an item in the user's cart. A quantity
+// of zero removes the line. Lines of a variant are named by the variant_id
+// query parameter.
+func (h *CartHandler) UpdateCartItem(c *gin.Context) {
+	var req UpdateCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	itemID := c.Param("item_id")
+	variantID, err := variantParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user's cart
+	var cart Cart
+	if err := ownedCart(h.db, c).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	var cartItem CartItem
+	if err := sameVariant(h.db, variantID).Where("cart_id = ? AND item_id = ?", cart.ID, itemID).Preload("Item").First(&cartItem).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in cart"})
+		return
+	}
+
+	quantity := *req.Quantity
+	if quantity == 0 {
+		if err := h.db.Delete(&cartItem).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+			return
+		}
+	} else {
+		if quantity > cartItem.Item.QuantityLimit() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity exceeds the maximum for this item", "max_quantity": cartItem.Item.QuantityLimit()})
+			return
+		}
+
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			return reserveStock(tx, &cartItem, quantity)
+		})
+		if err != nil {
+			respondStockError(c, err, "Failed to update cart item")
+			return
+		}
+	}
+
+	// Load cart with items
+	h.db.Scopes(preloadLines).First(&cart, cart.ID)
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// RemoveFromCart removes an item from the user's cart. The variant_id query
+// parameter removes only the line of that variant; without it every line of
+// the item goes.
+func (h *CartHandler) RemoveFromCart(c *gin.Context) {
+	itemID := c.Param("item_id")
+	variantID, err := variantParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user's cart
+	var cart Cart
+	if err := ownedCart(h.db, c).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	// Remove the specific item from cart
+	query := h.db.Where("cart_id = ? AND item_id = ?", cart.ID, itemID)
+	if variantID != nil {
+		query = sameVariant(query, variantID)
+	}
+	if err := query.Delete(&CartItem{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item removed from cart"})
+}
+
+// ApplyCoupon puts a coupon on the user's cart. The coupon must apply to
+// the cart as it is now; the cart comes back with its discount breakdown.
+func (h *CartHandler) ApplyCoupon(c *gin.Context) {
+	var req ApplyCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cart Cart
+	if err := ownedCart(h.db, c).Scopes(preloadLines).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	var promotion Promotion
+	if err := h.db.Where("code = ?", normalizeCouponCode(req.Code)).First(&promotion).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+		return
+	}
+
+	if err := cart.CalculateTotals(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+	_, _, err := evaluatePromotion(h.db, promotion.ID, &cart, time.Now())
+	var promotionErr *PromotionError
+	if errors.As(err, &promotionErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": promotionErr.Message})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply coupon"})
+		return
+	}
+
+	cart.PromotionID = &promotion.ID
+	if err := h.db.Model(&cart).Update("promotion_id", promotion.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply coupon"})
+		return
+	}
+
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// RemoveCoupon takes the coupon off the user's cart
+func (h *CartHandler) RemoveCoupon(c *gin.Context) {
+	var cart Cart
+	if err := ownedCart(h.db, c).Scopes(preloadLines).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	cart.PromotionID = nil
+	if err := h.db.Model(&cart).Update("promotion_id", gorm.Expr("NULL")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove coupon"})
+		return
+	}
+
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// AcknowledgePrices records that the user reviewed the cart at cart_version:
+// its lines' prices become what they cost now, so a later price change is
+// flagged again. A version that no longer matches the cart gets a 409 with
+// the price changes and the current version.
+func (h *CartHandler) AcknowledgePrices(c *gin.Context) {
+	var req AcknowledgePricesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cart Cart
+	if err := ownedCart(h.db, c).Scopes(preloadLines).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	cart.flagPriceChanges()
+	if req.CartVersion != cart.Version {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart has changed; review it and acknowledge again",
+			"price_changes": cart.priceChanges(), "cart_version": cart.Version})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		return cart.acknowledgePrices(tx)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to acknowledge prices"})
+		return
+	}
+
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// ShippingOptions quotes the ways the cart can be shipped to the address
+// given by address_id, or to the user's default address. Guests have no saved
+// addresses, so they are quoted to the country, region and postal_code query
+// parameters instead.
+func (h *CartHandler) ShippingOptions(c *gin.Context) {
+	destination, ok := h.shippingDestination(c)
+	if !ok {
+		return
+	}
+
+	var cart Cart
+	if err := ownedCart(h.db, c).Scopes(preloadLines).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+	subtotal, err := cart.Subtotal.Sub(cart.DiscountTotal)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	options, err := h.shipping.Options(newShipment(cart.Items, destination, subtotal, cart.FreeShipping))
+	var shippingErr *ShippingError
+	if errors.As(err, &shippingErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": shippingErr.Message})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to quote shipping"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// shippingDestination resolves the address to quote shipping to, responding
+// with an error and returning false when there is none
+func (h *CartHandler) shippingDestination(c *gin.Context) (PostalAddress, bool) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		destination := normalizeAddress(PostalAddress{
+			Region:     c.Query("region"),
+			PostalCode: c.Query("postal_code"),
+			Country:    c.Query("country"),
+		})
+		if destination.Country == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "country is required"})
+			return PostalAddress{}, false
+		}
+		return destination, true
+	}
+
+	var addressID *uint
+	if value := c.Query("address_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address_id"})
+			return PostalAddress{}, false
+		}
+		addressID = new(uint)
+		*addressID = uint(id)
+	}
+
+	address, err := findAddress(h.db, userID, addressID)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return PostalAddress{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch address"})
+		return PostalAddress{}, false
+	}
+	if address == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Add a shipping address first"})
+		return PostalAddress{}, false
+	}
+	return address.PostalAddress, true
+}
+
+// Address Handlers
+
+// CreateAddress saves an address for the current user. Their first address
+// becomes their default address.
+func (h *AddressHandler) CreateAddress(c *gin.Context) {
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	address := Address{UserID: c.GetUint("user_id"), PostalAddress: normalizeAddress(req.postalAddress())}
+	if err := validateAddress(address.PostalAddress); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Model(&Address{}).Where("user_id = ?", address.UserID).Count(&count).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&address).Error; err != nil {
+			return err
+		}
+		if req.IsDefault || count == 0 {
+			return makeDefaultAddress(tx, &address)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, address)
+}
+
+// ListAddresses returns the current user's addresses, default first
+func (h *AddressHandler) ListAddresses(c *gin.Context) {
+	var addresses []Address
+	if err := h.db.Where("user_id = ?", c.GetUint("user_id")).Order("is_default DESC, id").Find(&addresses).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch addresses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, addresses)
+}
+
+// GetAddress returns one of the current user's addresses
+func (h *AddressHandler) GetAddress(c *gin.Context) {
+	var address Address
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&address).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, address)
+}
+
+// UpdateAddress replaces one of the current user's addresses. Orders keep the
+// address they were placed with. An address stops being the default only
+// when another one becomes the default.
+func (h *AddressHandler) UpdateAddress(c *gin.Context) {
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var address Address
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&address).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	address.PostalAddress = normalizeAddress(req.postalAddress())
+	if err := validateAddress(address.PostalAddress); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&address).Error; err != nil {
+			return err
+		}
+		if req.IsDefault {
+			return makeDefaultAddress(tx, &address)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, address)
+}
+
+// DeleteAddress removes one of the current user's addresses. When it was the
+// default, their oldest remaining address becomes the default.
+func (h *AddressHandler) DeleteAddress(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var address Address
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&address).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&address).Error; err != nil {
+			return err
+		}
+		if !address.IsDefault {
+			return nil
+		}
+
+		var next Address
+		err := tx.Where("user_id = ?", userID).Order("id").First(&next).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return makeDefaultAddress(tx, &next)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted"})
+}
+
+// Wishlist Handlers
+
+// CreateWishlist starts a new wishlist for the current user
+func (h *WishlistHandler) CreateWishlist(c *gin.Context) {
+	var req WishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	wishlist := Wishlist{UserID: c.GetUint("user_id"), Name: strings.TrimSpace(req.Name), Items: []WishlistItem{}}
+	if wishlist.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be blank"})
+		return
+	}
+	if err := setWishlistSharing(&wishlist, req.IsPublic); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create wishlist"})
+		return
+	}
+
+	if err := h.db.Create(&wishlist).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create wishlist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, wishlist)
+}
+
+// ListWishlists returns the current user's wishlists with their items
+func (h *WishlistHandler) ListWishlists(c *gin.Context) {
+	var wishlists []Wishlist
+	if err := h.db.Where("user_id = ?", c.GetUint("user_id")).Scopes(preloadLines).Order("id").Find(&wishlists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wishlists"})
+		return
+	}
+
+	for i := range wishlists {
+		if err := reportWishlistStock(h.db, &wishlists[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wishlists"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, wishlists)
+}
+
+// GetWishlist returns one of the current user's wishlists
+func (h *WishlistHandler) GetWishlist(c *gin.Context) {
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).Scopes(preloadLines).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	h.respondWishlist(c, wishlist)
+}
+
+// SharedWishlist returns a public wishlist to anyone with its share token
+func (h *WishlistHandler) SharedWishlist(c *gin.Context) {
+	var wishlist Wishlist
+	if err := h.db.Where("share_token = ? AND is_public = ?", c.Param("token"), true).Scopes(preloadLines).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	h.respondWishlist(c, wishlist)
+}
+
+// UpdateWishlist renames one of the current user's wishlists and shares or
+// unshares it. Unsharing revokes the share link for good.
+func (h *WishlistHandler) UpdateWishlist(c *gin.Context) {
+	var req WishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	wishlist.Name = strings.TrimSpace(req.Name)
+	if wishlist.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be blank"})
+		return
+	}
+	if err := setWishlistSharing(&wishlist, req.IsPublic); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update wishlist"})
+		return
+	}
+
+	if err := h.db.Save(&wishlist).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update wishlist"})
+		return
+	}
+
+	h.db.Scopes(preloadLines).First(&wishlist, wishlist.ID)
+	h.respondWishlist(c, wishlist)
+}
+
+// DeleteWishlist removes one of the current user's wishlists and its items
+func (h *WishlistHandler) DeleteWishlist(c *gin.Context) {
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("wishlist_id = ?", wishlist.ID).Delete(&WishlistItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&wishlist).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wishlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Wishlist deleted"})
+}
+
+// AddWishlistItem saves an item on one of the current user's wishlists. An
+// item already on the list gets the new units added.
+func (h *WishlistHandler) AddWishlistItem(c *gin.Context) {
+	var req AddWishlistItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	var item Item
+	if err := h.db.First(&item, req.ItemID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	// A variant is optional on a wishlist, but must be one of the item's
+	if req.VariantID != nil {
+		if _, err := findVariant(h.db, item, req.VariantID); err != nil {
+			respondVariantError(c, err)
+			return
+		}
+	}
+
+	if err := addToWishlist(h.db, wishlist.ID, item.ID, req.VariantID, req.Quantity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to wishlist"})
+		return
+	}
+
+	h.db.Scopes(preloadLines).First(&wishlist, wishlist.ID)
+	h.respondWishlist(c, wishlist)
+}
+
+// RemoveWishlistItem takes an item off one of the current user's wishlists.
+// The variant_id query parameter takes off only the line of that variant.
+func (h *WishlistHandler) RemoveWishlistItem(c *gin.Context) {
+	variantID, err := variantParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	query := h.db.Where("wishlist_id = ? AND item_id = ?", wishlist.ID, c.Param("item_id"))
+	if variantID != nil {
+		query = sameVariant(query, variantID)
+	}
+	if err := query.Delete(&WishlistItem{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from wishlist"})
+		return
+	}
+
+	h.db.Scopes(preloadLines).First(&wishlist, wishlist.ID)
+	h.respondWishlist(c, wishlist)
+}
+
+// SaveForLater moves a line of the current user's cart to the wishlist given
+// by wishlist_id, or to their "Saved for later" list, and returns the cart.
+// Its units stop being reserved.
+func (h *WishlistHandler) SaveForLater(c *gin.Context) {
+	var req MoveToWishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+
+	var cart Cart
+	if err := ownedCart(h.db, c).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	variantID, err := variantParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cartItem CartItem
+	if err := sameVariant(h.db, variantID).Where("cart_id = ? AND item_id = ?", cart.ID, c.Param("item_id")).First(&cartItem).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in cart"})
+		return
+	}
+
+	var wishlist Wishlist
+	if req.WishlistID != nil {
+		if err := h.db.Where("id = ? AND user_id = ?", *req.WishlistID, userID).First(&wishlist).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+			return
+		}
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if req.WishlistID == nil {
+			var err error
+			if wishlist, err = savedForLater(tx, userID); err != nil {
+				return err
+			}
+		}
+		if err := addToWishlist(tx, wishlist.ID, cartItem.ItemID, cartItem.VariantID, cartItem.Quantity); err != nil {
+			return err
+		}
+		return tx.Delete(&cartItem).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save item for later"})
+		return
+	}
+
+	// Load cart with items
+	h.db.Scopes(preloadLines).First(&cart, cart.ID)
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// MoveToCart moves an item from one of the current user's wishlists into
+// their cart, up to the item's per-cart limit, and returns the cart. Units
+// over the limit stay on the wishlist, and a cart already at the limit gets
+// a 400 with max_quantity. The item stays on the wishlist when its units are
+// not available. Lines of a variant
+// are named by the variant_id query parameter, and an item with variants
+// must have been saved with one.
+func (h *WishlistHandler) MoveToCart(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	variantID, err := variantParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var wishlist Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+
+	var line WishlistItem
+	if err := sameVariant(h.db, variantID).Where("wishlist_id = ? AND item_id = ?", wishlist.ID, c.Param("item_id")).Preload("Item").First(&line).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in wishlist"})
+		return
+	}
+	if line.Item.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	variant, err := findVariant(h.db, line.Item, line.VariantID)
+	if err != nil {
+		respondVariantError(c, err)
+		return
+	}
+	price := line.Item.Price
+	if variant != nil {
+		price = variant.Price
+	}
+
+	var cart Cart
+	if err := h.db.Where(Cart{UserID: userID}).FirstOrCreate(&cart).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart"})
+		return
+	}
+
+	// A cart is paid for in one currency
+	if pricedInOtherCurrency(h.db, cart.ID, price.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart items must all be priced in " + price.Currency})
+		return
+	}
+
+	limit := line.Item.QuantityLimit()
+	limitReached := false
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		cartItem := CartItem{CartID: cart.ID, ItemID: line.ItemID, VariantID: line.VariantID, Price: price}
+		if err := sameVariant(tx, line.VariantID).Where("cart_id = ? AND item_id = ?", cart.ID, line.ItemID).First(&cartItem).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if cartItem.Quantity >= limit {
+			limitReached = true
+			return nil
+		}
+
+		moved := min(line.Quantity, limit-cartItem.Quantity)
+		if err := reserveStock(tx, &cartItem, cartItem.Quantity+moved); err != nil {
+			return err
+		}
+		if moved < line.Quantity {
+			return tx.Model(&line).Update("quantity", line.Quantity-moved).Error
+		}
+		return tx.Delete(&line).Error
+	})
+	if err != nil {
+		respondStockError(c, err, "Failed to move item to cart")
+		return
+	}
+	if limitReached {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum quantity for this item reached", "max_quantity": limit})
+		return
+	}
+
+	// Load cart with items
+	h.db.Scopes(preloadLines).First(&cart, cart.ID)
+	if err := priceCart(h.db, h.taxes, "", &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// respondWishlist writes a wishlist with the current price and stock of its
+// items
+func (h *WishlistHandler) respondWishlist(c *gin.Context, wishlist Wishlist) {
+	if err := reportWishlistStock(h.db, &wishlist); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wishlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, wishlist)
+}
+
+// Review Handlers
+
+// ListReviews returns an item's visible reviews, newest first unless sort
+// names recent, helpful or rating and order is asc or desc. The
+// X-Total-Count response header gives the number of reviews.
+func (h *ReviewHandler) ListReviews(c *gin.Context) {
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	column, ok := reviewSortColumns[c.DefaultQuery("sort", "recent")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of recent, helpful or rating"})
+		return
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+	limit, err := parsePageSize(c.Query("limit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be zero or a positive number"})
+		return
+	}
+
+	query := h.db.Model(&Review{}).Where("item_id = ? AND status IN (?)", item.ID, visibleReviewStatuses)
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count reviews"})
+		return
+	}
+
+	reviews := []Review{}
+	if err := query.Order(column + " " + order).Order("id " + order).Offset(offset).Limit(limit).Find(&reviews).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.JSON(http.StatusOK, reviews)
+}
+
+// CreateReview reviews an item for the current user, who must have received
+// it in a fulfilled order. Each user reviews an item once and edits their
+// review after that.
+func (h *ReviewHandler) CreateReview(c *gin.Context) {
+	var req ReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item Item
+	if err := h.db.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	var user User
+	if err := h.db.First(&user, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	review := Review{ItemID: item.ID, UserID: user.ID, Author: user.Username, Rating: req.Rating, Title: req.Title, Body: req.Body, Status: ReviewPublished}
+	if err := normalizeReview(&review); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	verified, err := verifiedPurchaser(h.db, user.ID, item.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check your orders"})
+		return
+	}
+	if !verified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers who bought this item can review it"})
+		return
+	}
+
+	var existing Review
+	if err := h.db.Where("item_id = ? AND user_id = ?", item.ID, user.ID).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already reviewed this item", "review_id": existing.ID})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+		return refreshItemRating(tx, item.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save review"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, review)
+}
+
+// UpdateReview rewrites one of the current user's reviews. Editing an
+// approved review publishes it again, so its flags put it back in front of
+// the moderators; a hidden review stays hidden.
+func (h *ReviewHandler) UpdateReview(c *gin.Context) {
+	var req ReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var review Review
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&review).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+
+	review.Rating, review.Title, review.Body = req.Rating, req.Title, req.Body
+	if err := normalizeReview(&review); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if review.Status == ReviewApproved {
+		review.Status = ReviewPublished
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&review).Error; err != nil {
+			return err
+		}
+		return refreshItemRating(tx, review.ItemID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// DeleteReview removes one of the current user's reviews with its votes and
+// flags
+func (h *ReviewHandler) DeleteReview(c *gin.Context) {
+	var review Review
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&review).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("review_id = ?", review.ID).Delete(&ReviewVote{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("review_id = ?", review.ID).Delete(&ReviewFlag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&review).Error; err != nil {
+			return err
+		}
+		return refreshItemRating(tx, review.ItemID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review deleted"})
+}
+
+// VoteHelpful marks another customer's review as helpful to the current
+// user. Voting twice counts once.
+func (h *ReviewHandler) VoteHelpful(c *gin.Context) {
+	review, ok := h.othersReview(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		vote := ReviewVote{ReviewID: review.ID, UserID: c.GetUint("user_id")}
+		if err := tx.Where(vote).FirstOrCreate(&vote).Error; err != nil {
+			return err
+		}
+		return refreshReviewCounts(tx, &review)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save vote"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// RemoveHelpfulVote takes back the current user's helpful vote
+func (h *ReviewHandler) RemoveHelpfulVote(c *gin.Context) {
+	review, ok := h.othersReview(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("review_id = ? AND user_id = ?", review.ID, c.GetUint("user_id")).Delete(&ReviewVote{}).Error; err != nil {
+			return err
+		}
+		return refreshReviewCounts(tx, &review)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove vote"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// FlagReview reports another customer's review to the moderators. A user
+// flags a review once; flagging it again keeps the first reason.
+func (h *ReviewHandler) FlagReview(c *gin.Context) {
+	var req FlagReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reason cannot be blank"})
+		return
+	}
+
+	review, ok := h.othersReview(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		flag := ReviewFlag{ReviewID: review.ID, UserID: c.GetUint("user_id")}
+		if err := tx.Where(flag).Attrs(ReviewFlag{Reason: reason}).FirstOrCreate(&flag).Error; err != nil {
+			return err
+		}
+		return refreshReviewCounts(tx, &review)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to flag review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review flagged for moderation"})
+}
+
+// ListFlaggedReviews returns the published reviews waiting for a moderator,
+// most flagged first, with their flags
+func (h *ReviewHandler) ListFlaggedReviews(c *gin.Context) {
+	reviews := []Review{}
+	err := h.db.Where("status = ? AND flag_count > 0", ReviewPublished).
+		Preload("Flags", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Order("flag_count desc").Order("id").Find(&reviews).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reviews)
+}
+
+// ModerateReview approves a review, keeping it up however often it was
+// flagged, or hides it from the item and its rating
+func (h *ReviewHandler) ModerateReview(c *gin.Context) {
+	var req ModerateReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Status != ReviewApproved && req.Status != ReviewHidden {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be approved or hidden"})
+		return
+	}
+
+	var review Review
+	if err := h.db.First(&review, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&review).Update("status", req.Status).Error; err != nil {
+			return err
+		}
+		return refreshItemRating(tx, review.ItemID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to moderate review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// othersReview loads the visible review a vote or flag is for. Customers
+// cannot vote for or flag their own reviews.
+func (h *ReviewHandler) othersReview(c *gin.Context) (Review, bool) {
+	var review Review
+	if err := h.db.Where("id = ? AND status IN (?)", c.Param("id"), visibleReviewStatuses).First(&review).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return review, false
+	}
+	if review.UserID == c.GetUint("user_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot vote for or flag your own review"})
+		return review, false
+	}
+	return review, true
+}
+
+// Promotion Handlers
+
+// CreatePromotion adds a coupon code. Codes are stored in upper case and
+// matched regardless of case.
+func (h *PromotionHandler) CreatePromotion(c *gin.Context) {
+	var req CreatePromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promotion := Promotion{
+		Code:         normalizeCouponCode(req.Code),
+		Description:  req.Description,
+		Type:         req.Type,
+		PercentOff:   req.PercentOff,
+		AmountOff:    req.AmountOff,
+		BuyQuantity:  req.BuyQuantity,
+		GetQuantity:  req.GetQuantity,
+		StartsAt:     req.StartsAt,
+		EndsAt:       req.EndsAt,
+		UsageLimit:   req.UsageLimit,
+		PerUserLimit: req.PerUserLimit,
+	}
+	if promotion.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Coupon code cannot be empty"})
+		return
+	}
+	if err := validatePromotion(promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.ItemIDs) > 0 {
+		if err := h.db.Where("id IN (?)", req.ItemIDs).Find(&promotion.Items).Error; err != nil || len(promotion.Items) != len(req.ItemIDs) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Item not found"})
+			return
+		}
+	}
+	if len(req.CategoryIDs) > 0 {
+		if err := h.db.Where("id IN (?)", req.CategoryIDs).Find(&promotion.Categories).Error; err != nil || len(promotion.Categories) != len(req.CategoryIDs) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Category not found"})
+			return
+		}
+	}
+
+	// Check if the code is already taken
+	var existing Promotion
+	if err := h.db.Where("code = ?", promotion.Code).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Coupon code already exists"})
+		return
+	}
+
+	// Link the items and categories without saving them again
+	if err := h.db.Set("gorm:association_autoupdate", false).Create(&promotion).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create promotion"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, promotion)
+}
+
+// ListPromotions returns every promotion with the items and categories it
+// applies to
+func (h *PromotionHandler) ListPromotions(c *gin.Context) {
+	var promotions []Promotion
+	if err := h.db.Preload("Items").Preload("Categories").Order("id").Find(&promotions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promotions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promotions)
+}
+
+// Order Handlers
+func (h *OrderHandler) CreateOrder(c *gin.Context) {
+	var req CreateOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+
+	// Turn the cart into an order in a single transaction so a failure at
+	// any step leaves neither a partial order nor an orphaned cart
+	var order Order
+	var payment Payment
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Get cart
+		var cart Cart
+		if err := tx.Where("id = ? AND user_id = ?", req.CartID, userID).Preload("Items.Item").Preload("Items.Variant").First(&cart).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return &CheckoutError{Status: http.StatusNotFound, Step: "load_cart", Message: "Cart not found"}
+			}
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "load_cart", Message: "Failed to fetch cart", Err: err}
+		}
+
+		if len(cart.Items) == 0 {
+			return &CheckoutError{Status: http.StatusBadRequest, Step: "load_cart", Message: "Cart is empty"}
+		}
+
+		// Only charge prices the user has seen
+		if err := checkCartVersion(&cart, req.CartVersion); err != nil {
+			return err
+		}
+
+		// Build order lines and calculate the subtotal from them
+		orderItems := make([]OrderItem, 0, len(cart.Items))
+		var subtotal Money
+		for _, cartItem := range cart.Items {
+			orderItem := newOrderItem(cartItem)
+			sum, err := subtotal.Add(orderItem.Subtotal)
+			if err != nil {
+				return &CheckoutError{Status: http.StatusBadRequest, Step: "load_cart", Message: "Cart items are priced in different currencies"}
+			}
+			subtotal = sum
+			orderItems = append(orderItems, orderItem)
+		}
+
+		// Check the coupon still applies. Usage counts are read inside the
+		// transaction, so concurrent checkouts cannot overuse a promotion.
+		var promotion Promotion
+		var discounts []Discount
+		if cart.PromotionID != nil {
+			if err := cart.CalculateTotals(); err != nil {
+				return &CheckoutError{Status: http.StatusBadRequest, Step: "load_cart", Message: "Cart items are priced in different currencies"}
+			}
+
+			var err error
+			promotion, discounts, err = evaluatePromotion(tx, *cart.PromotionID, &cart, time.Now())
+			var promotionErr *PromotionError
+			if errors.As(err, &promotionErr) {
+				return &CheckoutError{Status: http.StatusUnprocessableEntity, Step: "apply_promotion", Message: promotionErr.Message}
+			}
+			if err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "apply_promotion", Message: "Failed to apply coupon", Err: err}
+			}
+		}
+
+		total := subtotal
+		for _, discount := range discounts {
+			sum, err := total.Sub(discount.Amount)
+			if err != nil {
+				return &CheckoutError{Status: http.StatusBadRequest, Step: "apply_promotion", Message: "Coupon is priced in a different currency"}
+			}
+			total = sum
+		}
+
+		// Ship to the address asked for or the default address, and bill the
+		// shipping address unless told otherwise
+		shippingAddress, err := findAddress(tx, userID, req.ShippingAddressID)
+		if err == gorm.ErrRecordNotFound {
+			return &CheckoutError{Status: http.StatusNotFound, Step: "load_address", Message: "Shipping address not found"}
+		}
+		if err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "load_address", Message: "Failed to fetch address", Err: err}
+		}
+		billingAddress := shippingAddress
+		if req.BillingAddressID != nil {
+			billingAddress, err = findAddress(tx, userID, req.BillingAddressID)
+			if err == gorm.ErrRecordNotFound {
+				return &CheckoutError{Status: http.StatusNotFound, Step: "load_address", Message: "Billing address not found"}
+			}
+			if err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "load_address", Message: "Failed to fetch address", Err: err}
+			}
+		}
+
+		// Charge for the chosen shipping method on top of the discounted items
+		var shipping ShippingOption
+		if shippingAddress != nil {
+			shipment := newShipment(cart.Items, shippingAddress.PostalAddress, total, promotion.Type == PromotionFreeShipping)
+			shipping, err = chooseShipping(h.shipping, shipment, req.ShippingMethod)
+			var shippingErr *ShippingError
+			if errors.As(err, &shippingErr) {
+				return &CheckoutError{Status: http.StatusUnprocessableEntity, Step: "choose_shipping", Message: shippingErr.Message}
+			}
+			if err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "choose_shipping", Message: "Failed to quote shipping", Err: err}
+			}
+			if total, err = total.Add(shipping.Cost); err != nil {
+				return &CheckoutError{Status: http.StatusBadRequest, Step: "choose_shipping", Message: "Shipping is priced in a different currency"}
+			}
+		} else if req.ShippingMethod != "" {
+			return &CheckoutError{Status: http.StatusBadRequest, Step: "choose_shipping", Message: "A shipping address is needed to choose a shipping method"}
+		}
+
+		// Work out the tax on what each line costs after discounts
+		taxRegion := req.TaxRegion
+		if taxRegion == "" && shippingAddress != nil {
+			taxRegion = shippingAddress.TaxRegion()
+		}
+		lines := make([]TaxableLine, len(orderItems))
+		for i, cartItem := range cart.Items {
+			lines[i] = TaxableLine{ItemID: cartItem.ItemID, VariantID: cartItem.VariantID, Category: cartItem.Item.Category, Amount: orderItems[i].Subtotal}
+		}
+		tax, err := calculateTax(h.taxes, taxRegion, lines, discounts)
+		var regionErr *TaxRegionError
+		if errors.As(err, &regionErr) {
+			return &CheckoutError{Status: http.StatusBadRequest, Step: "calculate_tax", Message: "Unknown tax region " + regionErr.Region}
+		}
+		if err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "calculate_tax", Message: "Failed to calculate tax", Err: err}
+		}
+		for i := range orderItems {
+			orderItems[i].TaxRate = tax.Lines[i].Rate
+			orderItems[i].Tax = tax.Lines[i].Amount
+		}
+		if !tax.Inclusive {
+			if total, err = total.Add(tax.Total); err != nil {
+				return &CheckoutError{Status: http.StatusBadRequest, Step: "calculate_tax", Message: "Tax is in a different currency"}
+			}
+		}
+
+		// Take the units out of stock. Each decrement is a single conditional
+		// UPDATE, so concurrent checkouts cannot oversell.
+		for _, orderItem := range orderItems {
+			if err := decrementStock(tx, orderItem.ItemID, orderItem.VariantID, cart.ID, orderItem.Quantity); err != nil {
+				var stockErr *StockError
+				if errors.As(err, &stockErr) {
+					return &CheckoutError{Status: http.StatusConflict, Step: "update_stock", Message: "Not enough stock", ItemID: stockErr.ItemID, VariantID: stockErr.VariantID, Available: &stockErr.Available}
+				}
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "update_stock", Message: "Failed to update stock", Err: err}
+			}
+		}
+
+		// Create order
+		order = Order{
+			UserID:           userID,
+			Subtotal:         subtotal,
+			Total:            total,
+			FreeShipping:     promotion.Type == PromotionFreeShipping,
+			TaxRegion:        tax.Region,
+			PricesIncludeTax: tax.Inclusive,
+			TaxTotal:         tax.Total,
+			ShippingMethod:   shipping.Method,
+			ShippingCost:     shipping.Cost,
+			Status:           OrderPending,
+		}
+		if shippingAddress != nil {
+			order.ShippingAddressID = &shippingAddress.ID
+			order.ShippingAddress = shippingAddress.PostalAddress
+		}
+		if billingAddress != nil {
+			order.BillingAddressID = &billingAddress.ID
+			order.BillingAddress = billingAddress.PostalAddress
+		}
+
+		if err := tx.Create(&order).Error; err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_order", Message: "Failed to create order", Err: err}
+		}
+
+		// Create order items
+		for _, orderItem := range orderItems {
+			orderItem.OrderID = order.ID
+			if err := tx.Create(&orderItem).Error; err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_order_items", Message: "Failed to create order items", Err: err}
+			}
+		}
+
+		// Keep the tax charged per rate
+		for _, taxLine := range tax.Taxes {
+			orderTax := OrderTax{OrderID: order.ID, Name: taxLine.Name, Rate: taxLine.Rate, Amount: taxLine.Amount}
+			if err := tx.Create(&orderTax).Error; err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_taxes", Message: "Failed to save taxes", Err: err}
+			}
+		}
+
+		// Keep the discounts and count the promotion as used
+		for _, discount := range discounts {
+			orderDiscount := OrderDiscount{
+				OrderID:     order.ID,
+				PromotionID: discount.PromotionID,
+				Code:        discount.Code,
+				Description: discount.Description,
+				ItemID:      discount.ItemID,
+				VariantID:   discount.VariantID,
+				Amount:      discount.Amount,
+			}
+			if err := tx.Create(&orderDiscount).Error; err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_discounts", Message: "Failed to save discounts", Err: err}
+			}
+		}
+		if cart.PromotionID != nil {
+			redemption := PromotionRedemption{PromotionID: promotion.ID, UserID: userID, OrderID: order.ID}
+			if err := tx.Create(&redemption).Error; err != nil {
+				return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_discounts", Message: "Failed to record coupon use", Err: err}
+			}
+		}
+
+		if err := recordOrderStatus(tx, order.ID, "", OrderPending, userID, ""); err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "record_status", Message: "Failed to record order status", Err: err}
+		}
+
+		payment = Payment{OrderID: order.ID, Provider: h.payments.Name(), Amount: total, Status: PaymentPending}
+		if err := tx.Create(&payment).Error; err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "create_payment", Message: "Failed to create payment", Err: err}
+		}
+
+		// Delete cart and cart items
+		if err := tx.Where("cart_id = ?", cart.ID).Delete(&CartItem{}).Error; err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "clear_cart", Message: "Failed to clear cart", Err: err}
+		}
+		if err := tx.Delete(&cart).Error; err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "delete_cart", Message: "Failed to delete cart", Err: err}
+		}
+
+		return nil
+	})
+	if err != nil {
+		respondCheckoutError(c, err)
+		return
+	}
+
+	// Charge the order once it is committed, so the provider is never
+	// called while the checkout holds the database
+	if err := h.chargeOrder(c.Request.Context(), &order, &payment, PaymentRequest{Source: req.PaymentSource}); err != nil {
+		respondCheckoutError(c, err)
+		return
+	}
+
+	// Load order with items and payments
+	h.db.Preload("Items.Item", withArchived).Preload("Discounts").Preload("Taxes").Preload("Payments").First(&order, order.ID)
+
+	if payment.Status == PaymentRequiresAction {
+		c.JSON(http.StatusAccepted, order)
+		return
+	}
+	c.JSON(http.StatusCreated, order)
+}
+
+func (h *OrderHandler) ListOrders(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var orders []Order
+	if err := h.db.Where("user_id = ?", userID).Preload("Items.Item", withArchived).Preload("Discounts").Preload("Taxes").Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
+
+// GetOrder returns one of the current user's orders with its status history
+func (h *OrderHandler) GetOrder(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var order Order
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), userID).Preload("Items.Item", withArchived).Preload("StatusHistory", orderedHistory).Preload("Discounts").Preload("Taxes").Preload("Payments").First(&order).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// ConfirmPayment finishes a payment the provider challenged at checkout with
+// the customer's challenge response. The order is paid once the payment is
+// captured; a failed challenge cancels it like a declined card.
+func (h *OrderHandler) ConfirmPayment(c *gin.Context) {
+	var req ConfirmPaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var order Order
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("user_id")).First(&order).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	var payment Payment
+	err := h.db.Where("order_id = ? AND status = ?", order.ID, PaymentRequiresAction).First(&payment).Error
+	if err == gorm.ErrRecordNotFound || (err == nil && order.Status != OrderPending) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order has no payment awaiting authentication", "status": order.Status})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payment"})
+		return
+	}
+
+	challenge := PaymentRequest{AuthorizationID: payment.AuthorizationID, ChallengeResponse: req.ChallengeResponse}
+	if err := h.chargeOrder(c.Request.Context(), &order, &payment, challenge); err != nil {
+		respondCheckoutError(c, err)
+		return
+	}
+
+	// Load order with items, history and payments
+	h.db.Preload("Items.Item", withArchived).Preload("StatusHistory", orderedHistory).Preload("Discounts").Preload("Taxes").Preload("Payments").First(&order, order.ID)
+
+	c.JSON(http.StatusOK, order)
+}
+
+// CancelOrder lets a user cancel their own order before it is fulfilled.
+// Cancelling an already cancelled order returns it unchanged, so retries are
+// safe; the cart is only restored by the call that cancelled the order.
+func (h *OrderHandler) CancelOrder(c *gin.Context) {
+	var req CancelOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+
+	var order Order
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&order).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	if order.Status != OrderCancelled {
+		if !customerCancellable(order.Status) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Orders can only be cancelled before they are fulfilled", "status": order.Status})
+			return
+		}
+
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := transitionOrder(tx, &order, OrderCancelled, userID, req.Reason); err != nil {
+				return err
+			}
+			if req.RestoreCart {
+				return restoreCart(tx, order)
+			}
+			return nil
+		})
+
+		var transitionErr *TransitionError
+		switch {
+		case errors.As(err, &transitionErr) && transitionErr.From == OrderCancelled:
+			// Another request cancelled the order first
+		case errors.As(err, &transitionErr):
+			c.JSON(http.StatusConflict, gin.H{"error": "Orders can only be cancelled before they are fulfilled", "status": transitionErr.From})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order"})
+			return
+		}
+	}
+
+	// Retries release whatever an earlier attempt could not
+	if err := h.releasePayments(c.Request.Context(), order.ID); err != nil {
+		log.Printf("Payment release error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Order cancelled, but its payment could not be released; try again"})
+		return
+	}
+
+	// Load order with items, history and payments
+	h.db.Preload("Items.Item", withArchived).Preload("StatusHistory", orderedHistory).Preload("Discounts").Preload("Taxes").Preload("Payments").First(&order, order.ID)
+
+	c.JSON(http.StatusOK, order)
+}
+
+// UpdateOrderStatus moves an order to a new status. Only the transitions in
+// orderTransitions are allowed; anything else is a 409 listing the statuses
+// the order can move to.
+func (h *OrderHandler) UpdateOrderStatus(c *gin.Context) {
+	var req UpdateOrderStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validOrderStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status " + req.Status})
+		return
+	}
+
+	var order Order
+	if err := h.db.First(&order, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		return transitionOrder(tx, &order, req.Status, c.GetUint("user_id"), req.Note)
+	})
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		c.JSON(http.StatusConflict, gin.H{"error": transitionErr.Error(), "status": transitionErr.From, "allowed": transitionErr.Allowed})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		return
+	}
+
+	if order.Status == OrderCancelled || order.Status == OrderRefunded {
+		if err := h.releasePayments(c.Request.Context(), order.ID); err != nil {
+			log.Printf("Payment release error: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Order status updated, but its payment could not be released"})
+			return
+		}
+	}
+
+	// Load order with items, history and payments
+	h.db.Preload("Items.Item", withArchived).Preload("StatusHistory", orderedHistory).Preload("Discounts").Preload("Taxes").Preload("Payments").First(&order, order.ID)
+
+	c.JSON(http.StatusOK, order)
+}
+
+// chargeOrder authorizes and captures payment for a pending order, then
+// marks the order paid. When the provider challenges the payment, the order
+// stays pending and payment is left requiring action. A declined, failed or
+// timed out payment cancels the order, puts its items back in the user's
+// cart and returns a *CheckoutError.
+func (h *OrderHandler) chargeOrder(ctx context.Context, order *Order, payment *Payment, req PaymentRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, h.paymentTimeout)
+	defer cancel()
+
+	req.Reference = payment.Reference()
+	req.Amount = payment.Amount
+
+	authorization, err := h.payments.Authorize(ctx, req)
+	var challenge *ChallengeError
+	if errors.As(err, &challenge) {
+		payment.Status = PaymentRequiresAction
+		payment.AuthorizationID = challenge.AuthorizationID
+		payment.ChallengeURL = challenge.URL
+		if err := h.db.Save(payment).Error; err != nil {
+			return &CheckoutError{Status: http.StatusInternalServerError, Step: "authorize_payment", Message: "Failed to save payment", OrderID: order.ID, Err: err}
+		}
+		return nil
+	}
+	if err != nil {
+		return h.failPayment(order, payment, "authorize_payment", err)
+	}
+
+	payment.Status = PaymentAuthorized
+	payment.AuthorizationID = authorization.ID
+	payment.ChallengeURL = ""
+	if err := h.db.Save(payment).Error; err != nil {
+		return &CheckoutError{Status: http.StatusInternalServerError, Step: "authorize_payment", Message: "Failed to save payment", OrderID: order.ID, Err: err}
+	}
+
+	if err := h.payments.Capture(ctx, authorization.ID, payment.Amount); err != nil {
+		// Release the held funds. If the void fails too, the provider drops
+		// the uncaptured authorization on its own.
+		if voidErr := h.payments.Void(context.Background(), authorization.ID); voidErr != nil {
+			log.Printf("Payment void error: %v", voidErr)
+		}
+		return h.failPayment(order, payment, "capture_payment", err)
+	}
+
+	payment.Status = PaymentCaptured
+	if err := h.db.Save(payment).Error; err != nil {
+		return &CheckoutError{Status: http.StatusInternalServerError, Step: "capture_payment", Message: "Failed to save payment", OrderID: order.ID, Err: err}
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		return transitionOrder(tx, order, OrderPaid, order.UserID, "Payment captured")
+	})
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		// The order was cancelled while it was being paid for
+		if err := h.releasePayments(ctx, order.ID); err != nil {
+			log.Printf("Payment release error: %v", err)
+		}
+		return &CheckoutError{Status: http.StatusConflict, Step: "mark_paid", Message: "Order is no longer awaiting payment", OrderID: order.ID}
+	}
+	if err != nil {
+		return &CheckoutError{Status: http.StatusInternalServerError, Step: "mark_paid", Message: "Failed to mark order paid", OrderID: order.ID, Err: err}
+	}
+
+	return nil
+}
+
+// failPayment records a failed payment, cancels its order and puts the
+// order's items back in the user's cart so they can try again. It returns
+// the *CheckoutError to respond with: 402 for a declined payment, 504 when
+// the provider timed out and 502 for any other provider error.
+func (h *OrderHandler) failPayment(order *Order, payment *Payment, step string, err error) error {
+	checkoutErr := &CheckoutError{Step: step, OrderID: order.ID}
+	var declineErr *DeclineError
+	switch {
+	case errors.As(err, &declineErr):
+		checkoutErr.Status = http.StatusPaymentRequired
+		checkoutErr.Message = "Payment declined"
+		checkoutErr.Code = declineErr.Code
+	case errors.Is(err, ErrPaymentTimeout) || errors.Is(err, context.DeadlineExceeded):
+		checkoutErr.Status = http.StatusGatewayTimeout
+		checkoutErr.Message = "Payment provider timed out"
+		checkoutErr.Code = "timeout"
+		checkoutErr.Err = err
+	default:
+		checkoutErr.Status = http.StatusBadGateway
+		checkoutErr.Message = "Payment failed"
+		checkoutErr.Code = "provider_error"
+		checkoutErr.Err = err
+	}
+
+	payment.Status = PaymentFailed
+	payment.FailureCode = checkoutErr.Code
+	payment.ChallengeURL = ""
+	txErr := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(payment).Error; err != nil {
+			return err
+		}
+		if err := transitionOrder(tx, order, OrderCancelled, order.UserID, "Payment failed: "+checkoutErr.Code); err != nil {
+			return err
+		}
+		return restoreCart(tx, *order)
+	})
+	if txErr != nil {
+		return &CheckoutError{Status: http.StatusInternalServerError, Step: step, Message: "Failed to record failed payment", OrderID: order.ID, Err: txErr}
+	}
+
+	return checkoutErr
+}
+
+// releasePayments gives back what was taken for a cancelled or refunded
+// order: captured payments are refunded, and authorizations that were never
+// captured are voided. Each payment is claimed with a conditional update
+// before the provider is called, so concurrent calls never release it twice,
+// and put back when the provider fails so that a retry can release it.
+func (h *OrderHandler) releasePayments(ctx context.Context, orderID uint) error {
+	var payments []Payment
+	if err := h.db.Where("order_id = ? AND status IN (?)", orderID, []string{PaymentRequiresAction, PaymentAuthorized, PaymentCaptured}).Find(&payments).Error; err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.paymentTimeout)
+	defer cancel()
+
+	for _, payment := range payments {
+		released := PaymentVoided
+		if payment.Status == PaymentCaptured {
+			released = PaymentRefunded
+		}
+
+		claim := h.db.Model(&Payment{}).Where("id = ? AND status = ?", payment.ID, payment.Status).Update("status", released)
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		var err error
+		if released == PaymentRefunded {
+			err = h.payments.Refund(ctx, payment.AuthorizationID, payment.Amount)
+		} else {
+			err = h.payments.Void(ctx, payment.AuthorizationID)
+		}
+		if err != nil {
+			h.db.Model(&Payment{}).Where("id = ?", payment.ID).Update("status", payment.Status)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper functions
+
+// newOrderItem snapshots a cart line into an order line, along with its
+// variant's SKU and options. Carts created before quantities were tracked may
+// have a zero quantity, which counts as one.
+func newOrderItem(cartItem CartItem) OrderItem {
+	quantity := cartItem.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+
+	orderItem := OrderItem{
+		ItemID:    cartItem.ItemID,
+		VariantID: cartItem.VariantID,
+		Quantity:  quantity,
+		Price:     cartItem.UnitPrice(),
+		Subtotal:  cartItem.UnitPrice().Mul(quantity),
+	}
+	if cartItem.Variant != nil {
+		orderItem.SKU = cartItem.Variant.SKU
+		orderItem.Options = cartItem.Variant.Options
+	}
+	return orderItem
+}
+
+// restoreCart puts a cancelled order's items back in its user's cart,
+// reserving them again. Archived items and variants are left out, as are
+// items bought before they had variants. Lines are capped at the item's
+// quantity limit and at the stock still available.
+func restoreCart(tx *gorm.DB, order Order) error {
+	var orderItems []OrderItem
+	if err := tx.Where("order_id = ?", order.ID).Preload("Item").Find(&orderItems).Error; err != nil {
+		return err
+	}
+
+	var cart Cart
+	if err := tx.Where(Cart{UserID: order.UserID}).FirstOrCreate(&cart).Error; err != nil {
+		return err
+	}
+
+	for _, orderItem := range orderItems {
+		if orderItem.Item.ID == 0 {
+			continue
+		}
+
+		variant, err := findVariant(tx, orderItem.Item, orderItem.VariantID)
+		var variantErr *VariantError
+		if err == gorm.ErrRecordNotFound || errors.As(err, &variantErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		price := orderItem.Item.Price
+		if variant != nil {
+			price = variant.Price
+		}
+
+		cartItem := CartItem{CartID: cart.ID, ItemID: orderItem.ItemID, VariantID: orderItem.VariantID, Price: price}
+		if err := sameVariant(tx, orderItem.VariantID).Where("cart_id = ? AND item_id = ?", cart.ID, orderItem.ItemID).First(&cartItem).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		quantity := cartItem.Quantity + orderItem.Quantity
+		if quantity > orderItem.Item.QuantityLimit() {
+			quantity = orderItem.Item.QuantityLimit()
+		}
+
+		err = reserveStock(tx, &cartItem, quantity)
+		var stockErr *StockError
+		if errors.As(err, &stockErr) {
+			if stockErr.Available <= cartItem.Quantity {
+				continue
+			}
+			err = reserveStock(tx, &cartItem, stockErr.Available)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// respondCheckoutError writes a failed checkout as JSON. Errors that are not a
+// CheckoutError come from the transaction itself, such as a failed commit.
+func respondCheckoutError(c *gin.Context, err error) {
+	checkoutErr, ok := err.(*CheckoutError)
+	if !ok {
+		checkoutErr = &CheckoutError{Status: http.StatusInternalServerError, Step: "commit", Message: "Failed to complete checkout", Err: err}
+	}
+
+	if checkoutErr.Err != nil {
+		log.Printf("Checkout error: %v", checkoutErr)
+	}
+
+	c.JSON(checkoutErr.Status, checkoutErr)
+}
+
+// respondStockError writes a failed reservation as JSON: 409 with the
+// available quantity when stock is short, otherwise 500 with message
+func respondStockError(c *gin.Context, err error, message string) {
+	var stockErr *StockError
+	if errors.As(err, &stockErr) {
+		response := gin.H{"error": "Not enough stock", "item_id": stockErr.ItemID, "available": stockErr.Available}
+		if stockErr.VariantID != nil {
+			response["variant_id"] = *stockErr.VariantID
+		}
+		c.JSON(http.StatusConflict, response)
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// respondVariantError writes a failed findVariant as JSON: 400 with the
+// variants to choose from when one is needed, 404 for a variant that is not
+// the item's
+func respondVariantError(c *gin.Context, err error) {
+	var variantErr *VariantError
+	switch {
+	case errors.As(err, &variantErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": variantErr.Message, "variants": variantErr.Variants})
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch variants"})
+	}
+}
+
+// variantParam parses the optional variant_id query parameter naming the
+// variant of a cart or wishlist line
+func variantParam(c *gin.Context) (*uint, error) {
+	value := c.Query("variant_id")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || id == 0 {
+		return nil, errors.New("variant_id must be a positive integer")
+	}
+	variantID := uint(id)
+	return &variantID, nil
+}
+
+// preloadLines loads what a cart or wishlist is shown with: each line's item
+// with its images, and its variant
+func preloadLines(db *gorm.DB) *gorm.DB {
+	return db.Preload("Items.Item").Preload("Items.Item.Images", orderedImages).Preload("Items.Variant")
+}
+
+// pricedInOtherCurrency reports whether a cart holds items priced in
+// another currency than currency
+func pricedInOtherCurrency(db *gorm.DB, cartID uint, currency string) bool {
+	var otherCurrencies int
+	db.Model(&CartItem{}).Joins("JOIN items ON items.id = cart_items.item_id").
+		Where("cart_items.cart_id = ? AND items.price_currency <> ?", cartID, currency).
+		Count(&otherCurrencies)
+	return otherCurrencies > 0
+}
+
+// resolveCategory finds the category an item should be filed under. An ID
+// must refer to an existing category, while a name is matched by slug or name
+// and created as a top-level category when it does not exist yet. It returns
+// nil when neither is given.
+func resolveCategory(db *gorm.DB, categoryID *uint, name string) (*Category, error) {
+	var category Category
+	if categoryID != nil {
+		if err := db.First(&category, *categoryID).Error; err != nil {
+			return nil, errors.New("Category not found")
+		}
+		return &category, nil
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, nil
+	}
+
+	slug := slugify(name)
+	if err := db.Where("slug = ? OR name = ?", slug, name).First(&category).Error; err == nil {
+		return &category, nil
+	}
+
+	category = Category{Slug: slug, Name: name}
+	if err := db.Create(&category).Error; err != nil {
+		return nil, errors.New("Failed to create category")
+	}
+	return &category, nil
+}
+
+// categoryWithDescendants returns the ID of the category and of every
+// category nested below it
+func categoryWithDescendants(categories []Category, rootID uint) []uint {
+	ids := []uint{rootID}
+	for i := 0; i < len(ids); i++ {
+		for _, category := range categories {
+			if category.ParentID != nil && *category.ParentID == ids[i] {
+				ids = append(ids, category.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// slugify turns a display name such as "Home & Garden" into "home-garden"
+func slugify(name string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && slug.Len() > 0 {
+				slug.WriteRune('-')
+			}
+			slug.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return slug.String()
+}
+
+// withArchived is a preload condition that also loads archived items, for
+// records such as order items that must keep pointing at what was sold
+func withArchived(db *gorm.DB) *gorm.DB {
+	return db.Unscoped()
+}
+
+// orderedHistory is a preload condition that lists status changes oldest first
+func orderedHistory(db *gorm.DB) *gorm.DB {
+	return db.Order("created_at, id")
+}
+
+// errLastAdmin is returned when a role change would leave no admins
+var errLastAdmin = errors.New("Cannot remove the last admin")
+
+// activeSessions scopes a query to the user's sessions that are neither
+// revoked nor expired
+func activeSessions(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now())
+}
+
+// findActiveSession loads the session a token was issued for, if it is
+// still active
+func findActiveSession(db *gorm.DB, claims *Claims) (Session, bool) {
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", claims.SessionID, claims.UserID).First(&session).Error; err != nil {
+		return session, false
+	}
+	return session, session.Active(time.Now())
+}
+
+// revokeSessions revokes the sessions matched by query, and the access tokens
+// already issued for them
+func revokeSessions(tokens *TokenService, query *gorm.DB) error {
+	var ids []uint
+	if err := query.Model(&Session{}).Where("revoked_at IS NULL").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if err := query.New().Model(&Session{}).Where("id IN (?)", ids).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	tokens.RevokeSessions(now, ids...)
+	return nil
+}
+
+// loadRevokedSessions tells tokens about sessions revoked recently enough that
+// access tokens issued for them may still be valid, so they stay revoked
+// across a restart
+func loadRevokedSessions(db *gorm.DB, tokens *TokenService) error {
+	var sessions []Session
+	if err := db.Where("revoked_at > ?", time.Now().Add(-AccessTokenTTL)).Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		tokens.RevokeSessions(*session.RevokedAt, session.ID)
+	}
+	return nil
+}
+
+// authMiddleware accepts requests carrying a valid access token for a session
+// that has not been revoked and makes the token's user and session IDs
+// available as "user_id" and "session_id"
+func authMiddleware(tokens *TokenService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("Authorization")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			c.Abort()
+			return
+		}
+
+		// Remove "Bearer " prefix if present
+		token = strings.TrimPrefix(token, "Bearer ")
+
+		claims, err := tokens.Parse(token, AccessToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		// Tokens of a revoked session stop working before they expire. The
+		// session itself is only loaded when refreshing, which is also when
+		// its last_seen_at is updated.
+		if tokens.SessionRevoked(claims.SessionID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
+		c.Next()
+	}
+}
+
+// requireRole only lets through users that have one of roles. It must run
+// after authMiddleware. Roles are read from the database on every request,
+// so granting or revoking a role takes effect immediately.
+func requireRole(db *gorm.DB, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user User
+		if err := db.Select("id, role").First(&user, c.GetUint("user_id")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		if !user.HasRole(roles...) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+
+		c.Set("role", user.Role)
+		c.Next()
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// IdempotencyKeyHeader names the header clients use to make a POST safe to
+// retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyWindow is how long a response is kept for replay when
+// IDEMPOTENCY_WINDOW is not set
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyKey stores the first response to a request sent with an
+// Idempotency-Key, so that retries with the same key replay it instead of
+// running the request again. Keys belong to a user. Status is zero while the
+// first request is still running.
+type IdempotencyKey struct {
+	ID          uint   `gorm:"primary_key"`
+	UserID      uint   `gorm:"not null;unique_index:idx_idempotency_user_key"`
+	Key         string `gorm:"not null;unique_index:idx_idempotency_user_key"`
+	Fingerprint string `gorm:"not null"`
+	Status      int    `gorm:"not null;default:0"`
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// idempotencyWindowFromEnv reads how long responses are kept for replay from
+// IDEMPOTENCY_WINDOW, such as "24h" or "30m"
+func idempotencyWindowFromEnv() (time.Duration, error) {
+	value := os.Getenv("IDEMPOTENCY_WINDOW")
+	if value == "" {
+		return DefaultIdempotencyWindow, nil
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid IDEMPOTENCY_WINDOW %q", value)
+	}
+	return window, nil
+}
+
+// idempotencyFingerprint identifies a request by its method, path and body
+func idempotencyFingerprint(c *gin.Context, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", c.Request.Method, c.Request.URL.Path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body as it is written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a route safe to retry for requests that carry an
+// Idempotency-Key header. The first request with a key runs and its response
+// is kept for window; a retry with the same key and body replays that
+// response with an Idempotent-Replayed header. Reusing a key for a different
+// request is a 422, and a retry while the first request is still running is
+// a 409. Requests without the header run as usual. It must come after
+// authMiddleware or cartOwner; a guest's keys are their own.
+func idempotent(db *gorm.DB, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := c.GetUint("user_id")
+		if guestID := c.GetString("guest_id"); guestID != "" {
+			key = "guest:" + guestID + ":" + key
+		}
+		fingerprint := idempotencyFingerprint(c, body)
+
+		// Forget the key once its window has passed
+		if err := db.Where("user_id = ? AND key = ? AND expires_at <= ?", userID, key, time.Now()).Delete(&IdempotencyKey{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+
+		// Claim the key. The unique index lets only one request claim it,
+		// so concurrent retries cannot both run.
+		record := IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint, ExpiresAt: time.Now().Add(window)}
+		if err := db.Create(&record).Error; err != nil {
+			var existing IdempotencyKey
+			if err := db.Where("user_id = ? AND key = ?", userID, key).First(&existing).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+				c.Abort()
+				return
+			}
+
+			switch {
+			case existing.Fingerprint != fingerprint:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			case existing.Status == 0:
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.Status, existing.ContentType, existing.Body)
+			}
+			c.Abort()
+			return
+		}
+
+		// Release the key if the handler panics, so the request can be retried
+		completed := false
+		defer func() {
+			if !completed {
+				db.Delete(&record)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		err = db.Model(&record).Updates(map[string]interface{}{
+			"status":       writer.Status(),
+			"content_type": writer.Header().Get("Content-Type"),
+			"body":         writer.body.Bytes(),
+		}).Error
+		if err != nil {
+			log.Printf("Idempotency-Key error: %v", err)
+			db.Delete(&record)
+		}
+		completed = true
+	}
+}
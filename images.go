@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Upload limits. MaxImagePixels keeps a small file that decodes to a huge
+// image from exhausting memory.
+const (
+	MaxImageBytes  = 5 << 20
+	MaxImagePixels = 40_000_000
+	// ThumbnailSize is the longest side of a thumbnail in pixels
+	ThumbnailSize = 320
+)
+
+// imageTypes maps the content types accepted for upload, as sniffed from the
+// file itself, to the extension they are stored with
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// imageKeyPattern matches the keys images are stored under. Keys never
+// contain a path separator, so they cannot name a file outside the store.
+var imageKeyPattern = regexp.MustCompile(`^[a-z0-9-]+\.(jpg|png|gif)$`)
+
+// ImageStore keeps uploaded image files under keys made by the handlers.
+// URL returns where clients can fetch a stored file.
+type ImageStore interface {
+	Save(key string, data []byte) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	URL(key string) string
+}
+
+// DiskImageStore is the default ImageStore. It keeps files in Dir and serves
+// them below BaseURL.
+type DiskImageStore struct {
+	Dir     string
+	BaseURL string
+}
+
+// NewDiskImageStoreFromEnv stores images in IMAGE_DIR, or in "uploads" when
+// it is not set, creating the directory when needed. They are served by the
+// /api/images route.
+func NewDiskImageStoreFromEnv() (*DiskImageStore, error) {
+	dir := os.Getenv("IMAGE_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskImageStore{Dir: dir, BaseURL: "/api/images"}, nil
+}
+
+// path returns the file key is stored in
+func (s *DiskImageStore) path(key string) (string, error) {
+	if !imageKeyPattern.MatchString(key) {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+// Save writes the file to a temporary name first, so a failed write never
+// leaves a partial image behind
+func (s *DiskImageStore) Save(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return fmt.Errorf("invalid image key %q", key)
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Open returns an error satisfying errors.Is(err, os.ErrNotExist) for keys
+// that are not stored
+func (s *DiskImageStore) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete removes a stored file. Deleting a missing file is not an error.
+func (s *DiskImageStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskImageStore) URL(key string) string {
+	return s.BaseURL + "/" + key
+}
+
+// ImageError explains why an upload was refused
+type ImageError struct {
+	Status  int
+	Message string
+}
+
+func (e *ImageError) Error() string {
+	return e.Message
+}
+
+// processedImage is an accepted upload and the thumbnail made from it
+type processedImage struct {
+	ContentType   string
+	Extension     string
+	Width         int
+	Height        int
+	Thumbnail     []byte
+	ThumbnailType string
+}
+
+// processImage checks an upload by its content rather than by what the
+// client claims it is, and makes its thumbnail. It returns an *ImageError
+// for files that are not an image of an accepted type and size.
+func processImage(data []byte) (processedImage, error) {
+	if len(data) > MaxImageBytes {
+		return processedImage{}, &ImageError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Images may be at most %d MB", MaxImageBytes>>20)}
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := imageTypes[contentType]
+	if !ok {
+		return processedImage{}, &ImageError{Status: http.StatusUnsupportedMediaType, Message: "Images must be JPEG, PNG or GIF"}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return processedImage{}, &ImageError{Status: http.StatusBadRequest, Message: "Image could not be read"}
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return processedImage{}, &ImageError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Images may have at most %d megapixels", MaxImagePixels/1_000_000)}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return processedImage{}, &ImageError{Status: http.StatusBadRequest, Message: "Image could not be read"}
+	}
+
+	// Photos keep JPEG; PNG and GIF thumbnails keep their transparency
+	var thumbnail bytes.Buffer
+	processed := processedImage{ContentType: contentType, Extension: extension, Width: config.Width, Height: config.Height}
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumbnail, makeThumbnail(img, ThumbnailSize), &jpeg.Options{Quality: 85})
+		processed.ThumbnailType = "image/jpeg"
+	} else {
+		err = png.Encode(&thumbnail, makeThumbnail(img, ThumbnailSize))
+		processed.ThumbnailType = "image/png"
+	}
+	if err != nil {
+		return processedImage{}, err
+	}
+	processed.Thumbnail = thumbnail.Bytes()
+	return processed, nil
+}
+
+// makeThumbnail scales img down to fit in a size by size square, keeping its
+// aspect ratio. Each thumbnail pixel is the average of the source pixels it
+// covers, which keeps detail better than sampling one of them. Images that
+// already fit keep their size.
+func makeThumbnail(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	thumbWidth, thumbHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbWidth, thumbHeight = size, max(1, height*size/width)
+		} else {
+			thumbWidth, thumbHeight = max(1, width*size/height), size
+		}
+	}
+
+	thumb := image.NewNRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0 := bounds.Min.Y + y*height/thumbHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/thumbHeight)
+		for x := 0; x < thumbWidth; x++ {
+			x0 := bounds.Min.X + x*width/thumbWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/thumbWidth)
+
+			// RGBA returns 16-bit colour premultiplied by alpha, so the sums
+			// weigh each pixel by how opaque it is
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			thumb.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r * 0xff / a),
+				G: uint8(g * 0xff / a),
+				B: uint8(b * 0xff / a),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return thumb
+}
+
+// newImageKeys returns fresh keys for an image of an item and its thumbnail
+func newImageKeys(itemID uint, extension string, thumbnailType string) (key string, thumbnailKey string, err error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	base := fmt.Sprintf("item-%d-%s", itemID, hex.EncodeToString(random))
+	return base + extension, base + "-thumb" + imageTypes[thumbnailType], nil
+}
+
+// orderedImages preloads an item's images in the order they were uploaded,
+// so the first is the item's main image
+func orderedImages(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ReservationTTL is how long units put in a cart stay reserved for it.
+// Adding to or changing the cart line renews the reservation.
+const ReservationTTL = 15 * time.Minute
+
+// StockError reports that fewer units of an item, or of one of its
+// variants, are available than were asked for
+type StockError struct {
+	ItemID    uint  `json:"item_id"`
+	VariantID *uint `json:"variant_id,omitempty"`
+	Available uint  `json:"available"`
+}
+
+func (e *StockError) Error() string {
+	if e.VariantID != nil {
+		return fmt.Sprintf("not enough stock for variant %d of item %d: %d available", *e.VariantID, e.ItemID, e.Available)
+	}
+	return fmt.Sprintf("not enough stock for item %d: %d available", e.ItemID, e.Available)
+}
+
+// reservedByOthers is the SQL for the units held by unexpired reservations in
+// carts other than the one asking. The %s is the cart_items column naming
+// what is counted: item_id or variant_id.
+const reservedByOthers = `SELECT COALESCE(SUM(quantity), 0) FROM cart_items
+	WHERE %s = ? AND cart_id <> ? AND reserved_until > ?`
+
+// stockRow names the row that holds the stock of an item, or of its variant
+// when variantID is set, and the cart_items column reserving from it
+func stockRow(itemID uint, variantID *uint) (table string, column string, id uint) {
+	if variantID != nil {
+		return "item_variants", "variant_id", *variantID
+	}
+	return "items", "item_id", itemID
+}
+
+// availableStock returns the units of an item, or of its variant, that cartID
+// may still take: the stock left after every other cart's active
+// reservations
+func availableStock(db *gorm.DB, itemID uint, variantID *uint, cartID uint) (uint, error) {
+	table, column, id := stockRow(itemID, variantID)
+
+	var result struct {
+		Available int
+	}
+	err := db.Raw("SELECT stock - ("+fmt.Sprintf(reservedByOthers, column)+") AS available FROM "+table+" WHERE id = ?",
+		id, cartID, time.Now(), id).Scan(&result).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if result.Available < 0 {
+		return 0, nil
+	}
+	return uint(result.Available), nil
+}
+
+// reserveStock sets cartItem's quantity and renews its reservation, or
+// returns a *StockError when the quantity is not available. cartItem is
+// created when it is new. Call it inside a transaction so the check and the
+// write cannot interleave with another reservation.
+func reserveStock(tx *gorm.DB, cartItem *CartItem, quantity uint) error {
+	available, err := availableStock(tx, cartItem.ItemID, cartItem.VariantID, cartItem.CartID)
+	if err != nil {
+		return err
+	}
+	if quantity > available {
+		return &StockError{ItemID: cartItem.ItemID, VariantID: cartItem.VariantID, Available: available}
+	}
+
+	reservedUntil := time.Now().Add(ReservationTTL)
+	cartItem.Quantity = quantity
+	cartItem.ReservedUntil = &reservedUntil
+
+	if tx.NewRecord(cartItem) {
+		return tx.Create(cartItem).Error
+	}
+	return tx.Model(cartItem).Updates(map[string]interface{}{
+		"quantity":       quantity,
+		"reserved_until": reservedUntil,
+	}).Error
+}
+
+// decrementStock takes quantity units of an item, or of its variant, out of
+// stock for cartID in a single conditional UPDATE, so concurrent checkouts
+// can never sell more than there is. Other carts' active reservations are
+// left untouched. It returns a *StockError when the units are not available.
+func decrementStock(tx *gorm.DB, itemID uint, variantID *uint, cartID uint, quantity uint) error {
+	table, column, id := stockRow(itemID, variantID)
+
+	now := time.Now()
+	result := tx.Exec(`UPDATE `+table+` SET stock = stock - ?, updated_at = ?
+		WHERE id = ? AND stock - (`+fmt.Sprintf(reservedByOthers, column)+`) >= ?`,
+		quantity, now, id, id, cartID, now, quantity)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		available, err := availableStock(tx, itemID, variantID, cartID)
+		if err != nil {
+			return err
+		}
+		return &StockError{ItemID: itemID, VariantID: variantID, Available: available}
+	}
+
+	return nil
+}
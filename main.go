@@ -11,15 +11,17 @@ import (
 )
 
 func main() {
-	// Initialize database
-	db, err := gorm.Open("sqlite3", "./ecommerce.db")
+	// Initialize database. Transactions take the write lock up front and
+	// wait for each other, so concurrent checkouts queue up instead of
+	// failing with "database is locked".
+	db, err := gorm.Open("sqlite3", "./ecommerce.db?_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 	defer db.Close()
 
 	// Auto migrate the schema
-	db.AutoMigrate(&User{}, &Item{}, &Cart{}, &CartItem{}, &Order{}, &OrderItem{})
+	db.AutoMigrate(&User{}, &Session{}, &Address{}, &Item{}, &ItemVariant{}, &ItemImage{}, &Review{}, &ReviewVote{}, &ReviewFlag{}, &Category{}, &Cart{}, &CartItem{}, &Wishlist{}, &WishlistItem{}, &Order{}, &OrderItem{}, &OrderStatusEvent{}, &Payment{}, &Promotion{}, &PromotionRedemption{}, &OrderDiscount{}, &OrderTax{}, &IdempotencyKey{})
 
 	// Create sample users if they don't exist
 	var userCount int64
@@ -30,97 +32,141 @@ func main() {
 		sampleUser := User{
 			Username: "testuser",
 			Password: string(hashedPassword),
-			Token:    "sample-token-123",
 		}
 		db.Create(&sampleUser)
 
+		// Give the sample user a default address
+		db.Create(&Address{UserID: sampleUser.ID, PostalAddress: PostalAddress{Name: "Test User", Line1: "1 Market St", City: "San Francisco", Region: "CA", PostalCode: "94105", Country: "US"}, IsDefault: true})
+
+		// Create sample admin
+		hashedAdminPassword, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+		adminUser := User{
+			Username: "admin",
+			Password: string(hashedAdminPassword),
+			Role:     RoleAdmin,
+		}
+		db.Create(&adminUser)
+
 		// Create sample items with categories
 		sampleItems := []Item{
 			// Electronics
-			{Name: "MacBook Pro", Description: "High-performance laptop with M2 chip", Price: 1299.99, Category: "Electronics"},
-			{Name: "iPhone 15", Description: "Latest smartphone with advanced camera", Price: 899.99, Category: "Electronics"},
-			{Name: "Sony WH-1000XM4", Description: "Premium noise-canceling headphones", Price: 349.99, Category: "Electronics"},
-			{Name: "iPad Air", Description: "Lightweight tablet for productivity", Price: 599.99, Category: "Electronics"},
-			{Name: "Apple Watch", Description: "Smartwatch with health tracking", Price: 399.99, Category: "Electronics"},
+			{Name: "MacBook Pro", Description: "High-performance laptop with M2 chip", Price: NewMoney(129999, DefaultCurrency), Category: "Electronics"},
+			{Name: "iPhone 15", Description: "Latest smartphone with advanced camera", Price: NewMoney(89999, DefaultCurrency), Category: "Electronics"},
+			{Name: "Sony WH-1000XM4", Description: "Premium noise-canceling headphones", Price: NewMoney(34999, DefaultCurrency), Category: "Electronics"},
+			{Name: "iPad Air", Description: "Lightweight tablet for productivity", Price: NewMoney(59999, DefaultCurrency), Category: "Electronics"},
+			{Name: "Apple Watch", Description: "Smartwatch with health tracking", Price: NewMoney(39999, DefaultCurrency), Category: "Electronics"},
 			
 			// Clothing
-			{Name: "Nike Air Max", Description: "Comfortable running shoes", Price: 129.99, Category: "Clothing"},
-			{Name: "Levi's Jeans", Description: "Classic blue denim jeans", Price: 79.99, Category: "Clothing"},
-			{Name: "Adidas Hoodie", Description: "Warm and stylish hoodie", Price: 59.99, Category: "Clothing"},
-			{Name: "Ray-Ban Aviator", Description: "Classic sunglasses", Price: 159.99, Category: "Clothing"},
-			{Name: "Rolex Submariner", Description: "Luxury diving watch", Price: 8999.99, Category: "Clothing"},
+			{Name: "Nike Air Max", Description: "Comfortable running shoes", Price: NewMoney(12999, DefaultCurrency), Category: "Clothing"},
+			{Name: "Levi's Jeans", Description: "Classic blue denim jeans", Price: NewMoney(7999, DefaultCurrency), Category: "Clothing"},
+			{Name: "Adidas Hoodie", Description: "Warm and stylish hoodie", Price: NewMoney(5999, DefaultCurrency), Category: "Clothing"},
+			{Name: "Ray-Ban Aviator", Description: "Classic sunglasses", Price: NewMoney(15999, DefaultCurrency), Category: "Clothing"},
+			{Name: "Rolex Submariner", Description: "Luxury diving watch", Price: NewMoney(899999, DefaultCurrency), Category: "Clothing"},
 			
 			// Home & Garden
-			{Name: "Dyson V15", Description: "Cordless vacuum cleaner", Price: 699.99, Category: "Home & Garden"},
-			{Name: "Philips Hue", Description: "Smart LED light bulbs", Price: 199.99, Category: "Home & Garden"},
-			{Name: "IKEA Furniture", Description: "Modern living room set", Price: 899.99, Category: "Home & Garden"},
-			{Name: "KitchenAid Mixer", Description: "Professional stand mixer", Price: 399.99, Category: "Home & Garden"},
-			{Name: "Nest Thermostat", Description: "Smart home temperature control", Price: 249.99, Category: "Home & Garden"},
+			{Name: "Dyson V15", Description: "Cordless vacuum cleaner", Price: NewMoney(69999, DefaultCurrency), Category: "Home & Garden"},
+			{Name: "Philips Hue", Description: "Smart LED light bulbs", Price: NewMoney(19999, DefaultCurrency), Category: "Home & Garden"},
+			{Name: "IKEA Furniture", Description: "Modern living room set", Price: NewMoney(89999, DefaultCurrency), Category: "Home & Garden"},
+			{Name: "KitchenAid Mixer", Description: "Professional stand mixer", Price: NewMoney(39999, DefaultCurrency), Category: "Home & Garden"},
+			{Name: "Nest Thermostat", Description: "Smart home temperature control", Price: NewMoney(24999, DefaultCurrency), Category: "Home & Garden"},
 			
 			// Books
-			{Name: "The Great Gatsby", Description: "Classic American novel", Price: 12.99, Category: "Books"},
-			{Name: "Harry Potter Set", Description: "Complete 7-book collection", Price: 89.99, Category: "Books"},
-			{Name: "Programming Guide", Description: "Learn coding from scratch", Price: 49.99, Category: "Books"},
-			{Name: "Cookbook Collection", Description: "1000+ recipes", Price: 34.99, Category: "Books"},
-			{Name: "Business Strategy", Description: "Modern business insights", Price: 24.99, Category: "Books"},
+			{Name: "The Great Gatsby", Description: "Classic American novel", Price: NewMoney(1299, DefaultCurrency), Category: "Books"},
+			{Name: "Harry Potter Set", Description: "Complete 7-book collection", Price: NewMoney(8999, DefaultCurrency), Category: "Books"},
+			{Name: "Programming Guide", Description: "Learn coding from scratch", Price: NewMoney(4999, DefaultCurrency), Category: "Books"},
+			{Name: "Cookbook Collection", Description: "1000+ recipes", Price: NewMoney(3499, DefaultCurrency), Category: "Books"},
+			{Name: "Business Strategy", Description: "Modern business insights", Price: NewMoney(2499, DefaultCurrency), Category: "Books"},
 			
 			// Sports
-			{Name: "Wilson Tennis Racket", Description: "Professional tennis equipment", Price: 199.99, Category: "Sports"},
-			{Name: "Nike Basketball", Description: "Official size basketball", Price: 29.99, Category: "Sports"},
-			{Name: "Yoga Mat", Description: "Premium non-slip yoga mat", Price: 39.99, Category: "Sports"},
-			{Name: "Gym Equipment", Description: "Complete home gym set", Price: 599.99, Category: "Sports"},
-			{Name: "Bicycle", Description: "Mountain bike for adventure", Price: 799.99, Category: "Sports"},
+			{Name: "Wilson Tennis Racket", Description: "Professional tennis equipment", Price: NewMoney(19999, DefaultCurrency), Category: "Sports"},
+			{Name: "Nike Basketball", Description: "Official size basketball", Price: NewMoney(2999, DefaultCurrency), Category: "Sports"},
+			{Name: "Yoga Mat", Description: "Premium non-slip yoga mat", Price: NewMoney(3999, DefaultCurrency), Category: "Sports"},
+			{Name: "Gym Equipment", Description: "Complete home gym set", Price: NewMoney(59999, DefaultCurrency), Category: "Sports"},
+			{Name: "Bicycle", Description: "Mountain bike for adventure", Price: NewMoney(79999, DefaultCurrency), Category: "Sports"},
 		}
+
+		// Clothing is sold by size
+		sampleVariants := map[string][]ItemVariant{
+			"Nike Air Max": {
+				{SKU: "NIKE-AIRMAX-9", Options: VariantOptions{"size": "9"}, Stock: 15},
+				{SKU: "NIKE-AIRMAX-10", Options: VariantOptions{"size": "10"}, Stock: 20},
+				{SKU: "NIKE-AIRMAX-11", Options: VariantOptions{"size": "11"}, Stock: 15},
+			},
+			"Levi's Jeans": {
+				{SKU: "LEVIS-501-30", Options: VariantOptions{"size": "30"}, Stock: 15},
+				{SKU: "LEVIS-501-32", Options: VariantOptions{"size": "32"}, Stock: 20},
+				{SKU: "LEVIS-501-34", Options: VariantOptions{"size": "34"}, Stock: 15},
+			},
+			"Adidas Hoodie": {
+				{SKU: "ADIDAS-HOODIE-S", Options: VariantOptions{"size": "S"}, Stock: 15},
+				{SKU: "ADIDAS-HOODIE-M", Options: VariantOptions{"size": "M"}, Stock: 20},
+				{SKU: "ADIDAS-HOODIE-L", Options: VariantOptions{"size": "L"}, Stock: 15},
+				{SKU: "ADIDAS-HOODIE-XL", Options: VariantOptions{"size": "XL"}, PriceOverride: NewMoney(6499, DefaultCurrency), Stock: 10},
+			},
+		}
+
 		for _, item := range sampleItems {
+			if category, err := resolveCategory(db, nil, item.Category); err == nil && category != nil {
+				item.CategoryID = &category.ID
+			}
+			item.Stock = 50
+			item.Variants = sampleVariants[item.Name]
 			db.Create(&item)
 		}
+
+		// Create sample coupons
+		samplePromotions := []Promotion{
+			{Code: "WELCOME10", Description: "10% off your order", Type: PromotionPercentage, PercentOff: 10, PerUserLimit: 1},
+			{Code: "FREESHIP", Description: "Free shipping", Type: PromotionFreeShipping},
+		}
+		for _, promotion := range samplePromotions {
+			db.Create(&promotion)
+		}
 	}
 
-	// Initialize router
-	r := gin.Default()
+	// Initialize token signing
+	tokens, err := NewTokenServiceFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load JWT keys:", err)
+	}
+	if err := loadRevokedSessions(db, tokens); err != nil {
+		log.Fatal("Failed to load revoked sessions:", err)
+	}
 
-	// Enable CORS
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		
-		c.Next()
-	})
+	// Responses to requests with an Idempotency-Key are kept for replay
+	idempotencyWindow, err := idempotencyWindowFromEnv()
+	if err != nil {
+		log.Fatal("Failed to read idempotency window:", err)
+	}
+
+	// Orders are taxed by the jurisdictions in the tax table
+	taxes, err := taxTableFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load tax table:", err)
+	}
+
+	// Orders are shipped by the methods in the shipping table
+	shipping := DefaultShippingTable()
 
-	// Initialize handlers
-	userHandler := &UserHandler{db: db}
-	itemHandler := &ItemHandler{db: db}
-	cartHandler := &CartHandler{db: db}
-	orderHandler := &OrderHandler{db: db}
-
-	// Routes
-	api := r.Group("/api")
-	{
-		// User routes
-		api.POST("/users", userHandler.CreateUser)
-		api.GET("/users", userHandler.ListUsers)
-		api.POST("/users/login", userHandler.Login)
-
-		// Item routes
-		api.POST("/items", itemHandler.CreateItem)
-		api.GET("/items", itemHandler.ListItems)
-
-		// Cart routes (require authentication)
-		api.POST("/carts", authMiddleware(db), cartHandler.CreateCart)
-		api.GET("/carts", authMiddleware(db), cartHandler.ListCarts)
-		api.DELETE("/carts/items/:item_id", authMiddleware(db), cartHandler.RemoveFromCart)
-
-		// Order routes (require authentication)
-		api.POST("/orders", authMiddleware(db), orderHandler.CreateOrder)
-		api.GET("/orders", authMiddleware(db), orderHandler.ListOrders)
+	// Uploaded item images are kept on local disk
+	images, err := NewDiskImageStoreFromEnv()
+	if err != nil {
+		log.Fatal("Failed to open image store:", err)
 	}
 
+	// Initialize router. Orders are charged through the in-process fake
+	// provider until a real gateway is configured.
+	r := gin.Default()
+	setupRouter(r, db, RouterConfig{
+		Tokens:            tokens,
+		IdempotencyWindow: idempotencyWindow,
+		Taxes:             taxes,
+		Shipping:          shipping,
+		Images:            images,
+		Payments:          NewFakePaymentProvider(),
+		PaymentTimeout:    PaymentTimeout,
+	})
+
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -3,9 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -23,6 +34,13 @@ var _ = Describe("Ecommerce API", func() {
 	var (
 		router *gin.Engine
 		db     *gorm.DB
+		tokens *TokenService
+
+		// payments is the fake provider orders are charged through
+		payments *FakePaymentProvider
+
+		// adminToken signs requests to admin-only routes
+		adminToken string
 	)
 
 	BeforeEach(func() {
@@ -34,43 +52,26 @@ var _ = Describe("Ecommerce API", func() {
 		db, err = gorm.Open("sqlite3", ":memory:")
 		Expect(err).NotTo(HaveOccurred())
 
+		// Every connection to :memory: is a separate database, so keep to one
+		db.DB().SetMaxOpenConns(1)
+
 		// Auto migrate the schema
-		db.AutoMigrate(&User{}, &Item{}, &Cart{}, &Order{})
-
-		// Initialize router
-		router = gin.New()
-		router.Use(func(c *gin.Context) {
-			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-			
-			if c.Request.Method == "OPTIONS" {
-				c.AbortWithStatus(204)
-				return
-			}
-			
-			c.Next()
-		})
-
-		// Initialize handlers
-		userHandler := &UserHandler{db: db}
-		itemHandler := &ItemHandler{db: db}
-		cartHandler := &CartHandler{db: db}
-		orderHandler := &OrderHandler{db: db}
-
-		// Routes
-		api := router.Group("/api")
-		{
-			api.POST("/users", userHandler.CreateUser)
-			api.GET("/users", userHandler.ListUsers)
-			api.POST("/users/login", userHandler.Login)
-			api.POST("/items", itemHandler.CreateItem)
-			api.GET("/items", itemHandler.ListItems)
-			api.POST("/carts", authMiddleware(db), cartHandler.CreateCart)
-			api.GET("/carts", authMiddleware(db), cartHandler.ListCarts)
-			api.POST("/orders", authMiddleware(db), orderHandler.CreateOrder)
-			api.GET("/orders", authMiddleware(db), orderHandler.ListOrders)
-		}
+		db.AutoMigrate(&User{}, &Session{}, &Address{}, &Item{}, &ItemVariant{}, &ItemImage{}, &Review{}, &ReviewVote{}, &ReviewFlag{}, &Category{}, &Cart{}, &CartItem{}, &Wishlist{}, &WishlistItem{}, &Order{}, &OrderItem{}, &OrderStatusEvent{}, &Payment{}, &Promotion{}, &PromotionRedemption{}, &OrderDiscount{}, &OrderTax{}, &IdempotencyKey{})
+
+		// Sign tokens with a fixed test key
+		tokens, err = NewTokenService(map[string][]byte{"test": []byte("test-secret")}, "test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Sign in an admin for catalog management
+		admin := User{Username: "admin", Password: "unused", Role: RoleAdmin}
+		Expect(db.Create(&admin).Error).NotTo(HaveOccurred())
+		adminSession := Session{UserID: admin.ID, ExpiresAt: time.Now().Add(time.Hour)}
+		Expect(db.Create(&adminSession).Error).NotTo(HaveOccurred())
+		adminToken, _, err = tokens.Issue(adminSession, AccessToken)
+		Expect(err).NotTo(HaveOccurred())
+
+		payments = NewFakePaymentProvider()
+		router = newTestRouter(db, tokens, payments)
 	})
 
 	AfterEach(func() {
@@ -93,11 +94,19 @@ var _ = Describe("Ecommerce API", func() {
 
 			Expect(w.Code).To(Equal(http.StatusCreated))
 
-			var response User
+			var response LoginResponse
 			json.Unmarshal(w.Body.Bytes(), &response)
-			Expect(response.Username).To(Equal("testuser"))
-			Expect(response.Password).To(Equal(""))
+			Expect(response.User.Username).To(Equal("testuser"))
+			Expect(response.User.Password).To(Equal(""))
 			Expect(response.Token).NotTo(BeEmpty())
+			Expect(response.RefreshToken).NotTo(BeEmpty())
+
+			// The refresh token from signing up keeps the session going
+			req = httptest.NewRequest("POST", "/api/users/refresh", bytes.NewBufferString(fmt.Sprintf(`{"refresh_token": %q}`, response.RefreshToken)))
+			req.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
 		})
 
 		It("should not create user with duplicate username", func() {
@@ -114,8 +123,11 @@ var _ = Describe("Ecommerce API", func() {
 			router.ServeHTTP(w, req)
 
 			// Create same user again
+			req2 := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
+			req2.Header.Set("Content-Type", "application/json")
+
 			w2 := httptest.NewRecorder()
-			router.ServeHTTP(w2, req)
+			router.ServeHTTP(w2, req2)
 
 			Expect(w2.Code).To(Equal(http.StatusConflict))
 		})
@@ -152,6 +164,7 @@ var _ = Describe("Ecommerce API", func() {
 			var response LoginResponse
 			json.Unmarshal(w2.Body.Bytes(), &response)
 			Expect(response.Token).NotTo(BeEmpty())
+			Expect(response.RefreshToken).NotTo(BeEmpty())
 			Expect(response.User.Username).To(Equal("testuser"))
 		})
 
@@ -184,6 +197,377 @@ var _ = Describe("Ecommerce API", func() {
 
 			Expect(w2.Code).To(Equal(http.StatusUnauthorized))
 		})
+
+		Describe("Tokens", func() {
+			var login LoginResponse
+
+			BeforeEach(func() {
+				userData := CreateUserRequest{
+					Username: "testuser",
+					Password: "password123",
+				}
+
+				jsonData, _ := json.Marshal(userData)
+				req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+				router.ServeHTTP(httptest.NewRecorder(), req)
+
+				loginJson, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "password123"})
+				loginReq := httptest.NewRequest("POST", "/api/users/login", bytes.NewBuffer(loginJson))
+				loginReq.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, loginReq)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				login = LoginResponse{}
+				json.Unmarshal(w.Body.Bytes(), &login)
+			})
+
+			getCarts := func(token string) int {
+				req := httptest.NewRequest("GET", "/api/carts", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			refresh := func(refreshToken string) *httptest.ResponseRecorder {
+				jsonData, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+				req := httptest.NewRequest("POST", "/api/users/refresh", bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			It("should issue a signed access token with standard claims", func() {
+				claims, err := tokens.Parse(login.Token, AccessToken)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(claims.UserID).To(Equal(login.User.ID))
+				Expect(claims.Subject).To(Equal(fmt.Sprint(login.User.ID)))
+				Expect(claims.Issuer).To(Equal(TokenIssuer))
+				Expect(claims.ExpiresAt.Time).To(BeTemporally("~", claims.IssuedAt.Time.Add(AccessTokenTTL)))
+
+				Expect(getCarts(login.Token)).To(Equal(http.StatusOK))
+			})
+
+			It("should exchange a refresh token for a new access token", func() {
+				w := refresh(login.RefreshToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Token).NotTo(BeEmpty())
+				Expect(response.RefreshToken).NotTo(BeEmpty())
+				Expect(getCarts(response.Token)).To(Equal(http.StatusOK))
+			})
+
+			It("should not accept a refresh token as an access token", func() {
+				Expect(getCarts(login.RefreshToken)).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should not accept an access token as a refresh token", func() {
+				Expect(refresh(login.Token).Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should reject tampered tokens", func() {
+				Expect(getCarts(login.Token + "x")).To(Equal(http.StatusUnauthorized))
+				Expect(getCarts("not-a-token")).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should reject expired access tokens", func() {
+				tokens.now = func() time.Time { return time.Now().Add(AccessTokenTTL + time.Minute) }
+				Expect(getCarts(login.Token)).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should reject tokens signed with an unknown key", func() {
+				other, err := NewTokenService(map[string][]byte{"test": []byte("other-secret")}, "test")
+				Expect(err).NotTo(HaveOccurred())
+
+				claims, err := tokens.Parse(login.Token, AccessToken)
+				Expect(err).NotTo(HaveOccurred())
+
+				token, _, err := other.Issue(Session{ID: claims.SessionID, UserID: claims.UserID}, AccessToken)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(getCarts(token)).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should keep verifying tokens signed with a rotated-out key", func() {
+				tokens.keys["next"] = []byte("next-secret")
+				tokens.activeKID = "next"
+
+				Expect(getCarts(login.Token)).To(Equal(http.StatusOK))
+
+				w := refresh(login.RefreshToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				claims, err := tokens.Parse(response.Token, AccessToken)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(claims.UserID).To(Equal(login.User.ID))
+
+				delete(tokens.keys, "test")
+				Expect(getCarts(login.Token)).To(Equal(http.StatusUnauthorized))
+				Expect(getCarts(response.Token)).To(Equal(http.StatusOK))
+			})
+		})
+
+		Describe("Sessions", func() {
+			var laptop, phone LoginResponse
+
+			loginFrom := func(username string, device string) LoginResponse {
+				jsonData, _ := json.Marshal(LoginRequest{Username: username, Password: "password123", Device: device})
+				req := httptest.NewRequest("POST", "/api/users/login", bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("User-Agent", device+" browser")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				return response
+			}
+
+			request := func(method string, url string, token string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, url, nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			listSessions := func(token string) []Session {
+				w := request("GET", "/api/users/me/sessions", token)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var sessions []Session
+				json.Unmarshal(w.Body.Bytes(), &sessions)
+				return sessions
+			}
+
+			BeforeEach(func() {
+				for _, username := range []string{"testuser", "otheruser"} {
+					jsonData, _ := json.Marshal(CreateUserRequest{Username: username, Password: "password123"})
+					req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
+					req.Header.Set("Content-Type", "application/json")
+					router.ServeHTTP(httptest.NewRecorder(), req)
+				}
+
+				laptop = loginFrom("testuser", "laptop")
+				phone = loginFrom("testuser", "phone")
+			})
+
+			It("should keep earlier sessions signed in after a new login", func() {
+				Expect(request("GET", "/api/carts", laptop.Token).Code).To(Equal(http.StatusOK))
+				Expect(request("GET", "/api/carts", phone.Token).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should list the active sessions and mark the current one", func() {
+				sessions := listSessions(phone.Token)
+
+				// The first session is the one started by signing up
+				devices := map[string]bool{}
+				for _, session := range sessions {
+					if session.Device != "" {
+						Expect(session.UserAgent).To(Equal(session.Device + " browser"))
+					}
+					Expect(session.IPAddress).NotTo(BeEmpty())
+					Expect(session.ExpiresAt).To(BeTemporally(">", time.Now()))
+					devices[session.Device] = session.Current
+				}
+				Expect(devices).To(Equal(map[string]bool{"": false, "laptop": false, "phone": true}))
+			})
+
+			It("should log out only the current session", func() {
+				w := request("POST", "/api/users/logout", laptop.Token)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(request("GET", "/api/carts", laptop.Token).Code).To(Equal(http.StatusUnauthorized))
+				Expect(request("GET", "/api/carts", phone.Token).Code).To(Equal(http.StatusOK))
+
+				jsonData, _ := json.Marshal(RefreshRequest{RefreshToken: laptop.RefreshToken})
+				req := httptest.NewRequest("POST", "/api/users/refresh", bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should revoke another session by id", func() {
+				var laptopSession Session
+				for _, session := range listSessions(phone.Token) {
+					if session.Device == "laptop" {
+						laptopSession = session
+					}
+				}
+
+				w := request("DELETE", fmt.Sprintf("/api/users/me/sessions/%d", laptopSession.ID), phone.Token)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(request("GET", "/api/carts", laptop.Token).Code).To(Equal(http.StatusUnauthorized))
+				Expect(request("GET", "/api/carts", phone.Token).Code).To(Equal(http.StatusOK))
+				Expect(listSessions(phone.Token)).To(HaveLen(2))
+			})
+
+			It("should not revoke another user's session", func() {
+				other := loginFrom("otheruser", "tablet")
+				otherSessions := listSessions(other.Token)
+				Expect(otherSessions).NotTo(BeEmpty())
+
+				w := request("DELETE", fmt.Sprintf("/api/users/me/sessions/%d", otherSessions[0].ID), phone.Token)
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+				Expect(request("GET", "/api/carts", other.Token).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should check access tokens without loading their session", func() {
+				// As if another server process revoked every session: access
+				// tokens keep working until they expire, refreshing does not
+				Expect(db.Model(&Session{}).Update("revoked_at", time.Now()).Error).NotTo(HaveOccurred())
+				Expect(request("GET", "/api/carts", laptop.Token).Code).To(Equal(http.StatusOK))
+
+				jsonData, _ := json.Marshal(RefreshRequest{RefreshToken: laptop.RefreshToken})
+				req := httptest.NewRequest("POST", "/api/users/refresh", bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should keep sessions revoked across a restart", func() {
+				Expect(request("POST", "/api/users/logout", laptop.Token).Code).To(Equal(http.StatusOK))
+
+				restarted, err := NewTokenService(map[string][]byte{"test": []byte("test-secret")}, "test")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loadRevokedSessions(db, restarted)).To(Succeed())
+
+				restartedRouter := newTestRouter(db, restarted, payments)
+				for token, code := range map[string]int{laptop.Token: http.StatusUnauthorized, phone.Token: http.StatusOK} {
+					req := httptest.NewRequest("GET", "/api/carts", nil)
+					req.Header.Set("Authorization", "Bearer "+token)
+					w := httptest.NewRecorder()
+					restartedRouter.ServeHTTP(w, req)
+					Expect(w.Code).To(Equal(code))
+				}
+			})
+
+			It("should revoke all sessions", func() {
+				other := loginFrom("otheruser", "tablet")
+
+				w := request("DELETE", "/api/users/me/sessions", phone.Token)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(request("GET", "/api/carts", laptop.Token).Code).To(Equal(http.StatusUnauthorized))
+				Expect(request("GET", "/api/carts", phone.Token).Code).To(Equal(http.StatusUnauthorized))
+				Expect(request("GET", "/api/carts", other.Token).Code).To(Equal(http.StatusOK))
+			})
+		})
+
+		Describe("Roles", func() {
+			var customer User
+			var customerToken string
+
+			request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			setRole := func(userID uint, role string) *httptest.ResponseRecorder {
+				return request("PUT", fmt.Sprintf("/api/users/%d/role", userID), adminToken, fmt.Sprintf(`{"role": %q}`, role))
+			}
+
+			BeforeEach(func() {
+				w := request("POST", "/api/users", "", `{"username": "customer", "password": "password123"}`)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				customer, customerToken = response.User, response.Token
+			})
+
+			It("should make new users customers", func() {
+				Expect(customer.Role).To(Equal(RoleCustomer))
+			})
+
+			It("should keep catalog writes and user listing admin-only", func() {
+				newItem := `{"name": "Widget", "price": 1, "category": "Misc"}`
+
+				Expect(request("POST", "/api/items", "", newItem).Code).To(Equal(http.StatusUnauthorized))
+				Expect(request("POST", "/api/items", customerToken, newItem).Code).To(Equal(http.StatusForbidden))
+				Expect(request("POST", "/api/categories", customerToken, `{"name": "Misc"}`).Code).To(Equal(http.StatusForbidden))
+				Expect(request("GET", "/api/users", customerToken, "").Code).To(Equal(http.StatusForbidden))
+
+				Expect(request("POST", "/api/items", adminToken, newItem).Code).To(Equal(http.StatusCreated))
+			})
+
+			It("should list users to admins without passwords", func() {
+				w := request("GET", "/api/users", adminToken, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var users []User
+				json.Unmarshal(w.Body.Bytes(), &users)
+				Expect(users).To(HaveLen(2))
+				for _, user := range users {
+					Expect(user.Password).To(BeEmpty())
+					Expect(user.Token).To(BeEmpty())
+				}
+			})
+
+			It("should not let staff manage the catalog", func() {
+				Expect(setRole(customer.ID, RoleStaff).Code).To(Equal(http.StatusOK))
+				Expect(request("POST", "/api/items", customerToken, `{"name": "Widget", "price": 1, "category": "Misc"}`).Code).To(Equal(http.StatusForbidden))
+			})
+
+			It("should apply granted and revoked roles immediately", func() {
+				w := setRole(customer.ID, RoleAdmin)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var updated User
+				json.Unmarshal(w.Body.Bytes(), &updated)
+				Expect(updated.Role).To(Equal(RoleAdmin))
+				Expect(updated.Password).To(BeEmpty())
+
+				Expect(request("GET", "/api/users", customerToken, "").Code).To(Equal(http.StatusOK))
+
+				Expect(setRole(customer.ID, RoleCustomer).Code).To(Equal(http.StatusOK))
+				Expect(request("GET", "/api/users", customerToken, "").Code).To(Equal(http.StatusForbidden))
+			})
+
+			It("should not let customers change roles", func() {
+				w := request("PUT", fmt.Sprintf("/api/users/%d/role", customer.ID), customerToken, `{"role": "admin"}`)
+				Expect(w.Code).To(Equal(http.StatusForbidden))
+			})
+
+			It("should reject unknown roles and users", func() {
+				Expect(setRole(customer.ID, "owner").Code).To(Equal(http.StatusBadRequest))
+				Expect(setRole(9999, RoleStaff).Code).To(Equal(http.StatusNotFound))
+			})
+
+			It("should not demote the last admin", func() {
+				var admin User
+				db.Where("username = ?", "admin").First(&admin)
+
+				Expect(setRole(admin.ID, RoleCustomer).Code).To(Equal(http.StatusConflict))
+
+				Expect(setRole(customer.ID, RoleAdmin).Code).To(Equal(http.StatusOK))
+				Expect(setRole(admin.ID, RoleCustomer).Code).To(Equal(http.StatusOK))
+			})
+		})
 	})
 
 	Describe("Item Management", func() {
@@ -191,11 +575,12 @@ var _ = Describe("Ecommerce API", func() {
 			itemData := CreateItemRequest{
 				Name:        "Test Item",
 				Description: "A test item",
-				Price:       29.99,
+				Price:       NewMoney(2999, DefaultCurrency),
 			}
 
 			jsonData, _ := json.Marshal(itemData)
 			req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
 			req.Header.Set("Content-Type", "application/json")
 
 			w := httptest.NewRecorder()
@@ -206,19 +591,20 @@ var _ = Describe("Ecommerce API", func() {
 			var response Item
 			json.Unmarshal(w.Body.Bytes(), &response)
 			Expect(response.Name).To(Equal("Test Item"))
-			Expect(response.Price).To(Equal(29.99))
+			Expect(response.Price).To(Equal(NewMoney(2999, DefaultCurrency)))
 		})
 
 		It("should list all items", func() {
 			// Create some items first
 			items := []CreateItemRequest{
-				{Name: "Item 1", Description: "First item", Price: 10.0},
-				{Name: "Item 2", Description: "Second item", Price: 20.0},
+				{Name: "Item 1", Description: "First item", Price: NewMoney(1000, DefaultCurrency)},
+				{Name: "Item 2", Description: "Second item", Price: NewMoney(2000, DefaultCurrency)},
 			}
 
 			for _, item := range items {
 				jsonData, _ := json.Marshal(item)
 				req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
 				req.Header.Set("Content-Type", "application/json")
 
 				w := httptest.NewRecorder()
@@ -236,145 +622,3736 @@ var _ = Describe("Ecommerce API", func() {
 			json.Unmarshal(w.Body.Bytes(), &response)
 			Expect(len(response)).To(Equal(2))
 		})
-	})
 
-	Describe("Cart Management", func() {
-		var token string
+		Describe("Paging and filtering", func() {
+			BeforeEach(func() {
+				items := []CreateItemRequest{
+					{Name: "Delta", Price: NewMoney(4000, DefaultCurrency)},
+					{Name: "Alpha", Price: NewMoney(1000, DefaultCurrency)},
+					{Name: "Echo", Price: NewMoney(2000, DefaultCurrency)},
+					{Name: "Charlie", Price: NewMoney(2000, DefaultCurrency)},
+					{Name: "Bravo", Price: NewMoney(5000, DefaultCurrency)},
+				}
 
-		BeforeEach(func() {
-			// Create user and login
-			userData := CreateUserRequest{
-				Username: "testuser",
-				Password: "password123",
-			}
+				for _, item := range items {
+					jsonData, _ := json.Marshal(item)
+					req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+					req.Header.Set("Authorization", "Bearer "+adminToken)
+					req.Header.Set("Content-Type", "application/json")
 
-			jsonData, _ := json.Marshal(userData)
-			req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
-			req.Header.Set("Content-Type", "application/json")
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+				}
+			})
 
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+			// listNames follows the cursors from url and returns every page
+			listNames := func(url string) [][]string {
+				var pages [][]string
+				cursor := ""
+				for {
+					pageURL := url
+					if cursor != "" {
+						pageURL += "&cursor=" + cursor
+					}
 
-			var user User
-			json.Unmarshal(w.Body.Bytes(), &user)
-			token = user.Token
-		})
+					req := httptest.NewRequest("GET", pageURL, nil)
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+					Expect(w.Code).To(Equal(http.StatusOK))
 
-		It("should add item to cart", func() {
-			// Create an item first
-			itemData := CreateItemRequest{
-				Name:  "Test Item",
-				Price: 29.99,
+					var items []Item
+					json.Unmarshal(w.Body.Bytes(), &items)
+
+					var names []string
+					for _, item := range items {
+						names = append(names, item.Name)
+					}
+					pages = append(pages, names)
+
+					cursor = w.Header().Get("X-Next-Cursor")
+					if cursor == "" {
+						return pages
+					}
+				}
 			}
 
-			jsonData, _ := json.Marshal(itemData)
-			req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
-			req.Header.Set("Content-Type", "application/json")
+			It("should page through items sorted by price", func() {
+				pages := listNames("/api/items?limit=2&sort=price&order=desc")
+				Expect(pages).To(Equal([][]string{
+					{"Bravo", "Delta"},
+					{"Charlie", "Echo"},
+					{"Alpha"},
+				}))
+			})
 
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+			It("should page through items in creation order by default", func() {
+				pages := listNames("/api/items?limit=2")
+				Expect(pages).To(Equal([][]string{
+					{"Delta", "Alpha"},
+					{"Echo", "Charlie"},
+					{"Bravo"},
+				}))
+			})
 
-			var item Item
-			json.Unmarshal(w.Body.Bytes(), &item)
+			It("should page through items sorted by name", func() {
+				pages := listNames("/api/items?limit=3&sort=name")
+				Expect(pages).To(Equal([][]string{
+					{"Alpha", "Bravo", "Charlie"},
+					{"Delta", "Echo"},
+				}))
+			})
 
-			// Add item to cart
-			cartData := CreateCartRequest{
-				ItemID: item.ID,
-			}
+			It("should filter by price range and report the total count", func() {
+				req := httptest.NewRequest("GET", "/api/items?limit=1&min_price=15&max_price=40&sort=price", nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
 
-			cartJson, _ := json.Marshal(cartData)
-			cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
-			cartReq.Header.Set("Content-Type", "application/json")
-			cartReq.Header.Set("Authorization", "Bearer "+token)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(w.Header().Get("X-Total-Count")).To(Equal("3"))
+				Expect(w.Header().Get("X-Next-Cursor")).NotTo(BeEmpty())
 
-			w2 := httptest.NewRecorder()
-			router.ServeHTTP(w2, cartReq)
+				var items []Item
+				json.Unmarshal(w.Body.Bytes(), &items)
+				Expect(len(items)).To(Equal(1))
+				Expect(items[0].Name).To(Equal("Echo"))
+			})
 
-			Expect(w2.Code).To(Equal(http.StatusCreated))
+			It("should reject page sizes over the limit", func() {
+				req := httptest.NewRequest("GET", fmt.Sprintf("/api/items?limit=%d", MaxPageSize+1), nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
 
-			var cart Cart
-			json.Unmarshal(w2.Body.Bytes(), &cart)
-			Expect(len(cart.Items)).To(Equal(1))
-			Expect(cart.Items[0].ItemID).To(Equal(item.ID))
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
 		})
-	})
 
-	Describe("Order Management", func() {
-		var token string
-		var itemID uint
+		Describe("Search", func() {
+			var hoodie Item
 
-		BeforeEach(func() {
-			// Create user and login
-			userData := CreateUserRequest{
-				Username: "testuser",
-				Password: "password123",
-			}
+			BeforeEach(func() {
+				items := []CreateItemRequest{
+					{Name: "Adidas Hoodie", Description: "Warm and stylish hoodie", Price: NewMoney(5999, DefaultCurrency), Category: "Clothing"},
+					{Name: "Yoga Mat", Description: "Premium non-slip mat, pairs well with a hoodie", Price: NewMoney(3999, DefaultCurrency), Category: "Sports"},
+					{Name: "Bicycle", Description: "Mountain bike for adventure", Price: NewMoney(79999, DefaultCurrency), Category: "Sports"},
+				}
 
-			jsonData, _ := json.Marshal(userData)
-			req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
-			req.Header.Set("Content-Type", "application/json")
+				for i, item := range items {
+					jsonData, _ := json.Marshal(item)
+					req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+					req.Header.Set("Authorization", "Bearer "+adminToken)
+					req.Header.Set("Content-Type", "application/json")
 
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+					if i == 0 {
+						json.Unmarshal(w.Body.Bytes(), &hoodie)
+					}
+				}
+			})
 
-			var user User
-			json.Unmarshal(w.Body.Bytes(), &user)
-			token = user.Token
+			search := func(query string) []ItemSearchResult {
+				req := httptest.NewRequest("GET", "/api/items/search?q="+query, nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
 
-			// Create an item
-			itemData := CreateItemRequest{
-				Name:  "Test Item",
-				Price: 29.99,
+				var results []ItemSearchResult
+				json.Unmarshal(w.Body.Bytes(), &results)
+				return results
 			}
 
-			jsonData, _ = json.Marshal(itemData)
-			req = httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
-			req.Header.Set("Content-Type", "application/json")
+			It("should rank name matches first and highlight them", func() {
+				results := search("hoodie")
+				Expect(len(results)).To(Equal(2))
+				Expect(results[0].Item.Name).To(Equal("Adidas Hoodie"))
+				Expect(results[0].Highlight).To(Equal("Adidas <mark>Hoodie</mark>"))
+				Expect(results[1].Item.Name).To(Equal("Yoga Mat"))
+				Expect(results[1].Snippet).To(ContainSubstring("<mark>hoodie</mark>"))
+			})
 
-			w = httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+			It("should match categories and word prefixes", func() {
+				results := search("sports+bik")
+				Expect(len(results)).To(Equal(1))
+				Expect(results[0].Item.Name).To(Equal("Bicycle"))
+			})
 
-			var item Item
-			json.Unmarshal(w.Body.Bytes(), &item)
-			itemID = item.ID
+			It("should keep the index in step with item changes", func() {
+				req := httptest.NewRequest("PATCH", fmt.Sprintf("/api/items/%d", hoodie.ID), bytes.NewBufferString(`{"name": "Adidas Sweatshirt", "description": "Warm and stylish"}`))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(search("sweatshirt")).To(HaveLen(1))
+				Expect(search("adidas")).To(HaveLen(1))
+
+				req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/items/%d", hoodie.ID), nil)
+
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(search("adidas")).To(BeEmpty())
+			})
+
+			It("should require a query", func() {
+				req := httptest.NewRequest("GET", "/api/items/search?q=", nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
 		})
 
-		It("should create order from cart", func() {
-			// Add item to cart
-			cartData := CreateCartRequest{
-				ItemID: itemID,
-			}
+		Describe("Single items", func() {
+			var item Item
 
-			cartJson, _ := json.Marshal(cartData)
-			cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
-			cartReq.Header.Set("Content-Type", "application/json")
-			cartReq.Header.Set("Authorization", "Bearer "+token)
+			BeforeEach(func() {
+				itemData := CreateItemRequest{
+					Name:        "Test Item",
+					Description: "A test item",
+					Price:       NewMoney(2999, DefaultCurrency),
+				}
 
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, cartReq)
+				jsonData, _ := json.Marshal(itemData)
+				req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				req.Header.Set("Content-Type", "application/json")
 
-			var cart Cart
-			json.Unmarshal(w.Body.Bytes(), &cart)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				json.Unmarshal(w.Body.Bytes(), &item)
+			})
 
-			// Create order
-			orderData := CreateOrderRequest{
-				CartID: cart.ID,
-			}
+			It("should get an item by ID", func() {
+				req := httptest.NewRequest("GET", fmt.Sprintf("/api/items/%d", item.ID), nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
 
-			orderJson, _ := json.Marshal(orderData)
-			orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
-			orderReq.Header.Set("Content-Type", "application/json")
-			orderReq.Header.Set("Authorization", "Bearer "+token)
+				Expect(w.Code).To(Equal(http.StatusOK))
 
-			w2 := httptest.NewRecorder()
-			router.ServeHTTP(w2, orderReq)
+				var response Item
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Name).To(Equal("Test Item"))
+			})
 
-			Expect(w2.Code).To(Equal(http.StatusCreated))
+			It("should update only the fields that are sent", func() {
+				req := httptest.NewRequest("PATCH", fmt.Sprintf("/api/items/%d", item.ID), bytes.NewBufferString(`{"price": 24.99}`))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				req.Header.Set("Content-Type", "application/json")
 
-			var order Order
-			json.Unmarshal(w2.Body.Bytes(), &order)
-			Expect(order.Total).To(Equal(29.99))
-			Expect(len(order.Items)).To(Equal(1))
-		})
-	})
-}) 
\ No newline at end of file
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var response Item
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Price).To(Equal(NewMoney(2499, DefaultCurrency)))
+				Expect(response.Name).To(Equal("Test Item"))
+				Expect(response.Description).To(Equal("A test item"))
+			})
+
+			It("should archive a deleted item", func() {
+				req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/items/%d", item.ID), nil)
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				// Gone from the default listing and lookup
+				req = httptest.NewRequest("GET", "/api/items", nil)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				var items []Item
+				json.Unmarshal(w.Body.Bytes(), &items)
+				Expect(items).To(BeEmpty())
+
+				req = httptest.NewRequest("GET", fmt.Sprintf("/api/items/%d", item.ID), nil)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+
+				// Still listed when archived items are asked for
+				req = httptest.NewRequest("GET", "/api/items?include_archived=true", nil)
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				json.Unmarshal(w.Body.Bytes(), &items)
+				Expect(len(items)).To(Equal(1))
+				Expect(items[0].DeletedAt).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe("Category Management", func() {
+		It("should file new items under the named category", func() {
+			itemData := CreateItemRequest{
+				Name:     "Laptop",
+				Price:    NewMoney(99999, DefaultCurrency),
+				Category: "Electronics",
+			}
+
+			jsonData, _ := json.Marshal(itemData)
+			req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var item Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+			Expect(item.Category).To(Equal("Electronics"))
+			Expect(item.CategoryID).NotTo(BeNil())
+
+			var category Category
+			db.First(&category, *item.CategoryID)
+			Expect(category.Slug).To(Equal("electronics"))
+		})
+
+		It("should count and filter items through nested categories", func() {
+			// Create a parent and a child category
+			jsonData, _ := json.Marshal(CreateCategoryRequest{Name: "Clothing"})
+			req := httptest.NewRequest("POST", "/api/categories", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var parent Category
+			json.Unmarshal(w.Body.Bytes(), &parent)
+
+			jsonData, _ = json.Marshal(CreateCategoryRequest{Name: "Shoes", ParentID: &parent.ID})
+			req = httptest.NewRequest("POST", "/api/categories", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var child Category
+			json.Unmarshal(w.Body.Bytes(), &child)
+			Expect(child.Slug).To(Equal("shoes"))
+
+			// One item in each
+			items := []CreateItemRequest{
+				{Name: "Hoodie", Price: NewMoney(5999, DefaultCurrency), CategoryID: &parent.ID},
+				{Name: "Sneakers", Price: NewMoney(12999, DefaultCurrency), CategoryID: &child.ID},
+			}
+			for _, item := range items {
+				jsonData, _ := json.Marshal(item)
+				req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				req.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+			}
+
+			// Counts include subcategories
+			req = httptest.NewRequest("GET", "/api/categories", nil)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var categories []Category
+			json.Unmarshal(w.Body.Bytes(), &categories)
+			counts := map[string]int{}
+			for _, category := range categories {
+				counts[category.Slug] = category.ItemCount
+			}
+			Expect(counts).To(Equal(map[string]int{"clothing": 2, "shoes": 1}))
+
+			// Filtering by the parent includes the child's items
+			req = httptest.NewRequest("GET", "/api/items?category=clothing", nil)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var listed []Item
+			json.Unmarshal(w.Body.Bytes(), &listed)
+			Expect(len(listed)).To(Equal(2))
+
+			req = httptest.NewRequest("GET", "/api/items?category=shoes", nil)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			json.Unmarshal(w.Body.Bytes(), &listed)
+			Expect(len(listed)).To(Equal(1))
+			Expect(listed[0].Name).To(Equal("Sneakers"))
+		})
+	})
+
+	Describe("Cart Management", func() {
+		var token string
+
+		BeforeEach(func() {
+			// Create user and login
+			userData := CreateUserRequest{
+				Username: "testuser",
+				Password: "password123",
+			}
+
+			jsonData, _ := json.Marshal(userData)
+			req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var response LoginResponse
+			json.Unmarshal(w.Body.Bytes(), &response)
+			token = response.Token
+		})
+
+		It("should add item to cart", func() {
+			// Create an item first
+			itemData := CreateItemRequest{
+				Name:  "Test Item",
+				Price: NewMoney(2999, DefaultCurrency),
+				Stock: 100,
+			}
+
+			jsonData, _ := json.Marshal(itemData)
+			req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var item Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+
+			// Add item to cart
+			cartData := CreateCartRequest{
+				ItemID: item.ID,
+			}
+
+			cartJson, _ := json.Marshal(cartData)
+			cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+			cartReq.Header.Set("Content-Type", "application/json")
+			cartReq.Header.Set("Authorization", "Bearer "+token)
+
+			w2 := httptest.NewRecorder()
+			router.ServeHTTP(w2, cartReq)
+
+			Expect(w2.Code).To(Equal(http.StatusCreated))
+
+			var cart Cart
+			json.Unmarshal(w2.Body.Bytes(), &cart)
+			Expect(len(cart.Items)).To(Equal(1))
+			Expect(cart.Items[0].ItemID).To(Equal(item.ID))
+		})
+
+		Describe("Updating quantities", func() {
+			var item Item
+
+			BeforeEach(func() {
+				// Create an item limited to five per cart and add it once
+				itemData := CreateItemRequest{
+					Name:        "Limited Item",
+					Price:       NewMoney(1000, DefaultCurrency),
+					MaxQuantity: 5,
+					Stock:       100,
+				}
+
+				jsonData, _ := json.Marshal(itemData)
+				req := httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+				req.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				json.Unmarshal(w.Body.Bytes(), &item)
+
+				cartJson, _ := json.Marshal(CreateCartRequest{ItemID: item.ID})
+				cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+				cartReq.Header.Set("Content-Type", "application/json")
+				cartReq.Header.Set("Authorization", "Bearer "+token)
+
+				w2 := httptest.NewRecorder()
+				router.ServeHTTP(w2, cartReq)
+				Expect(w2.Code).To(Equal(http.StatusCreated))
+			})
+
+			updateQuantity := func(quantity uint) *httptest.ResponseRecorder {
+				jsonData, _ := json.Marshal(UpdateCartItemRequest{Quantity: &quantity})
+				req := httptest.NewRequest("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), bytes.NewBuffer(jsonData))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			It("should set an exact quantity and return the recalculated cart", func() {
+				w := updateQuantity(3)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				Expect(len(cart.Items)).To(Equal(1))
+				Expect(cart.Items[0].Quantity).To(Equal(uint(3)))
+				Expect(cart.Items[0].Subtotal).To(Equal(NewMoney(3000, DefaultCurrency)))
+				Expect(cart.Total).To(Equal(NewMoney(3000, DefaultCurrency)))
+			})
+
+			It("should reject quantities above the item's maximum", func() {
+				w := updateQuantity(6)
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+				var response map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response["max_quantity"]).To(BeNumerically("==", 5))
+			})
+
+			It("should remove the line when the quantity is zero", func() {
+				w := updateQuantity(0)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				Expect(cart.Items).To(BeEmpty())
+				Expect(cart.Total.Amount).To(BeZero())
+			})
+		})
+
+		Describe("Price changes", func() {
+			var item Item
+
+			request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			getCart := func() Cart {
+				w := request("GET", "/api/carts", token, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts).To(HaveLen(1))
+				return carts[0]
+			}
+
+			checkout := func(cart Cart, version string) *httptest.ResponseRecorder {
+				return request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "cart_version": %q}`, cart.ID, version))
+			}
+
+			BeforeEach(func() {
+				item = Item{Name: "Repriced", Price: NewMoney(1000, DefaultCurrency), Stock: 10}
+				Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+				Expect(request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID)).Code).To(Equal(http.StatusCreated))
+				Expect(request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), token, `{"quantity": 2}`).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should record the price each line was added at", func() {
+				cart := getCart()
+				Expect(cart.Items[0].Price).To(Equal(NewMoney(1000, DefaultCurrency)))
+				Expect(cart.Items[0].PriceChanged).To(BeFalse())
+				Expect(cart.PricesChanged).To(BeFalse())
+				Expect(cart.Version).NotTo(BeEmpty())
+
+				// Without price changes the version is not needed
+				Expect(checkout(cart, "").Code).To(Equal(http.StatusCreated))
+			})
+
+			It("should flag lines whose price changed", func() {
+				before := getCart()
+				Expect(request("PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"price": "12.50"}`).Code).To(Equal(http.StatusOK))
+
+				cart := getCart()
+				Expect(cart.PricesChanged).To(BeTrue())
+				Expect(cart.Items[0].PriceChanged).To(BeTrue())
+				Expect(cart.Items[0].Price).To(Equal(NewMoney(1000, DefaultCurrency)))
+				Expect(cart.Total).To(Equal(NewMoney(2500, DefaultCurrency)))
+				Expect(cart.Version).NotTo(Equal(before.Version))
+			})
+
+			It("should refuse checkout until the new prices are acknowledged", func() {
+				Expect(request("PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"price": "12.50"}`).Code).To(Equal(http.StatusOK))
+				cart := getCart()
+
+				for _, version := range []string{"", "stale"} {
+					w := checkout(cart, version)
+					Expect(w.Code).To(Equal(http.StatusConflict))
+
+					var response CheckoutError
+					json.Unmarshal(w.Body.Bytes(), &response)
+					Expect(response.Step).To(Equal("check_prices"))
+					Expect(response.CartVersion).To(Equal(cart.Version))
+					Expect(response.PriceChanges).To(Equal([]PriceChange{
+						{ItemID: item.ID, Price: NewMoney(1000, DefaultCurrency), CurrentPrice: NewMoney(1250, DefaultCurrency)},
+					}))
+				}
+
+				w := checkout(cart, cart.Version)
+				Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				Expect(order.Total).To(Equal(NewMoney(2500, DefaultCurrency)))
+			})
+
+			It("should detect another price change once the first is acknowledged", func() {
+				Expect(request("PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"price": "12.50"}`).Code).To(Equal(http.StatusOK))
+				first := getCart()
+
+				Expect(request("POST", "/api/carts/acknowledge-prices", token, `{"cart_version": "stale"}`).Code).To(Equal(http.StatusConflict))
+				w := request("POST", "/api/carts/acknowledge-prices", token, fmt.Sprintf(`{"cart_version": %q}`, first.Version))
+				Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+
+				acknowledged := getCart()
+				Expect(acknowledged.PricesChanged).To(BeFalse())
+				Expect(acknowledged.Items[0].Price).To(Equal(NewMoney(1250, DefaultCurrency)))
+
+				Expect(request("PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"price": "15.00"}`).Code).To(Equal(http.StatusOK))
+				cart := getCart()
+				Expect(cart.PricesChanged).To(BeTrue())
+
+				for _, version := range []string{"", acknowledged.Version} {
+					w := checkout(cart, version)
+					Expect(w.Code).To(Equal(http.StatusConflict))
+
+					var response CheckoutError
+					json.Unmarshal(w.Body.Bytes(), &response)
+					Expect(response.PriceChanges).To(Equal([]PriceChange{
+						{ItemID: item.ID, Price: NewMoney(1250, DefaultCurrency), CurrentPrice: NewMoney(1500, DefaultCurrency)},
+					}))
+				}
+				Expect(checkout(cart, cart.Version).Code).To(Equal(http.StatusCreated))
+			})
+
+			It("should refuse a version of a cart that changed since", func() {
+				cart := getCart()
+				Expect(request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), token, `{"quantity": 3}`).Code).To(Equal(http.StatusOK))
+
+				w := checkout(cart, cart.Version)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				Expect(checkout(cart, getCart().Version).Code).To(Equal(http.StatusCreated))
+			})
+		})
+
+		Describe("Guest carts", func() {
+			var limited, scarce Item
+
+			// guestRequest sends a request as the guest holding cartToken, or
+			// as a new guest when it is empty
+			guestRequest := func(method string, url string, cartToken string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				if cartToken != "" {
+					req.Header.Set(CartTokenHeader, cartToken)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			// addToCart adds quantity units of item for the guest and returns
+			// the guest's cart token
+			addToCart := func(cartToken string, item Item, quantity uint) string {
+				for i := uint(0); i < quantity; i++ {
+					w := guestRequest("POST", "/api/carts", cartToken, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+					Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+					if cartToken == "" {
+						cartToken = w.Header().Get(CartTokenHeader)
+					}
+				}
+				return cartToken
+			}
+
+			userCart := func() Cart {
+				req := httptest.NewRequest("GET", "/api/carts", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts).To(HaveLen(1))
+				return carts[0]
+			}
+
+			login := func(cartToken string) (*httptest.ResponseRecorder, LoginResponse) {
+				w := guestRequest("POST", "/api/users/login", cartToken, `{"username": "testuser", "password": "password123"}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				return w, response
+			}
+
+			quantities := func(cart Cart) map[uint]uint {
+				lines := map[uint]uint{}
+				for _, line := range cart.Items {
+					lines[line.ItemID] = line.Quantity
+				}
+				return lines
+			}
+
+			BeforeEach(func() {
+				limited = Item{Name: "Limited", Price: NewMoney(1000, DefaultCurrency), MaxQuantity: 5, Stock: 100}
+				Expect(db.Create(&limited).Error).NotTo(HaveOccurred())
+				scarce = Item{Name: "Scarce", Price: NewMoney(500, DefaultCurrency), Stock: 4}
+				Expect(db.Create(&scarce).Error).NotTo(HaveOccurred())
+			})
+
+			It("should quote shipping for a guest cart to a country", func() {
+				cartToken := addToCart("", limited, 1)
+				Expect(guestRequest("GET", "/api/carts/shipping-options", cartToken, "").Code).To(Equal(http.StatusBadRequest))
+
+				var options []ShippingOption
+				w := guestRequest("GET", "/api/carts/shipping-options?country=us&region=ny", cartToken, "")
+				Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+				json.Unmarshal(w.Body.Bytes(), &options)
+				Expect(options).To(HaveLen(3))
+
+				w = guestRequest("GET", "/api/carts/shipping-options?country=DE", cartToken, "")
+				json.Unmarshal(w.Body.Bytes(), &options)
+				Expect(options).To(HaveLen(1))
+				Expect(options[0].Method).To(Equal("international"))
+			})
+
+			It("should keep a cart for a guest under a signed token", func() {
+				w := guestRequest("POST", "/api/carts", "", fmt.Sprintf(`{"item_id": %d}`, limited.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				cartToken := w.Header().Get(CartTokenHeader)
+				Expect(cartToken).NotTo(BeEmpty())
+				Expect(w.Header().Get("Set-Cookie")).To(ContainSubstring(CartTokenCookie + "=" + cartToken))
+
+				var carts []Cart
+				w = guestRequest("GET", "/api/carts", cartToken, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts).To(HaveLen(1))
+				Expect(carts[0].Items[0].ItemID).To(Equal(limited.ID))
+
+				// The cookie works as well as the header
+				req := httptest.NewRequest("GET", "/api/carts", nil)
+				req.AddCookie(&http.Cookie{Name: CartTokenCookie, Value: cartToken})
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts).To(HaveLen(1))
+
+				// Another guest, or a forged token, gets a cart of its own
+				for _, other := range []string{"", cartToken + "x"} {
+					w = guestRequest("GET", "/api/carts", other, "")
+					Expect(w.Code).To(Equal(http.StatusOK))
+					Expect(w.Header().Get(CartTokenHeader)).NotTo(BeEmpty())
+					json.Unmarshal(w.Body.Bytes(), &carts)
+					Expect(carts).To(BeEmpty())
+				}
+
+				// A guest cart token is not an access token
+				_, err := tokens.Parse(cartToken, AccessToken)
+				Expect(err).To(MatchError(ErrInvalidToken))
+			})
+
+			It("should leave checkout to signed-in users", func() {
+				cartToken := addToCart("", limited, 1)
+				w := guestRequest("POST", "/api/orders", cartToken, `{"cart_id": 1, "payment_source": "tok_visa"}`)
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should merge the guest cart into the user's cart on login", func() {
+				// The user already has two of the limited item
+				userToken := addToCart("", limited, 2)
+				_, response := login(userToken)
+				Expect(response.CartAdjustments).To(BeEmpty())
+				token = response.Token
+
+				cartToken := addToCart("", limited, 4)
+				addToCart(cartToken, scarce, 1)
+
+				w, response := login(cartToken)
+				Expect(response.CartAdjustments).To(Equal([]CartAdjustment{
+					{ItemID: limited.ID, Requested: 6, Quantity: 5, Reason: MergeMaxQuantity},
+				}))
+				Expect(w.Header().Get("Set-Cookie")).To(ContainSubstring(CartTokenCookie + "=;"))
+				token = response.Token
+
+				Expect(quantities(userCart())).To(Equal(map[uint]uint{limited.ID: 5, scarce.ID: 1}))
+
+				// The guest cart is gone
+				var carts []Cart
+				json.Unmarshal(guestRequest("GET", "/api/carts", cartToken, "").Body.Bytes(), &carts)
+				Expect(carts).To(BeEmpty())
+				var guestCarts int
+				db.Model(&Cart{}).Where("user_id = 0").Count(&guestCarts)
+				Expect(guestCarts).To(BeZero())
+			})
+
+			It("should only merge the stock that is left", func() {
+				_, response := login(addToCart("", scarce, 1))
+				token = response.Token
+
+				// Another shopper holds one unit and the guest two, then the
+				// stock drops to three
+				addToCart("", scarce, 1)
+				cartToken := addToCart("", scarce, 2)
+				Expect(db.Model(&Item{}).Where("id = ?", scarce.ID).Update("stock", 3).Error).NotTo(HaveOccurred())
+
+				_, response = login(cartToken)
+				Expect(response.CartAdjustments).To(Equal([]CartAdjustment{
+					{ItemID: scarce.ID, Requested: 3, Quantity: 2, Reason: MergeStock},
+				}))
+				Expect(quantities(userCart())).To(Equal(map[uint]uint{scarce.ID: 2}))
+			})
+
+			It("should hand the guest cart to a new user", func() {
+				cartToken := addToCart("", limited, 2)
+				var guest Cart
+				Expect(db.Where("guest_id <> ''").First(&guest).Error).NotTo(HaveOccurred())
+
+				w := guestRequest("POST", "/api/users", cartToken, `{"username": "newcomer", "password": "password123"}`)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				var cart Cart
+				Expect(db.First(&cart, guest.ID).Error).NotTo(HaveOccurred())
+				Expect(cart.UserID).To(Equal(response.User.ID))
+				Expect(cart.GuestID).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Order Management", func() {
+		var token string
+		var itemID uint
+
+		BeforeEach(func() {
+			// Create user and login
+			userData := CreateUserRequest{
+				Username: "testuser",
+				Password: "password123",
+			}
+
+			jsonData, _ := json.Marshal(userData)
+			req := httptest.NewRequest("POST", "/api/users", bytes.NewBuffer(jsonData))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var response LoginResponse
+			json.Unmarshal(w.Body.Bytes(), &response)
+			token = response.Token
+
+			// Create an item
+			itemData := CreateItemRequest{
+				Name:  "Test Item",
+				Price: NewMoney(2999, DefaultCurrency),
+				Stock: 100,
+			}
+
+			jsonData, _ = json.Marshal(itemData)
+			req = httptest.NewRequest("POST", "/api/items", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var item Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+			itemID = item.ID
+		})
+
+		It("should create order from cart", func() {
+			// Add item to cart
+			cartData := CreateCartRequest{
+				ItemID: itemID,
+			}
+
+			cartJson, _ := json.Marshal(cartData)
+			cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+			cartReq.Header.Set("Content-Type", "application/json")
+			cartReq.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, cartReq)
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			// Create order
+			orderData := CreateOrderRequest{
+				CartID:        cart.ID,
+				PaymentSource: "tok_visa",
+			}
+
+			orderJson, _ := json.Marshal(orderData)
+			orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
+			orderReq.Header.Set("Content-Type", "application/json")
+			orderReq.Header.Set("Authorization", "Bearer "+token)
+
+			w2 := httptest.NewRecorder()
+			router.ServeHTTP(w2, orderReq)
+
+			Expect(w2.Code).To(Equal(http.StatusCreated))
+
+			var order Order
+			json.Unmarshal(w2.Body.Bytes(), &order)
+			Expect(order.Total).To(Equal(NewMoney(2999, DefaultCurrency)))
+			Expect(len(order.Items)).To(Equal(1))
+		})
+
+		It("should keep archived items on past orders", func() {
+			cartJson, _ := json.Marshal(CreateCartRequest{ItemID: itemID})
+			cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+			cartReq.Header.Set("Content-Type", "application/json")
+			cartReq.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, cartReq)
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			orderJson, _ := json.Marshal(CreateOrderRequest{CartID: cart.ID, PaymentSource: "tok_visa"})
+			orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
+			orderReq.Header.Set("Content-Type", "application/json")
+			orderReq.Header.Set("Authorization", "Bearer "+token)
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, orderReq)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			// Archive the item and list orders again
+			deleteReq := httptest.NewRequest("DELETE", fmt.Sprintf("/api/items/%d", itemID), nil)
+			deleteReq.Header.Set("Authorization", "Bearer "+adminToken)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, deleteReq)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			listReq := httptest.NewRequest("GET", "/api/orders", nil)
+			listReq.Header.Set("Authorization", "Bearer "+token)
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, listReq)
+
+			var orders []Order
+			json.Unmarshal(w.Body.Bytes(), &orders)
+			Expect(len(orders)).To(Equal(1))
+			Expect(orders[0].Items[0].Item.Name).To(Equal("Test Item"))
+		})
+
+		It("should charge for every unit of a cart line", func() {
+			// Add the same item to cart three times
+			cartData := CreateCartRequest{
+				ItemID: itemID,
+			}
+
+			cartJson, _ := json.Marshal(cartData)
+
+			var cart Cart
+			for i := 0; i < 3; i++ {
+				cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+				cartReq.Header.Set("Content-Type", "application/json")
+				cartReq.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, cartReq)
+				json.Unmarshal(w.Body.Bytes(), &cart)
+			}
+
+			Expect(cart.Items[0].Quantity).To(Equal(uint(3)))
+
+			// Create order
+			orderData := CreateOrderRequest{
+				CartID:        cart.ID,
+				PaymentSource: "tok_visa",
+			}
+
+			orderJson, _ := json.Marshal(orderData)
+			orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
+			orderReq.Header.Set("Content-Type", "application/json")
+			orderReq.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, orderReq)
+
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var order Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(len(order.Items)).To(Equal(1))
+			Expect(order.Items[0].Quantity).To(Equal(uint(3)))
+			Expect(order.Items[0].Price).To(Equal(NewMoney(2999, DefaultCurrency)))
+			Expect(order.Items[0].Subtotal).To(Equal(NewMoney(8997, DefaultCurrency)))
+			Expect(order.Total).To(Equal(NewMoney(8997, DefaultCurrency)))
+		})
+
+		Describe("Checkout transaction", func() {
+			var cartID uint
+
+			BeforeEach(func() {
+				cartData := CreateCartRequest{
+					ItemID: itemID,
+				}
+
+				cartJson, _ := json.Marshal(cartData)
+				cartReq := httptest.NewRequest("POST", "/api/carts", bytes.NewBuffer(cartJson))
+				cartReq.Header.Set("Content-Type", "application/json")
+				cartReq.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, cartReq)
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				cartID = cart.ID
+			})
+
+			// injectFailure makes every create or delete against table fail
+			injectFailure := func(operation string, table string) {
+				fail := func(scope *gorm.Scope) {
+					if scope.TableName() == table {
+						scope.Err(errors.New("injected failure"))
+					}
+				}
+
+				switch operation {
+				case "create":
+					db.Callback().Create().Before("gorm:create").Register("test:fail_create", fail)
+				case "delete":
+					db.Callback().Delete().Before("gorm:delete").Register("test:fail_delete", fail)
+				}
+			}
+
+			DescribeTable("should roll back when a step fails",
+				func(operation string, table string, step string) {
+					injectFailure(operation, table)
+
+					orderData := CreateOrderRequest{
+						CartID:        cartID,
+						PaymentSource: "tok_visa",
+						TaxRegion:     "US-CA",
+					}
+
+					orderJson, _ := json.Marshal(orderData)
+					orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
+					orderReq.Header.Set("Content-Type", "application/json")
+					orderReq.Header.Set("Authorization", "Bearer "+token)
+
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, orderReq)
+
+					Expect(w.Code).To(Equal(http.StatusInternalServerError))
+
+					var response CheckoutError
+					json.Unmarshal(w.Body.Bytes(), &response)
+					Expect(response.Step).To(Equal(step))
+					Expect(response.Message).NotTo(BeEmpty())
+
+					// Nothing from the failed checkout may remain
+					var orderCount, orderItemCount, cartCount, cartItemCount int
+					db.Model(&Order{}).Count(&orderCount)
+					db.Model(&OrderItem{}).Count(&orderItemCount)
+					db.Model(&Cart{}).Count(&cartCount)
+					db.Model(&CartItem{}).Where("cart_id = ?", cartID).Count(&cartItemCount)
+					Expect(orderCount).To(Equal(0))
+					Expect(orderItemCount).To(Equal(0))
+					Expect(cartCount).To(Equal(1))
+					Expect(cartItemCount).To(Equal(1))
+				},
+				Entry("creating the order", "create", "orders", "create_order"),
+				Entry("creating the order items", "create", "order_items", "create_order_items"),
+				Entry("saving the taxes", "create", "order_taxes", "create_taxes"),
+				Entry("recording the order status", "create", "order_status_events", "record_status"),
+				Entry("creating the payment", "create", "payments", "create_payment"),
+				Entry("clearing the cart items", "delete", "cart_items", "clear_cart"),
+				Entry("deleting the cart", "delete", "carts", "delete_cart"),
+			)
+
+			It("should return a structured error for a missing cart", func() {
+				orderData := CreateOrderRequest{
+					CartID:        cartID + 100,
+					PaymentSource: "tok_visa",
+				}
+
+				orderJson, _ := json.Marshal(orderData)
+				orderReq := httptest.NewRequest("POST", "/api/orders", bytes.NewBuffer(orderJson))
+				orderReq.Header.Set("Content-Type", "application/json")
+				orderReq.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, orderReq)
+
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Step).To(Equal("load_cart"))
+				Expect(response.Message).To(Equal("Cart not found"))
+			})
+		})
+	})
+
+	Describe("Order status", func() {
+		var customerToken, staffToken string
+		var order Order
+		var item Item
+
+		signIn := func(username string, role string) string {
+			user := User{Username: username, Password: "unused", Role: role}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		setStatus := func(token string, status string) *httptest.ResponseRecorder {
+			return request("PATCH", fmt.Sprintf("/api/orders/%d/status", order.ID), token, fmt.Sprintf(`{"status": %q, "note": "moved to %s"}`, status, status))
+		}
+
+		BeforeEach(func() {
+			customerToken = signIn("customer", RoleCustomer)
+			staffToken = signIn("staff", RoleStaff)
+
+			item = Item{Name: "Kettle", Price: NewMoney(3500, DefaultCurrency), Category: "Home", Stock: 3}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+
+			w := request("POST", "/api/carts", customerToken, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			// The challenge leaves the order pending until the customer
+			// authenticates, so every status is still ahead of it
+			w = request("POST", "/api/orders", customerToken, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_challenge"}`, cart.ID))
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+			order = Order{}
+			json.Unmarshal(w.Body.Bytes(), &order)
+		})
+
+		It("should place orders as pending with a first history entry", func() {
+			Expect(order.Status).To(Equal(OrderPending))
+
+			w := request("GET", fmt.Sprintf("/api/orders/%d", order.ID), customerToken, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var fetched Order
+			json.Unmarshal(w.Body.Bytes(), &fetched)
+			Expect(fetched.Items).To(HaveLen(1))
+			Expect(fetched.StatusHistory).To(HaveLen(1))
+			Expect(fetched.StatusHistory[0].FromStatus).To(BeEmpty())
+			Expect(fetched.StatusHistory[0].ToStatus).To(Equal(OrderPending))
+			Expect(fetched.StatusHistory[0].ActorID).To(Equal(fetched.UserID))
+		})
+
+		It("should only show an order to its owner", func() {
+			otherToken := signIn("other", RoleCustomer)
+			Expect(request("GET", fmt.Sprintf("/api/orders/%d", order.ID), otherToken, "").Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should walk an order through its lifecycle and record every step", func() {
+			for _, status := range []string{OrderPaid, OrderFulfilled, OrderShipped, OrderDelivered, OrderRefunded} {
+				w := setStatus(staffToken, status)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var updated Order
+				json.Unmarshal(w.Body.Bytes(), &updated)
+				Expect(updated.Status).To(Equal(status))
+			}
+
+			w := request("GET", fmt.Sprintf("/api/orders/%d", order.ID), customerToken, "")
+			var fetched Order
+			json.Unmarshal(w.Body.Bytes(), &fetched)
+
+			var steps []string
+			for _, event := range fetched.StatusHistory {
+				steps = append(steps, event.FromStatus+">"+event.ToStatus)
+			}
+			Expect(steps).To(Equal([]string{">pending", "pending>paid", "paid>fulfilled", "fulfilled>shipped", "shipped>delivered", "delivered>refunded"}))
+			Expect(fetched.StatusHistory[1].Note).To(Equal("moved to paid"))
+		})
+
+		DescribeTable("should refuse illegal transitions",
+			func(path []string, to string) {
+				for _, status := range path {
+					Expect(setStatus(staffToken, status).Code).To(Equal(http.StatusOK))
+				}
+
+				w := setStatus(staffToken, to)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				var response struct {
+					Status  string   `json:"status"`
+					Allowed []string `json:"allowed"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Allowed).To(Equal(orderTransitions[response.Status]))
+
+				var history int
+				db.Model(&OrderStatusEvent{}).Where("order_id = ?", order.ID).Count(&history)
+				Expect(history).To(Equal(len(path) + 1))
+			},
+			Entry("shipping an unpaid order", []string{}, OrderShipped),
+			Entry("refunding an unpaid order", []string{}, OrderRefunded),
+			Entry("paying twice", []string{OrderPaid}, OrderPaid),
+			Entry("cancelling a shipped order", []string{OrderPaid, OrderFulfilled, OrderShipped}, OrderCancelled),
+			Entry("reopening a cancelled order", []string{OrderCancelled}, OrderPending),
+			Entry("leaving a refunded order", []string{OrderPaid, OrderRefunded}, OrderFulfilled),
+		)
+
+		It("should reject unknown statuses", func() {
+			Expect(setStatus(staffToken, "lost").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should only let staff and admins change the status", func() {
+			Expect(setStatus(customerToken, OrderPaid).Code).To(Equal(http.StatusForbidden))
+			Expect(setStatus(adminToken, OrderPaid).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should return 404 for unknown orders", func() {
+			w := request("PATCH", "/api/orders/9999/status", staffToken, `{"status": "paid"}`)
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should put cancelled units back in stock", func() {
+			var before Item
+			db.First(&before, item.ID)
+			Expect(before.Stock).To(BeNumerically("==", 2))
+
+			Expect(setStatus(staffToken, OrderCancelled).Code).To(Equal(http.StatusOK))
+
+			var after Item
+			db.First(&after, item.ID)
+			Expect(after.Stock).To(BeNumerically("==", 3))
+		})
+
+		Describe("Cancelling", func() {
+			cancel := func(body string) *httptest.ResponseRecorder {
+				return request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), customerToken, body)
+			}
+
+			stock := func() uint {
+				var current Item
+				db.Unscoped().First(&current, item.ID)
+				return current.Stock
+			}
+
+			cartLines := func() []CartItem {
+				var lines []CartItem
+				db.Joins("JOIN carts ON carts.id = cart_items.cart_id").Where("carts.user_id = ?", order.UserID).Find(&lines)
+				return lines
+			}
+
+			It("should cancel the order with a reason and restore its stock", func() {
+				w := cancel(`{"reason": "Ordered by mistake"}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var cancelled Order
+				json.Unmarshal(w.Body.Bytes(), &cancelled)
+				Expect(cancelled.Status).To(Equal(OrderCancelled))
+				Expect(cancelled.CancelReason).To(Equal("Ordered by mistake"))
+
+				last := cancelled.StatusHistory[len(cancelled.StatusHistory)-1]
+				Expect(last.ToStatus).To(Equal(OrderCancelled))
+				Expect(last.Note).To(Equal("Ordered by mistake"))
+				Expect(last.ActorID).To(Equal(order.UserID))
+
+				Expect(stock()).To(BeNumerically("==", 3))
+				Expect(cartLines()).To(BeEmpty())
+			})
+
+			It("should return the same result when cancelled twice", func() {
+				first := cancel(`{"reason": "Changed my mind", "restore_cart": true}`)
+				Expect(first.Code).To(Equal(http.StatusOK))
+
+				second := cancel(`{"reason": "Changed my mind", "restore_cart": true}`)
+				Expect(second.Code).To(Equal(http.StatusOK))
+				Expect(second.Body.String()).To(Equal(first.Body.String()))
+
+				// Reserved again in the cart, and neither restored twice
+				Expect(stock()).To(BeNumerically("==", 3))
+				Expect(cartLines()).To(HaveLen(1))
+				Expect(cartLines()[0].Quantity).To(BeNumerically("==", 1))
+			})
+
+			It("should settle concurrent cancels on one cancellation", func() {
+				var wg sync.WaitGroup
+				codes := make([]int, 5)
+				for i := range codes {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						codes[i] = cancel(`{"reason": "Double click"}`).Code
+					}(i)
+				}
+				wg.Wait()
+
+				Expect(codes).To(HaveEach(http.StatusOK))
+				Expect(stock()).To(BeNumerically("==", 3))
+
+				var cancellations int
+				db.Model(&OrderStatusEvent{}).Where("order_id = ? AND to_status = ?", order.ID, OrderCancelled).Count(&cancellations)
+				Expect(cancellations).To(Equal(1))
+			})
+
+			It("should cancel a paid order", func() {
+				Expect(setStatus(staffToken, OrderPaid).Code).To(Equal(http.StatusOK))
+				Expect(cancel(`{"reason": "Found it cheaper"}`).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should refuse once the order is fulfilled", func() {
+				Expect(setStatus(staffToken, OrderPaid).Code).To(Equal(http.StatusOK))
+				Expect(setStatus(staffToken, OrderFulfilled).Code).To(Equal(http.StatusOK))
+
+				w := cancel(`{"reason": "Too late"}`)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+				Expect(stock()).To(BeNumerically("==", 2))
+			})
+
+			It("should require a reason", func() {
+				Expect(cancel(`{}`).Code).To(Equal(http.StatusBadRequest))
+			})
+
+			It("should not cancel another user's order", func() {
+				otherToken := signIn("other", RoleCustomer)
+				w := request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), otherToken, `{"reason": "Not mine"}`)
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+			})
+
+			It("should rebuild the cart from the order when asked", func() {
+				w := cancel(`{"reason": "Want to add more", "restore_cart": true}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				lines := cartLines()
+				Expect(lines).To(HaveLen(1))
+				Expect(lines[0].ItemID).To(Equal(item.ID))
+				Expect(lines[0].Quantity).To(BeNumerically("==", 1))
+				Expect(lines[0].ReservedUntil).NotTo(BeNil())
+
+				// The line can be changed and checked out again
+				w = request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), customerToken, `{"quantity": 2}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				w = request("POST", "/api/orders", customerToken, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				Expect(stock()).To(BeNumerically("==", 1))
+			})
+
+			It("should leave archived items out of the rebuilt cart", func() {
+				Expect(request("DELETE", fmt.Sprintf("/api/items/%d", item.ID), adminToken, "").Code).To(Equal(http.StatusOK))
+
+				Expect(cancel(`{"reason": "Discontinued", "restore_cart": true}`).Code).To(Equal(http.StatusOK))
+				Expect(cartLines()).To(BeEmpty())
+			})
+
+			It("should void the payment awaiting authentication", func() {
+				Expect(cancel(`{"reason": "Could not authenticate"}`).Code).To(Equal(http.StatusOK))
+
+				var payment Payment
+				db.Where("order_id = ?", order.ID).First(&payment)
+				Expect(payment.Status).To(Equal(PaymentVoided))
+				Expect(payments.Status(payment.AuthorizationID)).To(Equal(PaymentVoided))
+			})
+		})
+	})
+
+	Describe("Payments", func() {
+		var token string
+		var item Item
+
+		BeforeEach(func() {
+			user := User{Username: "payer", Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			var err error
+			token, _, err = tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+
+			item = Item{Name: "Headphones", Price: NewMoney(8999, DefaultCurrency), Category: "Electronics", Stock: 4}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+		})
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		checkout := func(source string) *httptest.ResponseRecorder {
+			w := request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": %q}`, cart.ID, source))
+		}
+
+		stock := func() uint {
+			var current Item
+			db.First(&current, item.ID)
+			return current.Stock
+		}
+
+		It("should mark the order paid once the payment is captured", func() {
+			w := checkout("tok_visa")
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var order Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Status).To(Equal(OrderPaid))
+			Expect(order.Payments).To(HaveLen(1))
+			Expect(order.Payments[0].Status).To(Equal(PaymentCaptured))
+			Expect(order.Payments[0].Amount).To(Equal(NewMoney(8999, DefaultCurrency)))
+			Expect(order.Payments[0].Provider).To(Equal("fake"))
+			Expect(payments.Status(order.Payments[0].AuthorizationID)).To(Equal(PaymentCaptured))
+			Expect(stock()).To(BeNumerically("==", 3))
+
+			var history []OrderStatusEvent
+			db.Where("order_id = ?", order.ID).Order("id").Find(&history)
+			Expect(history).To(HaveLen(2))
+			Expect(history[1].ToStatus).To(Equal(OrderPaid))
+			Expect(history[1].Note).To(Equal("Payment captured"))
+		})
+
+		It("should require a payment source", func() {
+			w := request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			w = request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d}`, cart.ID))
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(stock()).To(BeNumerically("==", 4))
+		})
+
+		DescribeTable("should cancel the order and give back the cart when payment fails",
+			func(source string, status int, step string, code string) {
+				w := checkout(source)
+				Expect(w.Code).To(Equal(status))
+
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Step).To(Equal(step))
+				Expect(response.Code).To(Equal(code))
+				Expect(response.OrderID).NotTo(BeZero())
+
+				var order Order
+				db.Preload("Payments").First(&order, response.OrderID)
+				Expect(order.Status).To(Equal(OrderCancelled))
+				Expect(order.CancelReason).To(Equal("Payment failed: " + code))
+				Expect(order.Payments).To(HaveLen(1))
+				Expect(order.Payments[0].Status).To(Equal(PaymentFailed))
+				Expect(order.Payments[0].FailureCode).To(Equal(code))
+				if order.Payments[0].AuthorizationID != "" {
+					Expect(payments.Status(order.Payments[0].AuthorizationID)).To(Equal(PaymentVoided))
+				}
+
+				// The units are reserved in the rebuilt cart, ready to retry
+				Expect(stock()).To(BeNumerically("==", 4))
+				w = request("GET", "/api/carts", token, "")
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts).To(HaveLen(1))
+				Expect(carts[0].Items).To(HaveLen(1))
+				Expect(carts[0].Items[0].ItemID).To(Equal(item.ID))
+
+				w = request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, carts[0].ID))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+			},
+			Entry("a declined card", "tok_declined", http.StatusPaymentRequired, "authorize_payment", "card_declined"),
+			Entry("insufficient funds", "tok_insufficient_funds", http.StatusPaymentRequired, "authorize_payment", "insufficient_funds"),
+			Entry("a declined capture", "tok_capture_declined", http.StatusPaymentRequired, "capture_payment", "capture_declined"),
+			Entry("a provider timeout", "tok_timeout", http.StatusGatewayTimeout, "authorize_payment", "timeout"),
+		)
+
+		Describe("Challenges", func() {
+			var order Order
+
+			BeforeEach(func() {
+				w := checkout("tok_challenge")
+				Expect(w.Code).To(Equal(http.StatusAccepted))
+				json.Unmarshal(w.Body.Bytes(), &order)
+			})
+
+			confirm := func(response string) *httptest.ResponseRecorder {
+				return request("POST", fmt.Sprintf("/api/orders/%d/payment", order.ID), token, fmt.Sprintf(`{"challenge_response": %q}`, response))
+			}
+
+			It("should keep the order pending until the customer authenticates", func() {
+				Expect(order.Status).To(Equal(OrderPending))
+				Expect(order.Payments).To(HaveLen(1))
+				Expect(order.Payments[0].Status).To(Equal(PaymentRequiresAction))
+				Expect(order.Payments[0].ChallengeURL).NotTo(BeEmpty())
+
+				w := confirm("pass")
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var paid Order
+				json.Unmarshal(w.Body.Bytes(), &paid)
+				Expect(paid.Status).To(Equal(OrderPaid))
+				Expect(paid.Payments[0].Status).To(Equal(PaymentCaptured))
+				Expect(paid.Payments[0].ChallengeURL).To(BeEmpty())
+				Expect(payments.Status(paid.Payments[0].AuthorizationID)).To(Equal(PaymentCaptured))
+			})
+
+			It("should cancel the order when authentication fails", func() {
+				w := confirm("fail")
+				Expect(w.Code).To(Equal(http.StatusPaymentRequired))
+
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Code).To(Equal("authentication_failed"))
+
+				var cancelled Order
+				db.First(&cancelled, order.ID)
+				Expect(cancelled.Status).To(Equal(OrderCancelled))
+				Expect(stock()).To(BeNumerically("==", 4))
+			})
+
+			It("should refuse to confirm a payment twice", func() {
+				Expect(confirm("pass").Code).To(Equal(http.StatusOK))
+				Expect(confirm("pass").Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should not confirm another user's payment", func() {
+				Expect(request("POST", fmt.Sprintf("/api/orders/%d/payment", order.ID), adminToken, `{"challenge_response": "pass"}`).Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Describe("Releasing", func() {
+			var order Order
+
+			BeforeEach(func() {
+				w := checkout("tok_visa")
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				json.Unmarshal(w.Body.Bytes(), &order)
+			})
+
+			It("should refund a paid order the customer cancels", func() {
+				w := request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), token, `{"reason": "Changed my mind"}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var cancelled Order
+				json.Unmarshal(w.Body.Bytes(), &cancelled)
+				Expect(cancelled.Payments[0].Status).To(Equal(PaymentRefunded))
+				Expect(payments.Status(order.Payments[0].AuthorizationID)).To(Equal(PaymentRefunded))
+
+				// Cancelling again does not refund twice
+				Expect(request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), token, `{"reason": "Changed my mind"}`).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should refund an order staff refund", func() {
+				w := request("PATCH", fmt.Sprintf("/api/orders/%d/status", order.ID), adminToken, `{"status": "refunded", "note": "Damaged in transit"}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(payments.Status(order.Payments[0].AuthorizationID)).To(Equal(PaymentRefunded))
+			})
+		})
+	})
+
+	Describe("Idempotency", func() {
+		var token string
+		var item Item
+
+		signIn := func(username string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		request := func(method string, url string, token string, key string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			if key != "" {
+				req.Header.Set(IdempotencyKeyHeader, key)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		BeforeEach(func() {
+			token = signIn("clicker")
+
+			item = Item{Name: "Desk Lamp", Price: NewMoney(2499, DefaultCurrency), Category: "Home", Stock: 5}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+		})
+
+		Describe("Checkout", func() {
+			var body string
+
+			BeforeEach(func() {
+				w := request("POST", "/api/carts", token, "", fmt.Sprintf(`{"item_id": %d}`, item.ID))
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				body = fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID)
+			})
+
+			It("should replay the first response to a retry", func() {
+				first := request("POST", "/api/orders", token, "checkout-1", body)
+				Expect(first.Code).To(Equal(http.StatusCreated))
+				Expect(first.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+
+				retry := request("POST", "/api/orders", token, "checkout-1", body)
+				Expect(retry.Code).To(Equal(http.StatusCreated))
+				Expect(retry.Header().Get("Idempotent-Replayed")).To(Equal("true"))
+				Expect(retry.Header().Get("Content-Type")).To(Equal(first.Header().Get("Content-Type")))
+				Expect(retry.Body.String()).To(Equal(first.Body.String()))
+
+				var orders int
+				db.Model(&Order{}).Count(&orders)
+				Expect(orders).To(Equal(1))
+
+				var current Item
+				db.First(&current, item.ID)
+				Expect(current.Stock).To(BeNumerically("==", 4))
+			})
+
+			It("should replay failed requests too", func() {
+				first := request("POST", "/api/orders", token, "checkout-1", `{"cart_id": 9999, "payment_source": "tok_visa"}`)
+				Expect(first.Code).To(Equal(http.StatusNotFound))
+
+				retry := request("POST", "/api/orders", token, "checkout-1", `{"cart_id": 9999, "payment_source": "tok_visa"}`)
+				Expect(retry.Code).To(Equal(http.StatusNotFound))
+				Expect(retry.Header().Get("Idempotent-Replayed")).To(Equal("true"))
+			})
+
+			It("should refuse a key reused for a different request", func() {
+				Expect(request("POST", "/api/orders", token, "checkout-1", body).Code).To(Equal(http.StatusCreated))
+
+				w := request("POST", "/api/orders", token, "checkout-1", `{"cart_id": 9999, "payment_source": "tok_visa"}`)
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+
+				// The same key on another route is a different request too
+				w = request("POST", "/api/carts", token, "checkout-1", body)
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should refuse a retry while the first request is running", func() {
+				var user User
+				db.Where("username = ?", "clicker").First(&user)
+				fingerprint := idempotencyFingerprint(&gin.Context{Request: httptest.NewRequest("POST", "/api/orders", nil)}, []byte(body))
+				running := IdempotencyKey{UserID: user.ID, Key: "checkout-1", Fingerprint: fingerprint, ExpiresAt: time.Now().Add(time.Hour)}
+				Expect(db.Create(&running).Error).NotTo(HaveOccurred())
+
+				w := request("POST", "/api/orders", token, "checkout-1", body)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				var orders int
+				db.Model(&Order{}).Count(&orders)
+				Expect(orders).To(Equal(0))
+			})
+
+			It("should place one order for a burst of double clicks", func() {
+				var wg sync.WaitGroup
+				codes := make([]int, 5)
+				for i := range codes {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						codes[i] = request("POST", "/api/orders", token, "checkout-1", body).Code
+					}(i)
+				}
+				wg.Wait()
+
+				Expect(codes).To(HaveEach(BeElementOf(http.StatusCreated, http.StatusConflict)))
+				Expect(codes).To(ContainElement(http.StatusCreated))
+
+				var orders int
+				db.Model(&Order{}).Count(&orders)
+				Expect(orders).To(Equal(1))
+			})
+
+			It("should run the request again once the key expired", func() {
+				Expect(request("POST", "/api/orders", token, "checkout-1", body).Code).To(Equal(http.StatusCreated))
+				db.Model(&IdempotencyKey{}).Update("expires_at", time.Now().Add(-time.Minute))
+
+				// The cart is gone, so running it again fails
+				w := request("POST", "/api/orders", token, "checkout-1", body)
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+				Expect(w.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+			})
+
+			It("should keep keys apart per user", func() {
+				Expect(request("POST", "/api/orders", token, "checkout-1", body).Code).To(Equal(http.StatusCreated))
+
+				// Another user's cart is not theirs, so their request really runs
+				otherToken := signIn("other")
+				w := request("POST", "/api/orders", otherToken, "checkout-1", body)
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+				Expect(w.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+			})
+
+			It("should reject overly long keys", func() {
+				w := request("POST", "/api/orders", token, strings.Repeat("k", maxIdempotencyKeyLength+1), body)
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		It("should add to the cart once per key", func() {
+			body := fmt.Sprintf(`{"item_id": %d}`, item.ID)
+			for i := 0; i < 3; i++ {
+				Expect(request("POST", "/api/carts", token, "add-lamp", body).Code).To(Equal(http.StatusCreated))
+			}
+
+			// Without a key every request adds another unit
+			w := request("POST", "/api/carts", token, "", body)
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Items).To(HaveLen(1))
+			Expect(cart.Items[0].Quantity).To(BeNumerically("==", 2))
+		})
+	})
+
+	Describe("Promotions", func() {
+		var token string
+		var tent, lantern, book Item
+
+		signIn := func(username string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		createPromotion := func(body string) Promotion {
+			w := request("POST", "/api/promotions", adminToken, body)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+			var promotion Promotion
+			json.Unmarshal(w.Body.Bytes(), &promotion)
+			return promotion
+		}
+
+		addToCart := func(token string, item Item, quantity uint) Cart {
+			w := request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			if quantity > 1 {
+				w = request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), token, fmt.Sprintf(`{"quantity": %d}`, quantity))
+				Expect(w.Code).To(Equal(http.StatusOK))
+			}
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return cart
+		}
+
+		applyCoupon := func(token string, code string) (*httptest.ResponseRecorder, Cart) {
+			w := request("POST", "/api/carts/coupon", token, fmt.Sprintf(`{"code": %q}`, code))
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return w, cart
+		}
+
+		checkout := func(token string, cart Cart) *httptest.ResponseRecorder {
+			return request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID))
+		}
+
+		BeforeEach(func() {
+			token = signIn("shopper")
+
+			outdoor := Category{Slug: "outdoor", Name: "Outdoor"}
+			Expect(db.Create(&outdoor).Error).NotTo(HaveOccurred())
+			camping := Category{Slug: "camping", Name: "Camping", ParentID: &outdoor.ID}
+			Expect(db.Create(&camping).Error).NotTo(HaveOccurred())
+
+			tent = Item{Name: "Tent", Price: NewMoney(3333, DefaultCurrency), Category: "Camping", CategoryID: &camping.ID, Stock: 10}
+			lantern = Item{Name: "Lantern", Price: NewMoney(1000, DefaultCurrency), Category: "Outdoor", CategoryID: &outdoor.ID, Stock: 10}
+			book = Item{Name: "Field Guide", Price: NewMoney(2000, DefaultCurrency), Category: "Books", Stock: 10}
+			for _, item := range []*Item{&tent, &lantern, &book} {
+				Expect(db.Create(item).Error).NotTo(HaveOccurred())
+			}
+		})
+
+		Describe("Managing promotions", func() {
+			It("should let admins create and list promotions", func() {
+				promotion := createPromotion(fmt.Sprintf(`{"code": " summer15 ", "type": "percentage", "percent_off": 15, "item_ids": [%d]}`, tent.ID))
+				Expect(promotion.Code).To(Equal("SUMMER15"))
+				Expect(promotion.Items).To(HaveLen(1))
+
+				w := request("GET", "/api/promotions", adminToken, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var promotions []Promotion
+				json.Unmarshal(w.Body.Bytes(), &promotions)
+				Expect(promotions).To(HaveLen(1))
+				Expect(promotions[0].Items[0].ID).To(Equal(tent.ID))
+
+				// Linking the item left it untouched
+				var stored Item
+				db.First(&stored, tent.ID)
+				Expect(stored.Stock).To(BeNumerically("==", 10))
+			})
+
+			It("should only let admins manage promotions", func() {
+				Expect(request("POST", "/api/promotions", token, `{"code": "X", "type": "free_shipping"}`).Code).To(Equal(http.StatusForbidden))
+				Expect(request("GET", "/api/promotions", token, "").Code).To(Equal(http.StatusForbidden))
+			})
+
+			It("should refuse duplicate codes", func() {
+				createPromotion(`{"code": "FREESHIP", "type": "free_shipping"}`)
+				Expect(request("POST", "/api/promotions", adminToken, `{"code": "freeship", "type": "free_shipping"}`).Code).To(Equal(http.StatusConflict))
+			})
+
+			DescribeTable("should validate promotions",
+				func(body string) {
+					Expect(request("POST", "/api/promotions", adminToken, body).Code).To(Equal(http.StatusBadRequest))
+				},
+				Entry("an unknown type", `{"code": "X", "type": "mystery"}`),
+				Entry("no percentage", `{"code": "X", "type": "percentage"}`),
+				Entry("over 100 percent", `{"code": "X", "type": "percentage", "percent_off": 101}`),
+				Entry("no amount", `{"code": "X", "type": "fixed_amount"}`),
+				Entry("nothing free", `{"code": "X", "type": "buy_x_get_y", "buy_quantity": 2}`),
+				Entry("ending before it starts", `{"code": "X", "type": "free_shipping", "starts_at": "2030-01-02T00:00:00Z", "ends_at": "2030-01-01T00:00:00Z"}`),
+				Entry("an unknown item", `{"code": "X", "type": "free_shipping", "item_ids": [9999]}`),
+			)
+		})
+
+		Describe("Discounts", func() {
+			It("should take a percentage off every eligible line, rounding each", func() {
+				createPromotion(`{"code": "SAVE15", "type": "percentage", "percent_off": 15}`)
+				addToCart(token, tent, 1)
+				addToCart(token, lantern, 2)
+
+				w, cart := applyCoupon(token, "save15")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(cart.Coupon).To(Equal("SAVE15"))
+				Expect(cart.Discounts).To(HaveLen(2))
+				Expect(cart.Discounts[0].Amount).To(Equal(NewMoney(500, DefaultCurrency))) // 15% of 33.33 is 4.9995
+				Expect(cart.Discounts[1].Amount).To(Equal(NewMoney(300, DefaultCurrency)))
+				Expect(cart.Subtotal).To(Equal(NewMoney(5333, DefaultCurrency)))
+				Expect(cart.DiscountTotal).To(Equal(NewMoney(800, DefaultCurrency)))
+				Expect(cart.Total).To(Equal(NewMoney(4533, DefaultCurrency)))
+
+				// Listing the cart shows the same breakdown
+				w = request("GET", "/api/carts", token, "")
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts[0].Total).To(Equal(cart.Total))
+				Expect(carts[0].Discounts).To(Equal(cart.Discounts))
+			})
+
+			It("should take a fixed amount off, up to the eligible subtotal", func() {
+				createPromotion(fmt.Sprintf(`{"code": "TENOFF", "type": "fixed_amount", "amount_off": "10.00", "item_ids": [%d]}`, lantern.ID))
+				addToCart(token, lantern, 1)
+				addToCart(token, book, 1)
+
+				w, cart := applyCoupon(token, "TENOFF")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(cart.DiscountTotal).To(Equal(NewMoney(1000, DefaultCurrency)))
+				Expect(cart.Total).To(Equal(NewMoney(2000, DefaultCurrency)))
+
+				createPromotion(`{"code": "BIGOFF", "type": "fixed_amount", "amount_off": "100.00"}`)
+				_, cart = applyCoupon(token, "BIGOFF")
+				Expect(cart.DiscountTotal).To(Equal(NewMoney(3000, DefaultCurrency)))
+				Expect(cart.Total.Amount).To(BeZero())
+			})
+
+			It("should give free units for every full set bought", func() {
+				createPromotion(`{"code": "B2G1", "type": "buy_x_get_y", "buy_quantity": 2, "get_quantity": 1}`)
+				addToCart(token, lantern, 2)
+
+				w, _ := applyCoupon(token, "B2G1")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+
+				addToCart(token, lantern, 7)
+				w, cart := applyCoupon(token, "B2G1")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(cart.Discounts).To(HaveLen(1))
+				Expect(*cart.Discounts[0].ItemID).To(Equal(lantern.ID))
+				Expect(cart.Discounts[0].Amount).To(Equal(NewMoney(2000, DefaultCurrency)))
+				Expect(cart.Total).To(Equal(NewMoney(5000, DefaultCurrency)))
+			})
+
+			It("should mark free shipping without changing the total", func() {
+				createPromotion(`{"code": "SHIPFREE", "type": "free_shipping"}`)
+				addToCart(token, book, 1)
+
+				_, cart := applyCoupon(token, "SHIPFREE")
+				Expect(cart.FreeShipping).To(BeTrue())
+				Expect(cart.Total).To(Equal(NewMoney(2000, DefaultCurrency)))
+			})
+
+			It("should only discount items in the promotion's categories and their subcategories", func() {
+				var outdoor Category
+				db.Where("slug = ?", "outdoor").First(&outdoor)
+				createPromotion(fmt.Sprintf(`{"code": "OUTDOORS", "type": "percentage", "percent_off": 10, "category_ids": [%d]}`, outdoor.ID))
+
+				addToCart(token, book, 1)
+				w, _ := applyCoupon(token, "OUTDOORS")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+
+				addToCart(token, tent, 1)
+				w, cart := applyCoupon(token, "OUTDOORS")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(cart.Discounts).To(HaveLen(1))
+				Expect(*cart.Discounts[0].ItemID).To(Equal(tent.ID))
+			})
+
+			It("should take the coupon off again", func() {
+				createPromotion(`{"code": "SAVE15", "type": "percentage", "percent_off": 15}`)
+				addToCart(token, book, 1)
+				applyCoupon(token, "SAVE15")
+
+				w := request("DELETE", "/api/carts/coupon", token, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				Expect(cart.PromotionID).To(BeNil())
+				Expect(cart.Discounts).To(BeEmpty())
+				Expect(cart.Total).To(Equal(NewMoney(2000, DefaultCurrency)))
+			})
+
+			It("should reject unknown codes", func() {
+				addToCart(token, book, 1)
+				w, _ := applyCoupon(token, "NOPE")
+				Expect(w.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Describe("Validity", func() {
+			It("should only apply between its start and end", func() {
+				createPromotion(`{"code": "LATER", "type": "free_shipping", "starts_at": "2999-01-01T00:00:00Z"}`)
+				createPromotion(`{"code": "GONE", "type": "free_shipping", "ends_at": "2000-01-01T00:00:00Z"}`)
+				addToCart(token, book, 1)
+
+				w, _ := applyCoupon(token, "LATER")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				w, _ = applyCoupon(token, "GONE")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should flag a coupon that stopped applying and refuse to check out with it", func() {
+				promotion := createPromotion(`{"code": "SAVE15", "type": "percentage", "percent_off": 15}`)
+				cart := addToCart(token, book, 1)
+				applyCoupon(token, "SAVE15")
+
+				db.Model(&Promotion{}).Where("id = ?", promotion.ID).Update("ends_at", time.Now().Add(-time.Minute))
+
+				w := request("GET", "/api/carts", token, "")
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts[0].CouponError).To(Equal("Coupon has expired"))
+				Expect(carts[0].Discounts).To(BeEmpty())
+				Expect(carts[0].Total).To(Equal(NewMoney(2000, DefaultCurrency)))
+
+				w = checkout(token, cart)
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Step).To(Equal("apply_promotion"))
+
+				var orders int
+				db.Model(&Order{}).Count(&orders)
+				Expect(orders).To(BeZero())
+			})
+
+			It("should enforce the overall usage limit", func() {
+				createPromotion(`{"code": "FIRST", "type": "percentage", "percent_off": 10, "usage_limit": 1}`)
+
+				cart := addToCart(token, book, 1)
+				applyCoupon(token, "FIRST")
+				Expect(checkout(token, cart).Code).To(Equal(http.StatusCreated))
+
+				otherToken := signIn("latecomer")
+				addToCart(otherToken, book, 1)
+				w, _ := applyCoupon(otherToken, "FIRST")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("should enforce the per-user limit and free it when the order is cancelled", func() {
+				createPromotion(`{"code": "ONCE", "type": "percentage", "percent_off": 10, "per_user_limit": 1}`)
+
+				cart := addToCart(token, book, 1)
+				applyCoupon(token, "ONCE")
+				w := checkout(token, cart)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+
+				addToCart(token, book, 1)
+				w, _ = applyCoupon(token, "ONCE")
+				Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+
+				// Someone else may still use it
+				otherToken := signIn("friend")
+				addToCart(otherToken, book, 1)
+				w, _ = applyCoupon(otherToken, "ONCE")
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				w = request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), token, `{"reason": "Wrong size"}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				w, _ = applyCoupon(token, "ONCE")
+				Expect(w.Code).To(Equal(http.StatusOK))
+			})
+		})
+
+		It("should keep the discounts on the order and charge the discounted total", func() {
+			createPromotion(`{"code": "SAVE15", "type": "percentage", "percent_off": 15}`)
+			addToCart(token, tent, 1)
+			cart := addToCart(token, lantern, 2)
+			applyCoupon(token, "SAVE15")
+
+			w := checkout(token, cart)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var order Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Subtotal).To(Equal(NewMoney(5333, DefaultCurrency)))
+			Expect(order.Total).To(Equal(NewMoney(4533, DefaultCurrency)))
+			Expect(order.Discounts).To(HaveLen(2))
+			Expect(order.Discounts[0].Code).To(Equal("SAVE15"))
+			Expect(order.Payments[0].Amount).To(Equal(order.Total))
+
+			var redemptions int
+			db.Model(&PromotionRedemption{}).Where("order_id = ?", order.ID).Count(&redemptions)
+			Expect(redemptions).To(Equal(1))
+		})
+	})
+
+	Describe("Taxes", func() {
+		line := func(category string, amount int64) TaxableLine {
+			return TaxableLine{Category: category, Amount: NewMoney(amount, DefaultCurrency)}
+		}
+
+		lineTaxes := func(breakdown TaxBreakdown) []int64 {
+			var amounts []int64
+			for _, line := range breakdown.Lines {
+				amounts = append(amounts, line.Amount.Amount)
+			}
+			return amounts
+		}
+
+		table := func(rounding string, inclusive bool) *TaxTable {
+			return &TaxTable{
+				DefaultRegion: "TEST",
+				Jurisdictions: map[string]TaxJurisdiction{
+					"TEST": {Name: "Tax", Rate: 7250, CategoryRates: map[string]TaxRate{"Books": 0}, PricesIncludeTax: inclusive, Rounding: rounding},
+				},
+			}
+		}
+
+		Describe("Rounding", func() {
+			// Three lines of 1.00 at 7.25% each owe exactly 7.25 cents
+			lines := []TaxableLine{line("Food", 100), line("Food", 100), line("Food", 100)}
+
+			It("should round every line on its own per line", func() {
+				breakdown, err := table(TaxRoundPerLine, false).Calculate("", lines)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lineTaxes(breakdown)).To(Equal([]int64{7, 7, 7}))
+				Expect(breakdown.Total).To(Equal(NewMoney(21, DefaultCurrency)))
+			})
+
+			It("should round the total once per order and share it over the lines", func() {
+				breakdown, err := table(TaxRoundPerOrder, false).Calculate("", lines)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lineTaxes(breakdown)).To(Equal([]int64{8, 7, 7}))
+				Expect(breakdown.Total).To(Equal(NewMoney(22, DefaultCurrency)))
+				Expect(breakdown.Taxes).To(Equal([]TaxLine{{Name: "Tax", Rate: 7250, Amount: NewMoney(22, DefaultCurrency)}}))
+			})
+
+			It("should give leftover units to the largest fractions", func() {
+				// 7.25% of 0.30, 0.10 and 0.50 is 2.175, 0.725 and 3.625
+				breakdown, err := table(TaxRoundPerOrder, false).Calculate("", []TaxableLine{line("Food", 30), line("Food", 10), line("Food", 50)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lineTaxes(breakdown)).To(Equal([]int64{2, 1, 4}))
+				Expect(breakdown.Total.Amount).To(Equal(int64(7)))
+			})
+
+			DescribeTable("should round halves away from zero",
+				func(rounding string) {
+					// 7.25% of 2.00 is 14.5 cents
+					breakdown, err := table(rounding, false).Calculate("", []TaxableLine{line("Food", 200)})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(breakdown.Total.Amount).To(Equal(int64(15)))
+				},
+				Entry("per line", TaxRoundPerLine),
+				Entry("per order", TaxRoundPerOrder),
+			)
+		})
+
+		It("should take inclusive tax out of the price", func() {
+			// 10.00 including 7.25% holds 67.599 cents of tax
+			breakdown, err := table(TaxRoundPerLine, true).Calculate("", []TaxableLine{line("Food", 1000)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(breakdown.Inclusive).To(BeTrue())
+			Expect(breakdown.Total).To(Equal(NewMoney(68, DefaultCurrency)))
+		})
+
+		It("should tax categories at their own rate and total each rate", func() {
+			breakdown, err := DefaultTaxTable().Calculate("de", []TaxableLine{line("Books", 1070), line("Electronics", 1190), line("Books", 2140)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(breakdown.Region).To(Equal("DE"))
+			Expect(breakdown.Lines[0].Rate).To(Equal(TaxRate(7000)))
+			Expect(lineTaxes(breakdown)).To(Equal([]int64{70, 190, 140}))
+			Expect(breakdown.Taxes).To(Equal([]TaxLine{
+				{Name: "VAT", Rate: 7000, Amount: NewMoney(210, DefaultCurrency)},
+				{Name: "VAT", Rate: 19000, Amount: NewMoney(190, DefaultCurrency)},
+			}))
+		})
+
+		It("should refuse unknown regions", func() {
+			_, err := DefaultTaxTable().Calculate("XX", nil)
+			var regionErr *TaxRegionError
+			Expect(errors.As(err, &regionErr)).To(BeTrue())
+			Expect(regionErr.Region).To(Equal("XX"))
+		})
+
+		It("should share order-wide discounts over the lines before taxing", func() {
+			lines := []TaxableLine{line("Food", 3000), line("Food", 1000)}
+			breakdown, err := calculateTax(table(TaxRoundPerLine, false), "", lines, []Discount{{Amount: NewMoney(1000, DefaultCurrency)}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lines[0].Amount.Amount).To(Equal(int64(2250)))
+			Expect(lines[1].Amount.Amount).To(Equal(int64(750)))
+			Expect(breakdown.Total.Amount).To(Equal(int64(217))) // 163.125 and 54.375 round down
+		})
+
+		It("should take item discounts off every variant line of the item", func() {
+			itemID, small, large := uint(7), uint(1), uint(2)
+			variantLine := func(variantID *uint, amount int64) TaxableLine {
+				taxable := line("Food", amount)
+				taxable.ItemID, taxable.VariantID = itemID, variantID
+				return taxable
+			}
+
+			// A discount on the whole item is shared over its lines
+			lines := []TaxableLine{variantLine(&small, 3000), variantLine(&large, 1000), line("Food", 500)}
+			_, err := calculateTax(table(TaxRoundPerLine, false), "", lines, []Discount{{ItemID: &itemID, Amount: NewMoney(3200, DefaultCurrency)}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lines[0].Amount.Amount).To(Equal(int64(600)))
+			Expect(lines[1].Amount.Amount).To(Equal(int64(200)))
+			Expect(lines[2].Amount.Amount).To(Equal(int64(500)))
+
+			// A discount on one variant only comes off its line, and never
+			// below zero
+			lines = []TaxableLine{variantLine(&small, 3000), variantLine(&large, 1000)}
+			_, err = calculateTax(table(TaxRoundPerLine, false), "", lines, []Discount{{ItemID: &itemID, VariantID: &large, Amount: NewMoney(1500, DefaultCurrency)}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lines[0].Amount.Amount).To(Equal(int64(3000)))
+			Expect(lines[1].Amount.Amount).To(BeZero())
+		})
+
+		DescribeTable("reading rates",
+			func(text string, expected TaxRate) {
+				var rate TaxRate
+				Expect(json.Unmarshal([]byte(text), &rate)).To(Succeed())
+				Expect(rate).To(Equal(expected))
+			},
+			Entry("a string", `"8.875"`, TaxRate(8875)),
+			Entry("a number", `19`, TaxRate(19000)),
+			Entry("zero", `"0"`, TaxRate(0)),
+		)
+
+		It("should write rates as decimal percentages", func() {
+			data, _ := json.Marshal([]TaxRate{7250, 19000, 8875})
+			Expect(string(data)).To(Equal(`["7.25","19","8.875"]`))
+
+			var rate TaxRate
+			Expect(json.Unmarshal([]byte(`"100.5"`), &rate)).NotTo(Succeed())
+			Expect(json.Unmarshal([]byte(`"7.2505"`), &rate)).NotTo(Succeed())
+		})
+
+		Describe("Carts and orders", func() {
+			var token string
+			var laptop, novel Item
+
+			request := func(method string, url string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			checkout := func(cartID uint, region string) Order {
+				w := request("POST", "/api/orders", fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "tax_region": %q}`, cartID, region))
+				Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				return order
+			}
+
+			var cartID uint
+
+			BeforeEach(func() {
+				user := User{Username: "taxpayer", Password: "unused", Role: RoleCustomer}
+				Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+				session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+				Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+				var err error
+				token, _, err = tokens.Issue(session, AccessToken)
+				Expect(err).NotTo(HaveOccurred())
+
+				laptop = Item{Name: "Laptop", Price: NewMoney(119000, DefaultCurrency), Category: "Electronics", Stock: 5}
+				novel = Item{Name: "Novel", Price: NewMoney(1070, DefaultCurrency), Category: "Books", Stock: 5}
+				for _, item := range []*Item{&laptop, &novel} {
+					Expect(db.Create(item).Error).NotTo(HaveOccurred())
+
+					w := request("POST", "/api/carts", fmt.Sprintf(`{"item_id": %d}`, item.ID))
+					Expect(w.Code).To(Equal(http.StatusCreated))
+					var cart Cart
+					json.Unmarshal(w.Body.Bytes(), &cart)
+					cartID = cart.ID
+				}
+			})
+
+			It("should preview the tax of a region in the cart", func() {
+				w := request("GET", "/api/carts?tax_region=us-ca", "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var carts []Cart
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				cart := carts[0]
+				Expect(cart.TaxRegion).To(Equal("US-CA"))
+				Expect(cart.PricesIncludeTax).To(BeFalse())
+				Expect(cart.Subtotal).To(Equal(NewMoney(120070, DefaultCurrency)))
+				Expect(cart.TaxTotal).To(Equal(NewMoney(8705, DefaultCurrency))) // 7.25% of 1200.70 is 87.05075
+				Expect(cart.Total).To(Equal(NewMoney(128775, DefaultCurrency)))
+				Expect(cart.Items[0].TaxRate).To(Equal(TaxRate(7250)))
+
+				// Without a region the default region is used
+				w = request("GET", "/api/carts", "")
+				json.Unmarshal(w.Body.Bytes(), &carts)
+				Expect(carts[0].TaxRegion).To(Equal("US-OR"))
+				Expect(carts[0].Taxes).To(BeEmpty())
+				Expect(carts[0].Total).To(Equal(carts[0].Subtotal))
+			})
+
+			It("should refuse to preview an unknown region", func() {
+				w := request("GET", "/api/carts?tax_region=XX", "")
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+				Expect(w.Body.String()).To(ContainSubstring("Unknown tax region"))
+			})
+
+			It("should add exclusive tax to the order total and keep the tax lines", func() {
+				order := checkout(cartID, "US-CA")
+				Expect(order.TaxRegion).To(Equal("US-CA"))
+				Expect(order.TaxTotal).To(Equal(NewMoney(8705, DefaultCurrency)))
+				Expect(order.Total).To(Equal(NewMoney(128775, DefaultCurrency)))
+				Expect(order.Taxes).To(HaveLen(1))
+				Expect(order.Taxes[0].Amount).To(Equal(order.TaxTotal))
+				Expect(order.Payments[0].Amount).To(Equal(order.Total))
+
+				// Per-order rounding shares the total over the lines
+				var items []OrderItem
+				db.Where("order_id = ?", order.ID).Order("id").Find(&items)
+				Expect(items[0].Tax.Amount + items[1].Tax.Amount).To(Equal(int64(8705)))
+				Expect(items[1].TaxRate).To(Equal(TaxRate(7250)))
+
+				var stored Order
+				db.Preload("Taxes").First(&stored, order.ID)
+				Expect(stored.TaxTotal).To(Equal(order.TaxTotal))
+				Expect(stored.Taxes[0].Rate).To(Equal(TaxRate(7250)))
+			})
+
+			It("should leave inclusive tax in the price", func() {
+				order := checkout(cartID, "DE")
+				Expect(order.PricesIncludeTax).To(BeTrue())
+				Expect(order.Total).To(Equal(order.Subtotal))
+				Expect(order.TaxTotal).To(Equal(NewMoney(19070, DefaultCurrency))) // 190.00 on the laptop and 0.70 on the novel
+				Expect(order.Taxes).To(HaveLen(2))
+			})
+
+			It("should tax what is left after discounts", func() {
+				createReq := httptest.NewRequest("POST", "/api/promotions", bytes.NewBufferString(`{"code": "HALF", "type": "percentage", "percent_off": 50}`))
+				createReq.Header.Set("Content-Type", "application/json")
+				createReq.Header.Set("Authorization", "Bearer "+adminToken)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, createReq)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				Expect(request("POST", "/api/carts/coupon", `{"code": "HALF"}`).Code).To(Equal(http.StatusOK))
+
+				order := checkout(cartID, "US-CA")
+				Expect(order.TaxTotal).To(Equal(NewMoney(4353, DefaultCurrency))) // 7.25% of 600.35 is 43.525375
+				Expect(order.Total).To(Equal(NewMoney(64388, DefaultCurrency)))
+			})
+
+			It("should refuse to check out in an unknown region", func() {
+				w := request("POST", "/api/orders", fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "tax_region": "XX"}`, cartID))
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Step).To(Equal("calculate_tax"))
+
+				var orderCount int
+				db.Model(&Order{}).Count(&orderCount)
+				Expect(orderCount).To(BeZero())
+			})
+		})
+	})
+
+	Describe("Addresses", func() {
+		var token string
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		signIn := func(username string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		createAddress := func(token string, body string) Address {
+			w := request("POST", "/api/addresses", token, body)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+			var address Address
+			json.Unmarshal(w.Body.Bytes(), &address)
+			return address
+		}
+
+		listAddresses := func() []Address {
+			w := request("GET", "/api/addresses", token, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var addresses []Address
+			json.Unmarshal(w.Body.Bytes(), &addresses)
+			return addresses
+		}
+
+		const home = `{"name": "Ada Lovelace", "line1": "1 Market St", "city": "San Francisco", "region": "ca", "postal_code": "94105", "country": "us"}`
+		const office = `{"name": "Ada Lovelace", "line1": "350 5th Ave", "city": "New York", "region": "NY", "postal_code": "10118", "country": "US"}`
+
+		BeforeEach(func() {
+			token = signIn("addressee")
+		})
+
+		It("should make the first address the default", func() {
+			first := createAddress(token, home)
+			Expect(first.IsDefault).To(BeTrue())
+			Expect(first.Country).To(Equal("US"))
+			Expect(first.Region).To(Equal("CA"))
+			Expect(first.TaxRegion()).To(Equal("US-CA"))
+
+			second := createAddress(token, office)
+			Expect(second.IsDefault).To(BeFalse())
+
+			addresses := listAddresses()
+			Expect(addresses).To(HaveLen(2))
+			Expect(addresses[0].ID).To(Equal(first.ID))
+		})
+
+		It("should keep a single default address", func() {
+			first := createAddress(token, home)
+			second := createAddress(token, strings.Replace(office, `"country"`, `"is_default": true, "country"`, 1))
+			Expect(second.IsDefault).To(BeTrue())
+
+			addresses := listAddresses()
+			Expect(addresses[0].ID).To(Equal(second.ID))
+			Expect(addresses[1].ID).To(Equal(first.ID))
+			Expect(addresses[1].IsDefault).To(BeFalse())
+
+			// Making the first address the default again moves the flag back
+			w := request("PUT", fmt.Sprintf("/api/addresses/%d", first.ID), token, strings.Replace(home, `"country"`, `"is_default": true, "country"`, 1))
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var defaults int
+			db.Model(&Address{}).Where("is_default = ?", true).Count(&defaults)
+			Expect(defaults).To(Equal(1))
+			Expect(listAddresses()[0].ID).To(Equal(first.ID))
+		})
+
+		It("should update an address", func() {
+			address := createAddress(token, home)
+
+			w := request("PUT", fmt.Sprintf("/api/addresses/%d", address.ID), token, strings.Replace(home, "1 Market St", "2 Market St", 1))
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			w = request("GET", fmt.Sprintf("/api/addresses/%d", address.ID), token, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var updated Address
+			json.Unmarshal(w.Body.Bytes(), &updated)
+			Expect(updated.Line1).To(Equal("2 Market St"))
+			Expect(updated.IsDefault).To(BeTrue())
+		})
+
+		It("should hand the default to the oldest address left when it is deleted", func() {
+			first := createAddress(token, home)
+			second := createAddress(token, office)
+			third := createAddress(token, office)
+
+			Expect(request("DELETE", fmt.Sprintf("/api/addresses/%d", first.ID), token, "").Code).To(Equal(http.StatusOK))
+
+			addresses := listAddresses()
+			Expect(addresses).To(HaveLen(2))
+			Expect(addresses[0].ID).To(Equal(second.ID))
+			Expect(addresses[0].IsDefault).To(BeTrue())
+			Expect(addresses[1].ID).To(Equal(third.ID))
+		})
+
+		DescribeTable("should validate addresses",
+			func(body string) {
+				Expect(request("POST", "/api/addresses", token, body).Code).To(Equal(http.StatusBadRequest))
+			},
+			Entry("a missing city", `{"name": "Ada", "line1": "1 Market St", "postal_code": "94105", "country": "US"}`),
+			Entry("a blank name", `{"name": "  ", "line1": "1 Market St", "city": "San Francisco", "postal_code": "94105", "country": "US"}`),
+			Entry("a country name", `{"name": "Ada", "line1": "1 Market St", "city": "San Francisco", "postal_code": "94105", "country": "United States"}`),
+		)
+
+		It("should keep addresses private", func() {
+			address := createAddress(token, home)
+			other := signIn("neighbour")
+
+			Expect(request("GET", fmt.Sprintf("/api/addresses/%d", address.ID), other, "").Code).To(Equal(http.StatusNotFound))
+			Expect(request("PUT", fmt.Sprintf("/api/addresses/%d", address.ID), other, office).Code).To(Equal(http.StatusNotFound))
+			Expect(request("DELETE", fmt.Sprintf("/api/addresses/%d", address.ID), other, "").Code).To(Equal(http.StatusNotFound))
+
+			w := request("GET", "/api/addresses", other, "")
+			Expect(w.Body.String()).To(Equal("[]"))
+		})
+
+		Describe("Shipping", func() {
+			var lamp Item
+
+			addToCart := func(item Item, quantity uint) Cart {
+				w := request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				if quantity > 1 {
+					w = request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), token, fmt.Sprintf(`{"quantity": %d}`, quantity))
+					Expect(w.Code).To(Equal(http.StatusOK))
+				}
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				return cart
+			}
+
+			checkout := func(body string) *httptest.ResponseRecorder {
+				return request("POST", "/api/orders", token, body)
+			}
+
+			BeforeEach(func() {
+				lamp = Item{Name: "Lamp", Price: NewMoney(2000, DefaultCurrency), Category: "Home", WeightGrams: 1500, Stock: 10}
+				Expect(db.Create(&lamp).Error).NotTo(HaveOccurred())
+			})
+
+			Describe("Rates", func() {
+				table := DefaultShippingTable()
+				address := PostalAddress{Country: "US"}
+
+				quote := func(shipment Shipment) map[string]int64 {
+					options, err := table.Options(shipment)
+					Expect(err).NotTo(HaveOccurred())
+
+					costs := map[string]int64{}
+					for _, option := range options {
+						costs[option.Method] = option.Cost.Amount
+					}
+					return costs
+				}
+
+				It("should quote flat, weight-based and free-over-threshold rates, cheapest first", func() {
+					options, err := table.Options(Shipment{Address: address, WeightGrams: 2001, Subtotal: NewMoney(5000, DefaultCurrency)})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(options).To(Equal([]ShippingOption{
+						{Method: "standard", Name: "Standard (free over $75)", Cost: NewMoney(599, DefaultCurrency)},
+						{Method: "ground", Name: "Ground", Cost: NewMoney(774, DefaultCurrency)}, // 3.99 and 3 started kilograms at 1.25
+						{Method: "express", Name: "Express", Cost: NewMoney(1999, DefaultCurrency)},
+					}))
+				})
+
+				It("should ship for free once the order reaches the threshold", func() {
+					Expect(quote(Shipment{Address: address, Subtotal: NewMoney(7499, DefaultCurrency)})["standard"]).To(Equal(int64(599)))
+					Expect(quote(Shipment{Address: address, Subtotal: NewMoney(7500, DefaultCurrency)})["standard"]).To(BeZero())
+				})
+
+				It("should not let free shipping coupons cover express", func() {
+					costs := quote(Shipment{Address: address, WeightGrams: 5000, FreeShipping: true})
+					Expect(costs["standard"]).To(BeZero())
+					Expect(costs["ground"]).To(BeZero())
+					Expect(costs["express"]).To(Equal(int64(1999)))
+				})
+
+				It("should only offer methods that ship to the country", func() {
+					costs := quote(Shipment{Address: PostalAddress{Country: "DE"}, WeightGrams: 500})
+					Expect(costs).To(Equal(map[string]int64{"international": 1899}))
+
+					_, err := table.Options(Shipment{Address: PostalAddress{Country: "JP"}})
+					var shippingErr *ShippingError
+					Expect(errors.As(err, &shippingErr)).To(BeTrue())
+				})
+			})
+
+			It("should quote shipping for the cart", func() {
+				Expect(request("GET", "/api/carts/shipping-options", token, "").Code).To(Equal(http.StatusBadRequest))
+
+				createAddress(token, home)
+				addToCart(lamp, 2)
+
+				w := request("GET", "/api/carts/shipping-options", token, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+				var options []ShippingOption
+				json.Unmarshal(w.Body.Bytes(), &options)
+				Expect(options).To(HaveLen(3))
+				Expect(options[0].Method).To(Equal("standard"))
+				Expect(options[1].Cost).To(Equal(NewMoney(774, DefaultCurrency)))
+
+				abroad := createAddress(token, `{"name": "Ada", "line1": "Unter den Linden 1", "city": "Berlin", "postal_code": "10117", "country": "DE"}`)
+				w = request("GET", fmt.Sprintf("/api/carts/shipping-options?address_id=%d", abroad.ID), token, "")
+				json.Unmarshal(w.Body.Bytes(), &options)
+				Expect(options).To(HaveLen(1))
+				Expect(options[0].Method).To(Equal("international"))
+
+				Expect(request("GET", "/api/carts/shipping-options?address_id=9999", token, "").Code).To(Equal(http.StatusNotFound))
+			})
+
+			It("should ship to the default address by the cheapest method", func() {
+				address := createAddress(token, home)
+				cart := addToCart(lamp, 1)
+
+				w := checkout(fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				Expect(*order.ShippingAddressID).To(Equal(address.ID))
+				Expect(*order.BillingAddressID).To(Equal(address.ID))
+				Expect(order.ShippingAddress.City).To(Equal("San Francisco"))
+				Expect(order.ShippingMethod).To(Equal("standard"))
+				Expect(order.ShippingCost).To(Equal(NewMoney(599, DefaultCurrency)))
+
+				// Taxed in the address's region, with shipping on top
+				Expect(order.TaxRegion).To(Equal("US-CA"))
+				Expect(order.TaxTotal).To(Equal(NewMoney(145, DefaultCurrency)))
+				Expect(order.Total).To(Equal(NewMoney(2744, DefaultCurrency)))
+				Expect(order.Payments[0].Amount).To(Equal(order.Total))
+			})
+
+			It("should use the chosen method and addresses and keep them on the order", func() {
+				billing := createAddress(token, home)
+				shipping := createAddress(token, office)
+				cart := addToCart(lamp, 1)
+
+				w := checkout(fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "shipping_address_id": %d, "billing_address_id": %d, "shipping_method": "express"}`, cart.ID, shipping.ID, billing.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				Expect(order.ShippingMethod).To(Equal("express"))
+				Expect(order.ShippingCost).To(Equal(NewMoney(1999, DefaultCurrency)))
+				Expect(order.TaxRegion).To(Equal("US-NY"))
+				Expect(order.BillingAddress.City).To(Equal("San Francisco"))
+
+				// Editing the address afterwards leaves the order alone
+				Expect(request("PUT", fmt.Sprintf("/api/addresses/%d", shipping.ID), token, home).Code).To(Equal(http.StatusOK))
+				var stored Order
+				db.First(&stored, order.ID)
+				Expect(stored.ShippingAddress.City).To(Equal("New York"))
+				Expect(stored.ShippingCost).To(Equal(NewMoney(1999, DefaultCurrency)))
+			})
+
+			It("should let free shipping coupons cover shipping", func() {
+				createAddress(token, home)
+				cart := addToCart(lamp, 1)
+
+				createReq := httptest.NewRequest("POST", "/api/promotions", bytes.NewBufferString(`{"code": "SHIPFREE", "type": "free_shipping"}`))
+				createReq.Header.Set("Content-Type", "application/json")
+				createReq.Header.Set("Authorization", "Bearer "+adminToken)
+				router.ServeHTTP(httptest.NewRecorder(), createReq)
+				Expect(request("POST", "/api/carts/coupon", token, `{"code": "SHIPFREE"}`).Code).To(Equal(http.StatusOK))
+
+				w := checkout(fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "shipping_method": "ground"}`, cart.ID))
+				Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				Expect(order.FreeShipping).To(BeTrue())
+				Expect(order.ShippingCost.Amount).To(BeZero())
+			})
+
+			DescribeTable("should refuse shipping that cannot be arranged",
+				func(body func(cart Cart, address Address) string, status int, step string) {
+					address := createAddress(token, home)
+					cart := addToCart(lamp, 1)
+
+					w := checkout(body(cart, address))
+					Expect(w.Code).To(Equal(status), w.Body.String())
+
+					var response CheckoutError
+					json.Unmarshal(w.Body.Bytes(), &response)
+					Expect(response.Step).To(Equal(step))
+
+					var orderCount int
+					db.Model(&Order{}).Count(&orderCount)
+					Expect(orderCount).To(BeZero())
+				},
+				Entry("an unknown method", func(cart Cart, address Address) string {
+					return fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "shipping_method": "teleport"}`, cart.ID)
+				}, http.StatusUnprocessableEntity, "choose_shipping"),
+				Entry("another user's address", func(cart Cart, address Address) string {
+					other := Address{UserID: address.UserID + 100, PostalAddress: address.PostalAddress}
+					Expect(db.Create(&other).Error).NotTo(HaveOccurred())
+					return fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "shipping_address_id": %d}`, cart.ID, other.ID)
+				}, http.StatusNotFound, "load_address"),
+				Entry("a country nothing ships to", func(cart Cart, address Address) string {
+					far := Address{UserID: address.UserID, PostalAddress: PostalAddress{Name: "Ada", Line1: "1 Chome", City: "Tokyo", PostalCode: "100-0001", Country: "JP"}}
+					Expect(db.Create(&far).Error).NotTo(HaveOccurred())
+					return fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa", "shipping_address_id": %d}`, cart.ID, far.ID)
+				}, http.StatusUnprocessableEntity, "choose_shipping"),
+			)
+		})
+	})
+
+	Describe("Wishlists", func() {
+		var token string
+		var item Item
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		signIn := func(username string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		createWishlist := func(body string) Wishlist {
+			w := request("POST", "/api/wishlists", token, body)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+
+			var wishlist Wishlist
+			json.Unmarshal(w.Body.Bytes(), &wishlist)
+			return wishlist
+		}
+
+		listWishlists := func() []Wishlist {
+			w := request("GET", "/api/wishlists", token, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var wishlists []Wishlist
+			json.Unmarshal(w.Body.Bytes(), &wishlists)
+			return wishlists
+		}
+
+		addToCart := func(token string, quantity uint) {
+			Expect(request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID)).Code).To(Equal(http.StatusCreated))
+			Expect(request("PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), token, fmt.Sprintf(`{"quantity": %d}`, quantity)).Code).To(Equal(http.StatusOK))
+		}
+
+		BeforeEach(func() {
+			token = signIn("wisher")
+			item = Item{Name: "Telescope", Price: NewMoney(24900, DefaultCurrency), Stock: 5}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+		})
+
+		It("should report the current price and stock of saved items", func() {
+			wishlist := createWishlist(`{"name": "Birthday"}`)
+			Expect(wishlist.IsPublic).To(BeFalse())
+			Expect(wishlist.ShareToken).To(BeNil())
+
+			w := request("POST", fmt.Sprintf("/api/wishlists/%d/items", wishlist.ID), token, fmt.Sprintf(`{"item_id": %d, "quantity": 2}`, item.ID))
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			// Another shopper holds two units and the price went up
+			addToCart(signIn("other"), 2)
+			Expect(db.Model(&item).Update("price_amount", 26900).Error).NotTo(HaveOccurred())
+
+			wishlists := listWishlists()
+			Expect(wishlists).To(HaveLen(1))
+			Expect(wishlists[0].Items).To(HaveLen(1))
+			line := wishlists[0].Items[0]
+			Expect(line.Quantity).To(Equal(uint(2)))
+			Expect(line.Price).To(Equal(NewMoney(26900, DefaultCurrency)))
+			Expect(line.Available).To(Equal(uint(3)))
+			Expect(line.InStock).To(BeTrue())
+
+			// Archived items stay on the list but cannot be bought
+			Expect(request("DELETE", fmt.Sprintf("/api/items/%d", item.ID), adminToken, "").Code).To(Equal(http.StatusOK))
+			line = listWishlists()[0].Items[0]
+			Expect(line.InStock).To(BeFalse())
+			Expect(line.Available).To(BeZero())
+		})
+
+		It("should share public wishlists by link until they are made private", func() {
+			wishlist := createWishlist(`{"name": "Gift ideas", "is_public": true}`)
+			Expect(wishlist.ShareToken).NotTo(BeNil())
+			link := "/api/wishlists/shared/" + *wishlist.ShareToken
+
+			w := request("GET", link, "", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var shared Wishlist
+			json.Unmarshal(w.Body.Bytes(), &shared)
+			Expect(shared.Name).To(Equal("Gift ideas"))
+
+			// Other users cannot change it
+			Expect(request("PUT", fmt.Sprintf("/api/wishlists/%d", wishlist.ID), signIn("stranger"), `{"name": "Mine"}`).Code).To(Equal(http.StatusNotFound))
+
+			w = request("PUT", fmt.Sprintf("/api/wishlists/%d", wishlist.ID), token, `{"name": "Gift ideas", "is_public": false}`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(request("GET", link, "", "").Code).To(Equal(http.StatusNotFound))
+
+			// Sharing again makes a new link
+			w = request("PUT", fmt.Sprintf("/api/wishlists/%d", wishlist.ID), token, `{"name": "Gift ideas", "is_public": true}`)
+			json.Unmarshal(w.Body.Bytes(), &shared)
+			Expect(*shared.ShareToken).NotTo(Equal(*wishlist.ShareToken))
+		})
+
+		It("should move cart lines to a wishlist and back", func() {
+			addToCart(token, 3)
+
+			w := request("POST", fmt.Sprintf("/api/carts/items/%d/move-to-wishlist", item.ID), token, "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Items).To(BeEmpty())
+
+			wishlists := listWishlists()
+			Expect(wishlists).To(HaveLen(1))
+			Expect(wishlists[0].Name).To(Equal(DefaultWishlistName))
+			Expect(wishlists[0].Items[0].Quantity).To(Equal(uint(3)))
+			Expect(wishlists[0].Items[0].Available).To(Equal(uint(5)))
+
+			w = request("POST", fmt.Sprintf("/api/wishlists/%d/items/%d/move-to-cart", wishlists[0].ID, item.ID), token, "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Items).To(HaveLen(1))
+			Expect(cart.Items[0].Quantity).To(Equal(uint(3)))
+			Expect(cart.Total).To(Equal(NewMoney(74700, DefaultCurrency)))
+			Expect(listWishlists()[0].Items).To(BeEmpty())
+		})
+
+		It("should save to the wishlist asked for", func() {
+			wishlist := createWishlist(`{"name": "Someday"}`)
+			addToCart(token, 1)
+
+			w := request("POST", fmt.Sprintf("/api/carts/items/%d/move-to-wishlist", item.ID), token, fmt.Sprintf(`{"wishlist_id": %d}`, wishlist.ID))
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			wishlists := listWishlists()
+			Expect(wishlists).To(HaveLen(1))
+			Expect(wishlists[0].Items).To(HaveLen(1))
+
+			w = request("POST", fmt.Sprintf("/api/carts/items/%d/move-to-wishlist", item.ID), token, fmt.Sprintf(`{"wishlist_id": %d}`, wishlist.ID+1))
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should keep units over the per-cart limit on the wishlist", func() {
+			Expect(db.Model(&item).Updates(map[string]interface{}{"max_quantity": 3, "stock": 10}).Error).NotTo(HaveOccurred())
+			wishlist := createWishlist(`{"name": "Later"}`)
+			request("POST", fmt.Sprintf("/api/wishlists/%d/items", wishlist.ID), token, fmt.Sprintf(`{"item_id": %d, "quantity": 2}`, item.ID))
+			addToCart(token, 2)
+
+			url := fmt.Sprintf("/api/wishlists/%d/items/%d/move-to-cart", wishlist.ID, item.ID)
+			w := request("POST", url, token, "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Items[0].Quantity).To(Equal(uint(3)))
+			Expect(listWishlists()[0].Items[0].Quantity).To(Equal(uint(1)))
+
+			// A full cart leaves the line as it is
+			w = request("POST", url, token, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			var body map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			Expect(body["max_quantity"]).To(BeEquivalentTo(3))
+			Expect(listWishlists()[0].Items[0].Quantity).To(Equal(uint(1)))
+		})
+
+		It("should keep the item on the wishlist when its stock ran out", func() {
+			wishlist := createWishlist(`{"name": "Later"}`)
+			request("POST", fmt.Sprintf("/api/wishlists/%d/items", wishlist.ID), token, fmt.Sprintf(`{"item_id": %d, "quantity": 2}`, item.ID))
+			addToCart(signIn("quicker"), 4)
+
+			w := request("POST", fmt.Sprintf("/api/wishlists/%d/items/%d/move-to-cart", wishlist.ID, item.ID), token, "")
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			Expect(listWishlists()[0].Items).To(HaveLen(1))
+		})
+	})
+
+	Describe("Variants", func() {
+		var token string
+		var item, other Item
+		var small, large ItemVariant
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		addVariant := func(body string) *httptest.ResponseRecorder {
+			return request("POST", fmt.Sprintf("/api/items/%d/variants", item.ID), adminToken, body)
+		}
+
+		addToCart := func(variantID uint) *httptest.ResponseRecorder {
+			return request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d, "variant_id": %d}`, item.ID, variantID))
+		}
+
+		BeforeEach(func() {
+			user := User{Username: "sizer", Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+			var err error
+			token, _, err = tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+
+			item = Item{Name: "T-shirt", Price: NewMoney(2000, DefaultCurrency), Category: "Clothing", Stock: 100}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+			other = Item{Name: "Socks", Price: NewMoney(500, DefaultCurrency), Category: "Clothing", Stock: 100}
+			Expect(db.Create(&other).Error).NotTo(HaveOccurred())
+
+			w := addVariant(`{"sku": "TEE-S", "options": {"Size": " S "}, "stock": 2}`)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			json.Unmarshal(w.Body.Bytes(), &small)
+			w = addVariant(`{"sku": "TEE-L", "options": {"size": "L"}, "price_override": "24.00", "stock": 5}`)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			json.Unmarshal(w.Body.Bytes(), &large)
+		})
+
+		It("should list items with their variants and prices", func() {
+			Expect(small.Options).To(Equal(VariantOptions{"size": "S"}))
+			Expect(small.Price).To(Equal(NewMoney(2000, DefaultCurrency)))
+			Expect(large.Price).To(Equal(NewMoney(2400, DefaultCurrency)))
+
+			w := request("GET", fmt.Sprintf("/api/items/%d", item.ID), "", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var fetched Item
+			json.Unmarshal(w.Body.Bytes(), &fetched)
+			Expect(fetched.Variants).To(HaveLen(2))
+			Expect(fetched.Variants[1].SKU).To(Equal("TEE-L"))
+			Expect(fetched.Variants[1].Price).To(Equal(NewMoney(2400, DefaultCurrency)))
+
+			// Variants without an override follow the item's price
+			Expect(request("PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"price": "21.00"}`).Code).To(Equal(http.StatusOK))
+			w = request("GET", "/api/items?limit=100", "", "")
+			var items []Item
+			json.Unmarshal(w.Body.Bytes(), &items)
+			for _, listed := range items {
+				if listed.ID == item.ID {
+					Expect(listed.Variants[0].Price).To(Equal(NewMoney(2100, DefaultCurrency)))
+					Expect(listed.Variants[1].Price).To(Equal(NewMoney(2400, DefaultCurrency)))
+				}
+				if listed.ID == other.ID {
+					Expect(listed.Variants).To(BeEmpty())
+				}
+			}
+		})
+
+		It("should reject variants that clash with others", func() {
+			Expect(addVariant(`{"sku": "TEE-S", "options": {"size": "M"}}`).Code).To(Equal(http.StatusConflict))
+			Expect(addVariant(`{"sku": "TEE-S2", "options": {"SIZE": "S"}}`).Code).To(Equal(http.StatusConflict))
+			Expect(addVariant(`{"sku": "TEE-M", "options": {}}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(addVariant(`{"sku": "TEE-M", "options": {"size": "M"}, "price_override": {"amount": "20", "currency": "EUR"}}`).Code).To(Equal(http.StatusBadRequest))
+
+			w := request("PATCH", fmt.Sprintf("/api/items/%d/variants/%d", item.ID, large.ID), adminToken, `{"sku": "TEE-S"}`)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			w = request("PATCH", fmt.Sprintf("/api/items/%d/variants/%d", other.ID, large.ID), adminToken, `{"stock": 1}`)
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+
+			// A zero override goes back to the item's price
+			w = request("PATCH", fmt.Sprintf("/api/items/%d/variants/%d", item.ID, large.ID), adminToken, `{"price_override": "0", "stock": 7}`)
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			var updated ItemVariant
+			json.Unmarshal(w.Body.Bytes(), &updated)
+			Expect(updated.Price).To(Equal(NewMoney(2000, DefaultCurrency)))
+			Expect(updated.Stock).To(Equal(uint(7)))
+		})
+
+		It("should require a variant of the item to add it to the cart", func() {
+			w := request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, item.ID))
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			var response struct {
+				Variants []ItemVariant `json:"variants"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			Expect(response.Variants).To(HaveLen(2))
+
+			w = request("POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d, "variant_id": %d}`, other.ID, small.ID))
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+
+			Expect(addToCart(small.ID).Code).To(Equal(http.StatusCreated))
+			w = addToCart(large.ID)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Items).To(HaveLen(2))
+			Expect(cart.Items[1].Variant.SKU).To(Equal("TEE-L"))
+			Expect(cart.Items[1].Price).To(Equal(NewMoney(2400, DefaultCurrency)))
+			Expect(cart.Total).To(Equal(NewMoney(4400, DefaultCurrency)))
+		})
+
+		It("should keep stock per variant and record the variant on the order", func() {
+			Expect(addToCart(small.ID).Code).To(Equal(http.StatusCreated))
+			Expect(addToCart(large.ID).Code).To(Equal(http.StatusCreated))
+
+			// Only two of the small size are in stock
+			url := fmt.Sprintf("/api/carts/items/%d?variant_id=%d", item.ID, small.ID)
+			w := request("PUT", url, token, `{"quantity": 3}`)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			Expect(w.Body.String()).To(ContainSubstring(fmt.Sprintf(`"variant_id":%d`, small.ID)))
+			w = request("PUT", url, token, `{"quantity": 2}`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var cart Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			w = request("POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID))
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			var order Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Total.Amount).To(BeNumerically(">=", 6400))
+
+			var orderItems []OrderItem
+			Expect(db.Where("order_id = ?", order.ID).Order("id").Find(&orderItems).Error).NotTo(HaveOccurred())
+			Expect(orderItems).To(HaveLen(2))
+			Expect(orderItems[0].SKU).To(Equal("TEE-S"))
+			Expect(orderItems[0].Options).To(Equal(VariantOptions{"size": "S"}))
+			Expect(orderItems[1].Price).To(Equal(NewMoney(2400, DefaultCurrency)))
+
+			// The variants' stock went down, not the item's
+			db.First(&small, small.ID)
+			db.First(&large, large.ID)
+			db.First(&item, item.ID)
+			Expect(small.Stock).To(BeZero())
+			Expect(large.Stock).To(Equal(uint(4)))
+			Expect(item.Stock).To(Equal(uint(100)))
+
+			// Cancelling puts the units back on the variants, and into the cart
+			w = request("POST", fmt.Sprintf("/api/orders/%d/cancel", order.ID), token, `{"reason": "Wrong size", "restore_cart": true}`)
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			db.First(&small, small.ID)
+			Expect(small.Stock).To(Equal(uint(2)))
+
+			w = request("GET", "/api/carts", token, "")
+			var carts []Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			lines := carts[0].Items
+			Expect(lines).To(HaveLen(2))
+			Expect(*lines[0].VariantID).To(Equal(small.ID))
+			Expect(lines[0].Quantity).To(Equal(uint(2)))
+			Expect(*lines[1].VariantID).To(Equal(large.ID))
+		})
+
+		It("should take archived variants out of carts", func() {
+			Expect(addToCart(small.ID).Code).To(Equal(http.StatusCreated))
+			Expect(addToCart(large.ID).Code).To(Equal(http.StatusCreated))
+
+			w := request("DELETE", fmt.Sprintf("/api/items/%d/variants/%d", item.ID, small.ID), adminToken, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			w = request("GET", "/api/carts", token, "")
+			var carts []Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts[0].Items).To(HaveLen(1))
+			Expect(*carts[0].Items[0].VariantID).To(Equal(large.ID))
+
+			Expect(addToCart(small.ID).Code).To(Equal(http.StatusNotFound))
+
+			w = request("GET", fmt.Sprintf("/api/items/%d", item.ID), "", "")
+			var fetched Item
+			json.Unmarshal(w.Body.Bytes(), &fetched)
+			Expect(fetched.Variants).To(HaveLen(1))
+		})
+	})
+
+	Describe("Item images", func() {
+		var item Item
+
+		upload := func(token string, filename string, data []byte) *httptest.ResponseRecorder {
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, err := form.CreateFormFile("image", filename)
+			Expect(err).NotTo(HaveOccurred())
+			part.Write(data)
+			Expect(form.Close()).To(Succeed())
+
+			req := httptest.NewRequest("POST", fmt.Sprintf("/api/items/%d/images", item.ID), &body)
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		fetch := func(url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+			return w
+		}
+
+		photo := func(width int, height int) []byte {
+			img := image.NewRGBA(image.Rect(0, 0, width, height))
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+				}
+			}
+			var data bytes.Buffer
+			Expect(jpeg.Encode(&data, img, nil)).To(Succeed())
+			return data.Bytes()
+		}
+
+		BeforeEach(func() {
+			item = Item{Name: "Lamp", Price: NewMoney(3500, DefaultCurrency), Category: "Home & Garden", Stock: 10}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+		})
+
+		It("should store an upload with a thumbnail and list it with the item", func() {
+			w := upload(adminToken, "lamp.jpg", photo(800, 400))
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			var uploaded ItemImage
+			json.Unmarshal(w.Body.Bytes(), &uploaded)
+			Expect(uploaded.ContentType).To(Equal("image/jpeg"))
+			Expect(uploaded.Width).To(Equal(800))
+			Expect(uploaded.Height).To(Equal(400))
+			Expect(uploaded.URL).To(HavePrefix("/api/images/"))
+
+			w = fetch(uploaded.URL)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("image/jpeg"))
+			Expect(w.Body.Len()).To(Equal(uploaded.Size))
+
+			w = fetch(uploaded.ThumbnailURL)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			thumbnail, _, err := image.DecodeConfig(w.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(thumbnail.Width).To(Equal(ThumbnailSize))
+			Expect(thumbnail.Height).To(Equal(ThumbnailSize / 2))
+
+			w = fetch(fmt.Sprintf("/api/items/%d", item.ID))
+			var fetched Item
+			json.Unmarshal(w.Body.Bytes(), &fetched)
+			Expect(fetched.Images).To(HaveLen(1))
+			Expect(fetched.Images[0].ThumbnailURL).To(Equal(uploaded.ThumbnailURL))
+		})
+
+		It("should keep transparent images as PNG thumbnails", func() {
+			img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+			img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+			var data bytes.Buffer
+			Expect(png.Encode(&data, img)).To(Succeed())
+
+			// The name claims a JPEG; the content decides
+			w := upload(adminToken, "dot.jpg", data.Bytes())
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			var uploaded ItemImage
+			json.Unmarshal(w.Body.Bytes(), &uploaded)
+			Expect(uploaded.ContentType).To(Equal("image/png"))
+			Expect(uploaded.URL).To(HaveSuffix(".png"))
+
+			w = fetch(uploaded.ThumbnailURL)
+			Expect(w.Header().Get("Content-Type")).To(Equal("image/png"))
+			thumbnail, err := png.Decode(w.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(thumbnail.Bounds().Dx()).To(Equal(10))
+			_, _, _, alpha := thumbnail.At(5, 5).RGBA()
+			Expect(alpha).To(BeZero())
+		})
+
+		It("should refuse files that are not images or are too large", func() {
+			Expect(upload(adminToken, "notes.png", []byte("just some text")).Code).To(Equal(http.StatusUnsupportedMediaType))
+			Expect(upload(adminToken, "broken.png", []byte("\x89PNG\r\n\x1a\nnot really")).Code).To(Equal(http.StatusBadRequest))
+			Expect(upload(adminToken, "huge.jpg", bytes.Repeat([]byte{0xff}, MaxImageBytes+1)).Code).To(Equal(http.StatusRequestEntityTooLarge))
+
+			user := User{Username: "browser", Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upload(token, "lamp.jpg", photo(10, 10)).Code).To(Equal(http.StatusForbidden))
+
+			var count int
+			db.Model(&ItemImage{}).Count(&count)
+			Expect(count).To(BeZero())
+		})
+
+		It("should delete an image and its files", func() {
+			w := upload(adminToken, "lamp.jpg", photo(20, 20))
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var uploaded ItemImage
+			json.Unmarshal(w.Body.Bytes(), &uploaded)
+
+			req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/items/%d/images/%d", item.ID, uploaded.ID), nil)
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			Expect(fetch(uploaded.URL).Code).To(Equal(http.StatusNotFound))
+			Expect(fetch(uploaded.ThumbnailURL).Code).To(Equal(http.StatusNotFound))
+			Expect(fetch("/api/images/..%2Fmain.go").Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Reviews", func() {
+		var item, other Item
+
+		request := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		// customer signs up a user who bought item in an order with status,
+		// or bought nothing when status is empty
+		customer := func(username string, status string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+
+			if status != "" {
+				order := Order{UserID: user.ID, Status: status, Total: item.Price, Items: []OrderItem{
+					{ItemID: item.ID, Quantity: 1, Price: item.Price},
+				}}
+				Expect(db.Create(&order).Error).NotTo(HaveOccurred())
+			}
+			return token
+		}
+
+		review := func(token string, body string) Review {
+			w := request("POST", fmt.Sprintf("/api/items/%d/reviews", item.ID), token, body)
+			Expect(w.Code).To(Equal(http.StatusCreated), w.Body.String())
+			var created Review
+			json.Unmarshal(w.Body.Bytes(), &created)
+			return created
+		}
+
+		reload := func() Item {
+			var reloaded Item
+			Expect(db.First(&reloaded, item.ID).Error).NotTo(HaveOccurred())
+			return reloaded
+		}
+
+		listed := func(query string) []Review {
+			w := request("GET", fmt.Sprintf("/api/items/%d/reviews%s", item.ID, query), "", "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			var reviews []Review
+			json.Unmarshal(w.Body.Bytes(), &reviews)
+			return reviews
+		}
+
+		BeforeEach(func() {
+			item = Item{Name: "Kettle", Price: NewMoney(4000, DefaultCurrency), Category: "Home & Garden", Stock: 10}
+			Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+			other = Item{Name: "Teapot", Price: NewMoney(2500, DefaultCurrency), Category: "Home & Garden", Stock: 10}
+			Expect(db.Create(&other).Error).NotTo(HaveOccurred())
+		})
+
+		It("should only let customers who received the item review it", func() {
+			url := fmt.Sprintf("/api/items/%d/reviews", item.ID)
+			body := `{"rating": 4, "title": "Boils fast", "body": "Quiet too."}`
+			Expect(request("POST", url, customer("browser", ""), body).Code).To(Equal(http.StatusForbidden))
+			Expect(request("POST", url, customer("waiting", OrderPaid), body).Code).To(Equal(http.StatusForbidden))
+			Expect(request("POST", url, customer("refunded", OrderRefunded), body).Code).To(Equal(http.StatusForbidden))
+			Expect(request("POST", url, "", body).Code).To(Equal(http.StatusUnauthorized))
+
+			token := customer("buyer", OrderDelivered)
+			Expect(request("POST", url, token, `{"rating": 6, "title": "Great"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("POST", url, token, `{"rating": 5, "title": "   "}`).Code).To(Equal(http.StatusBadRequest))
+
+			created := review(token, body)
+			Expect(created.Author).To(Equal("buyer"))
+			Expect(created.Status).To(Equal(ReviewPublished))
+			Expect(request("POST", url, token, body).Code).To(Equal(http.StatusConflict))
+
+			// Bought in a fulfilled order that has not shipped yet
+			review(customer("early", OrderFulfilled), `{"rating": 3, "title": "Fine"}`)
+
+			Expect(reload().Rating).To(Equal(3.5))
+			Expect(reload().ReviewCount).To(Equal(uint(2)))
+			Expect(listed("")).To(HaveLen(2))
+		})
+
+		It("should sort items by rating", func() {
+			review(customer("fan", OrderShipped), `{"rating": 5, "title": "Love it"}`)
+			review(customer("critic", OrderShipped), `{"rating": 2, "title": "Leaks"}`)
+			Expect(reload().Rating).To(Equal(3.5))
+
+			// Rated items come before items nobody has reviewed
+			w := request("GET", "/api/items?sort=rating&order=desc&limit=1", "", "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			var page []Item
+			json.Unmarshal(w.Body.Bytes(), &page)
+			Expect(page).To(HaveLen(1))
+			Expect(page[0].ID).To(Equal(item.ID))
+			Expect(page[0].ReviewCount).To(Equal(uint(2)))
+
+			w = request("GET", "/api/items?sort=rating&order=desc&limit=1&cursor="+w.Header().Get("X-Next-Cursor"), "", "")
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			json.Unmarshal(w.Body.Bytes(), &page)
+			Expect(page).To(HaveLen(1))
+			Expect(page[0].ID).NotTo(Equal(item.ID))
+			Expect(page[0].Rating).To(BeZero())
+
+			reviews := listed("?sort=rating&order=asc")
+			Expect(reviews[0].Rating).To(Equal(2))
+			Expect(reviews[1].Rating).To(Equal(5))
+			Expect(request("GET", fmt.Sprintf("/api/items/%d/reviews?sort=stars", item.ID), "", "").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should count helpful votes once per customer", func() {
+			author := customer("author", OrderDelivered)
+			first := review(author, `{"rating": 4, "title": "Solid"}`)
+			second := review(customer("second", OrderDelivered), `{"rating": 3, "title": "Okay"}`)
+			voter := customer("voter", "")
+
+			url := fmt.Sprintf("/api/reviews/%d/helpful", first.ID)
+			Expect(request("POST", url, voter, "").Code).To(Equal(http.StatusOK))
+			w := request("POST", url, voter, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var voted Review
+			json.Unmarshal(w.Body.Bytes(), &voted)
+			Expect(voted.HelpfulCount).To(Equal(uint(1)))
+			Expect(request("POST", url, author, "").Code).To(Equal(http.StatusForbidden))
+
+			reviews := listed("?sort=helpful")
+			Expect(reviews[0].ID).To(Equal(first.ID))
+			Expect(reviews[1].ID).To(Equal(second.ID))
+
+			w = request("DELETE", url, voter, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &voted)
+			Expect(voted.HelpfulCount).To(BeZero())
+		})
+
+		It("should let moderators hide or approve flagged reviews", func() {
+			author := customer("author", OrderDelivered)
+			rant := review(author, `{"rating": 1, "title": "Spam spam spam"}`)
+			review(customer("calm", OrderDelivered), `{"rating": 5, "title": "Works well"}`)
+			Expect(reload().Rating).To(Equal(3.0))
+
+			flagURL := fmt.Sprintf("/api/reviews/%d/flag", rant.ID)
+			reader := customer("reader", "")
+			Expect(request("POST", flagURL, reader, `{"reason": ""}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("POST", flagURL, reader, `{"reason": "Advertising"}`).Code).To(Equal(http.StatusOK))
+			Expect(request("POST", flagURL, reader, `{"reason": "Again"}`).Code).To(Equal(http.StatusOK))
+			Expect(request("POST", flagURL, customer("another", ""), `{"reason": "Off topic"}`).Code).To(Equal(http.StatusOK))
+
+			Expect(request("GET", "/api/reviews/flagged", reader, "").Code).To(Equal(http.StatusForbidden))
+			w := request("GET", "/api/reviews/flagged", adminToken, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var flagged []Review
+			json.Unmarshal(w.Body.Bytes(), &flagged)
+			Expect(flagged).To(HaveLen(1))
+			Expect(flagged[0].FlagCount).To(Equal(uint(2)))
+			Expect(flagged[0].Flags[0].Reason).To(Equal("Advertising"))
+
+			moderationURL := fmt.Sprintf("/api/reviews/%d/moderation", rant.ID)
+			Expect(request("PUT", moderationURL, reader, `{"status": "hidden"}`).Code).To(Equal(http.StatusForbidden))
+			Expect(request("PUT", moderationURL, adminToken, `{"status": "deleted"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(request("PUT", moderationURL, adminToken, `{"status": "hidden"}`).Code).To(Equal(http.StatusOK))
+			Expect(reload().Rating).To(Equal(5.0))
+			Expect(reload().ReviewCount).To(Equal(uint(1)))
+			Expect(listed("")).To(HaveLen(1))
+			Expect(request("POST", fmt.Sprintf("/api/reviews/%d/helpful", rant.ID), reader, "").Code).To(Equal(http.StatusNotFound))
+
+			// Approved reviews leave the queue until they are edited
+			Expect(request("PUT", moderationURL, adminToken, `{"status": "approved"}`).Code).To(Equal(http.StatusOK))
+			Expect(reload().ReviewCount).To(Equal(uint(2)))
+			w = request("GET", "/api/reviews/flagged", adminToken, "")
+			json.Unmarshal(w.Body.Bytes(), &flagged)
+			Expect(flagged).To(BeEmpty())
+
+			w = request("PUT", fmt.Sprintf("/api/reviews/%d", rant.ID), author, `{"rating": 1, "title": "Buy my stuff"}`)
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			w = request("GET", "/api/reviews/flagged", adminToken, "")
+			json.Unmarshal(w.Body.Bytes(), &flagged)
+			Expect(flagged).To(HaveLen(1))
+		})
+
+		It("should let authors edit and delete only their own reviews", func() {
+			author := customer("author", OrderDelivered)
+			written := review(author, `{"rating": 2, "title": "Meh"}`)
+			stranger := customer("stranger", OrderDelivered)
+			Expect(request("PUT", fmt.Sprintf("/api/reviews/%d", written.ID), stranger, `{"rating": 5, "title": "Hacked"}`).Code).To(Equal(http.StatusNotFound))
+			Expect(request("DELETE", fmt.Sprintf("/api/reviews/%d", written.ID), stranger, "").Code).To(Equal(http.StatusNotFound))
+
+			w := request("PATCH", fmt.Sprintf("/api/reviews/%d", written.ID), author, `{"rating": 4, "title": "Grew on me"}`)
+			Expect(w.Code).To(Equal(http.StatusOK), w.Body.String())
+			Expect(reload().Rating).To(Equal(4.0))
+
+			Expect(request("POST", fmt.Sprintf("/api/reviews/%d/helpful", written.ID), stranger, "").Code).To(Equal(http.StatusOK))
+			Expect(request("DELETE", fmt.Sprintf("/api/reviews/%d", written.ID), author, "").Code).To(Equal(http.StatusOK))
+			Expect(reload().Rating).To(BeZero())
+			Expect(reload().ReviewCount).To(BeZero())
+
+			var votes int
+			db.Model(&ReviewVote{}).Count(&votes)
+			Expect(votes).To(BeZero())
+
+			// The author may review the item again
+			review(author, `{"rating": 3, "title": "Second look"}`)
+		})
+	})
+
+	Describe("Money", func() {
+		DescribeTable("reading amounts from JSON",
+			func(input string, expected Money) {
+				var money Money
+				Expect(json.Unmarshal([]byte(input), &money)).To(Succeed())
+				Expect(money).To(Equal(expected))
+			},
+			Entry("a number", `12.99`, NewMoney(1299, "USD")),
+			Entry("a whole number", `20`, NewMoney(2000, "USD")),
+			Entry("a string", `"0.1"`, NewMoney(10, "USD")),
+			Entry("an object", `{"amount": "1200", "currency": "JPY"}`, NewMoney(1200, "JPY")),
+			Entry("an object with a number", `{"amount": 5.5, "currency": "eur"}`, NewMoney(550, "EUR")),
+		)
+
+		DescribeTable("rejecting invalid amounts",
+			func(input string) {
+				var money Money
+				Expect(json.Unmarshal([]byte(input), &money)).NotTo(Succeed())
+			},
+			Entry("too many decimals", `"12.999"`),
+			Entry("decimals on a currency without minor units", `{"amount": "1.5", "currency": "JPY"}`),
+			Entry("an unknown currency", `{"amount": "1", "currency": "XXX"}`),
+			Entry("text", `"twelve"`),
+			Entry("a trailing point", `"1."`),
+		)
+
+		DescribeTable("writing amounts as decimal strings",
+			func(money Money, expected string) {
+				data, err := json.Marshal(money)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal(expected))
+			},
+			Entry("dollars", NewMoney(219998, "USD"), `{"amount":"2199.98","currency":"USD"}`),
+			Entry("cents", NewMoney(-5, "USD"), `{"amount":"-0.05","currency":"USD"}`),
+			Entry("yen", NewMoney(1200, "JPY"), `{"amount":"1200","currency":"JPY"}`),
+			Entry("dinar", NewMoney(1234, "KWD"), `{"amount":"1.234","currency":"KWD"}`),
+		)
+
+		Describe("Checkout", func() {
+			var token string
+
+			addToCart := func(item Item) *httptest.ResponseRecorder {
+				Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+
+				req := httptest.NewRequest("POST", "/api/carts", bytes.NewBufferString(fmt.Sprintf(`{"item_id": %d}`, item.ID)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			BeforeEach(func() {
+				req := httptest.NewRequest("POST", "/api/users", bytes.NewBufferString(`{"username": "buyer", "password": "password123"}`))
+				req.Header.Set("Content-Type", "application/json")
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				var response LoginResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				token = response.Token
+			})
+
+			It("should total orders exactly", func() {
+				Expect(addToCart(Item{Name: "MacBook Pro", Price: NewMoney(129999, "USD"), Category: "Electronics", Stock: 1}).Code).To(Equal(http.StatusCreated))
+				w := addToCart(Item{Name: "iPhone 15", Price: NewMoney(89999, "USD"), Category: "Electronics", Stock: 1})
+				Expect(w.Code).To(Equal(http.StatusCreated))
+
+				var cart Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				Expect(cart.Total).To(Equal(NewMoney(219998, "USD")))
+
+				req := httptest.NewRequest("POST", "/api/orders", bytes.NewBufferString(fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, cart.ID)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+
+				var order Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				Expect(order.Total).To(Equal(NewMoney(219998, "USD")))
+
+				var stored Order
+				db.First(&stored, order.ID)
+				Expect(stored.Total).To(Equal(NewMoney(219998, "USD")))
+			})
+
+			It("should not mix currencies in one cart", func() {
+				Expect(addToCart(Item{Name: "Tea", Price: NewMoney(500, "USD"), Category: "Food", Stock: 1}).Code).To(Equal(http.StatusCreated))
+				Expect(addToCart(Item{Name: "Sencha", Price: NewMoney(800, "JPY"), Category: "Food", Stock: 1}).Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Describe("Inventory", func() {
+		// signIn creates a customer with a session and returns its token
+		signIn := func(db *gorm.DB, username string) string {
+			user := User{Username: username, Password: "unused", Role: RoleCustomer}
+			Expect(db.Create(&user).Error).NotTo(HaveOccurred())
+			session := Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+			Expect(db.Create(&session).Error).NotTo(HaveOccurred())
+
+			token, _, err := tokens.Issue(session, AccessToken)
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		request := func(router *gin.Engine, method string, url string, token string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		addToCart := func(router *gin.Engine, token string, itemID uint) *httptest.ResponseRecorder {
+			return request(router, "POST", "/api/carts", token, fmt.Sprintf(`{"item_id": %d}`, itemID))
+		}
+
+		checkout := func(router *gin.Engine, token string) *httptest.ResponseRecorder {
+			w := request(router, "GET", "/api/carts", token, "")
+			var carts []Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts).To(HaveLen(1))
+
+			return request(router, "POST", "/api/orders", token, fmt.Sprintf(`{"cart_id": %d, "payment_source": "tok_visa"}`, carts[0].ID))
+		}
+
+		Describe("Reservations", func() {
+			var item Item
+			var alice, bob string
+
+			BeforeEach(func() {
+				item = Item{Name: "Lamp", Price: NewMoney(2000, DefaultCurrency), Category: "Home", Stock: 2}
+				Expect(db.Create(&item).Error).NotTo(HaveOccurred())
+
+				alice = signIn(db, "alice")
+				bob = signIn(db, "bob")
+
+				Expect(addToCart(router, alice, item.ID).Code).To(Equal(http.StatusCreated))
+				Expect(addToCart(router, alice, item.ID).Code).To(Equal(http.StatusCreated))
+			})
+
+			It("should hold reserved units back from other carts", func() {
+				w := addToCart(router, bob, item.ID)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				var response map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response["available"]).To(BeNumerically("==", 0))
+				Expect(response["item_id"]).To(BeNumerically("==", item.ID))
+			})
+
+			It("should not let a cart grow past the available stock", func() {
+				w := addToCart(router, alice, item.ID)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				w = request(router, "PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), alice, `{"quantity": 3}`)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				var response map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response["available"]).To(BeNumerically("==", 2))
+			})
+
+			It("should release units when they leave the cart", func() {
+				w := request(router, "PUT", fmt.Sprintf("/api/carts/items/%d", item.ID), alice, `{"quantity": 1}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+				Expect(addToCart(router, bob, item.ID).Code).To(Equal(http.StatusCreated))
+				Expect(addToCart(router, bob, item.ID).Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should release units when the reservation expires", func() {
+				db.Model(&CartItem{}).Update("reserved_until", time.Now().Add(-time.Minute))
+
+				Expect(addToCart(router, bob, item.ID).Code).To(Equal(http.StatusCreated))
+				Expect(addToCart(router, bob, item.ID).Code).To(Equal(http.StatusCreated))
+
+				// Alice's lapsed units are gone by the time she checks out
+				w := checkout(router, alice)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should take checked out units out of stock", func() {
+				Expect(checkout(router, alice).Code).To(Equal(http.StatusCreated))
+
+				var updated Item
+				db.First(&updated, item.ID)
+				Expect(updated.Stock).To(BeZero())
+			})
+
+			It("should refuse checkout with the available quantity when stock ran short", func() {
+				w := request(router, "PATCH", fmt.Sprintf("/api/items/%d", item.ID), adminToken, `{"stock": 1}`)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				w = checkout(router, alice)
+				Expect(w.Code).To(Equal(http.StatusConflict))
+
+				var response CheckoutError
+				json.Unmarshal(w.Body.Bytes(), &response)
+				Expect(response.Step).To(Equal("update_stock"))
+				Expect(response.ItemID).To(Equal(item.ID))
+				Expect(response.Available).NotTo(BeNil())
+				Expect(*response.Available).To(BeNumerically("==", 1))
+
+				// Nothing was sold and the cart is intact
+				var orderCount, cartItemCount int
+				db.Model(&Order{}).Count(&orderCount)
+				db.Model(&CartItem{}).Count(&cartItemCount)
+				Expect(orderCount).To(BeZero())
+				Expect(cartItemCount).To(Equal(1))
+
+				var updated Item
+				db.First(&updated, item.ID)
+				Expect(updated.Stock).To(BeNumerically("==", 1))
+			})
+		})
+
+		// These run against a database file so that requests really do run on
+		// separate connections at the same time
+		Describe("Concurrency", func() {
+			const shoppers = 12
+			var fileDB *gorm.DB
+			var fileRouter *gin.Engine
+			var item Item
+			var shopperTokens []string
+
+			BeforeEach(func() {
+				var err error
+				fileDB, err = gorm.Open("sqlite3", filepath.Join(GinkgoT().TempDir(), "race.db")+"?_busy_timeout=5000&_txlock=immediate")
+				Expect(err).NotTo(HaveOccurred())
+				fileDB.AutoMigrate(&User{}, &Session{}, &Address{}, &Item{}, &ItemVariant{}, &ItemImage{}, &Review{}, &ReviewVote{}, &ReviewFlag{}, &Category{}, &Cart{}, &CartItem{}, &Wishlist{}, &WishlistItem{}, &Order{}, &OrderItem{}, &OrderStatusEvent{}, &Payment{}, &Promotion{}, &PromotionRedemption{}, &OrderDiscount{}, &OrderTax{}, &IdempotencyKey{})
+				fileRouter = newTestRouter(fileDB, tokens, payments)
+
+				item = Item{Name: "Concert Ticket", Price: NewMoney(5000, DefaultCurrency), Category: "Tickets", Stock: 5}
+				Expect(fileDB.Create(&item).Error).NotTo(HaveOccurred())
+
+				shopperTokens = nil
+				for i := 0; i < shoppers; i++ {
+					shopperTokens = append(shopperTokens, signIn(fileDB, fmt.Sprintf("shopper%d", i)))
+				}
+			})
+
+			AfterEach(func() {
+				fileDB.Close()
+			})
+
+			// concurrently runs fn for every shopper at once and returns the
+			// response codes
+			concurrently := func(fn func(token string) int) []int {
+				codes := make([]int, shoppers)
+				var wg sync.WaitGroup
+				for i, token := range shopperTokens {
+					wg.Add(1)
+					go func(i int, token string) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						codes[i] = fn(token)
+					}(i, token)
+				}
+				wg.Wait()
+				return codes
+			}
+
+			It("should reserve no more than the stock", func() {
+				codes := concurrently(func(token string) int {
+					return addToCart(fileRouter, token, item.ID).Code
+				})
+
+				Expect(codes).To(HaveLen(shoppers))
+				Expect(codes).To(ContainElements(http.StatusCreated, http.StatusConflict))
+				created := 0
+				for _, code := range codes {
+					Expect(code).To(BeElementOf(http.StatusCreated, http.StatusConflict))
+					if code == http.StatusCreated {
+						created++
+					}
+				}
+				Expect(created).To(Equal(5))
+			})
+
+			It("should keep concurrent adds to one cart within the item's limit", func() {
+				fileDB.Model(&item).Updates(map[string]interface{}{"stock": 100, "max_quantity": 3})
+
+				codes := make([]int, shoppers)
+				var wg sync.WaitGroup
+				for i := range codes {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						codes[i] = addToCart(fileRouter, shopperTokens[0], item.ID).Code
+					}(i)
+				}
+				wg.Wait()
+
+				added := 0
+				for _, code := range codes {
+					Expect(code).To(BeElementOf(http.StatusCreated, http.StatusBadRequest))
+					if code == http.StatusCreated {
+						added++
+					}
+				}
+				Expect(added).To(Equal(3))
+
+				// One cart with every unit that was added
+				var carts []Cart
+				fileDB.Preload("Items").Find(&carts)
+				Expect(carts).To(HaveLen(1))
+				Expect(carts[0].Items).To(HaveLen(1))
+				Expect(carts[0].Items[0].Quantity).To(BeNumerically("==", 3))
+			})
+
+			It("should never sell more than the stock", func() {
+				// Every shopper gets a unit into their cart, then the
+				// reservations lapse so all checkouts race for the stock
+				fileDB.Model(&item).Update("stock", shoppers)
+				concurrently(func(token string) int {
+					return addToCart(fileRouter, token, item.ID).Code
+				})
+				fileDB.Model(&item).Update("stock", 5)
+				fileDB.Model(&CartItem{}).Update("reserved_until", time.Now().Add(-time.Minute))
+
+				codes := concurrently(func(token string) int {
+					return checkout(fileRouter, token).Code
+				})
+
+				sold := 0
+				for _, code := range codes {
+					Expect(code).To(BeElementOf(http.StatusCreated, http.StatusConflict))
+					if code == http.StatusCreated {
+						sold++
+					}
+				}
+				Expect(sold).To(Equal(5))
+
+				var updated Item
+				fileDB.First(&updated, item.ID)
+				Expect(updated.Stock).To(BeZero())
+
+				var orderItemCount int
+				fileDB.Model(&OrderItem{}).Count(&orderItemCount)
+				Expect(orderItemCount).To(Equal(5))
+			})
+		})
+	})
+})
+
+// newTestRouter wires the API routes the same way main does. Payment
+// provider calls time out quickly so timeouts can be tested.
+func newTestRouter(db *gorm.DB, tokens *TokenService, payments PaymentProvider) *gin.Engine {
+	// Orders are untaxed unless a test picks a tax region
+	taxes := DefaultTaxTable()
+	taxes.DefaultRegion = "US-OR"
+
+	router := gin.New()
+	setupRouter(router, db, RouterConfig{
+		Tokens:            tokens,
+		IdempotencyWindow: time.Hour,
+		Taxes:             taxes,
+		Shipping:          DefaultShippingTable(),
+		Images:            &DiskImageStore{Dir: GinkgoT().TempDir(), BaseURL: "/api/images"},
+		Payments:          payments,
+		PaymentTimeout:    50 * time.Millisecond,
+	})
+	return router
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -13,6 +19,11 @@ func main() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	initialStock, err := initialStockFromEnv()
+	if err != nil {
+		log.Fatal("Failed to read initial stock:", err)
+	}
+
 	// Add quantity column to cart_items table
 	err = db.Exec("ALTER TABLE cart_items ADD COLUMN quantity INTEGER DEFAULT 1").Error
 	if err != nil {
@@ -29,5 +40,406 @@ func main() {
 		log.Println("Successfully updated existing cart items with quantity 1")
 	}
 
+	// Add quantity and subtotal columns to order_items table
+	err = db.Exec("ALTER TABLE order_items ADD COLUMN quantity INTEGER NOT NULL DEFAULT 1").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added quantity column to order_items table")
+	}
+
+	// Subtotals in cents replace the float subtotal below, so once they exist
+	// the float column must not come back
+	if !db.Dialect().HasColumn("order_items", "subtotal_amount") {
+		err = db.Exec("ALTER TABLE order_items ADD COLUMN subtotal REAL").Error
+		if err != nil {
+			log.Println("Column might already exist or error occurred:", err)
+		} else {
+			log.Println("Successfully added subtotal column to order_items table")
+		}
+
+		// Order items written before quantities existed got the default
+		// quantity of 1 above. That matches what was charged, as checkout
+		// charged each row's price once whatever the cart quantity was, so
+		// their subtotal is the unit price they already store. Rows are not
+		// folded together: an item an order holds in several rows stays
+		// several lines of one unit each, and such orders are reported here.
+		var repeatedOrders int
+		err = db.Raw("SELECT COUNT(DISTINCT order_id) FROM (SELECT order_id FROM order_items GROUP BY order_id, item_id HAVING COUNT(*) > 1)").Row().Scan(&repeatedOrders)
+		if err != nil {
+			log.Println("Error checking order items for repeated items:", err)
+		} else if repeatedOrders > 0 {
+			log.Printf("%d orders list an item in more than one row; each row is kept as a line of quantity 1", repeatedOrders)
+		}
+
+		err = db.Exec("UPDATE order_items SET subtotal = price * quantity WHERE subtotal IS NULL").Error
+		if err != nil {
+			log.Println("Error updating existing order item subtotals:", err)
+		} else {
+			log.Println("Successfully backfilled order item subtotals")
+		}
+
+		// Recompute order totals from their lines
+		err = db.Exec("UPDATE orders SET total = (SELECT COALESCE(SUM(subtotal), 0) FROM order_items WHERE order_items.order_id = orders.id)").Error
+		if err != nil {
+			log.Println("Error recomputing order totals:", err)
+		} else {
+			log.Println("Successfully recomputed order totals from order items")
+		}
+	}
+
+	// Create categories table and link items to it
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS categories (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		slug VARCHAR(255) NOT NULL UNIQUE,
+		name VARCHAR(255) NOT NULL,
+		parent_id INTEGER,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`).Error
+	if err != nil {
+		log.Println("Error creating categories table:", err)
+	} else {
+		log.Println("Successfully created categories table")
+	}
+
+	err = db.Exec("ALTER TABLE items ADD COLUMN category_id INTEGER").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added category_id column to items table")
+	}
+
+	// Create a category for every category name already used by an item
+	var categoryNames []string
+	err = db.Table("items").Where("category <> '' AND category_id IS NULL").Pluck("DISTINCT category", &categoryNames).Error
+	if err != nil {
+		log.Println("Error reading existing item categories:", err)
+	}
+
+	slugPattern := regexp.MustCompile(`[^a-z0-9]+`)
+	for _, name := range categoryNames {
+		slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+
+		err = db.Exec("INSERT OR IGNORE INTO categories (slug, name, created_at, updated_at) VALUES (?, ?, datetime('now'), datetime('now'))", slug, name).Error
+		if err != nil {
+			log.Println("Error creating category", name+":", err)
+			continue
+		}
+
+		err = db.Exec("UPDATE items SET category_id = (SELECT id FROM categories WHERE slug = ?) WHERE category = ? AND category_id IS NULL", slug, name).Error
+		if err != nil {
+			log.Println("Error linking items to category", name+":", err)
+		} else {
+			log.Println("Successfully linked items to category", name)
+		}
+	}
+
+	// Add role column to users table; existing users become customers
+	err = db.Exec("ALTER TABLE users ADD COLUMN role VARCHAR(255) NOT NULL DEFAULT 'customer'").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added role column to users table")
+	}
+
+	var admins int
+	db.Table("users").Where("role = 'admin'").Count(&admins)
+	if admins == 0 {
+		log.Println("No admin users yet; grant one with: UPDATE users SET role = 'admin' WHERE username = '<username>'")
+	}
+
+	// Add stock tracking. Existing items start with initialStock units so the
+	// catalog stays on sale; set real stock levels with PATCH /api/items/:id.
+	if !db.Dialect().HasColumn("items", "stock") {
+		err = db.Exec("ALTER TABLE items ADD COLUMN stock INTEGER NOT NULL DEFAULT 0").Error
+		if err == nil {
+			err = db.Exec("UPDATE items SET stock = ?", initialStock).Error
+		}
+		if err != nil {
+			log.Println("Error adding stock column to items table:", err)
+		} else {
+			log.Println("Successfully added stock column to items table with", initialStock, "units of every item; set stock levels with PATCH /api/items/:id")
+		}
+	}
+
+	err = db.Exec("ALTER TABLE cart_items ADD COLUMN reserved_until DATETIME").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added reserved_until column to cart_items table")
+	}
+
+	// Add order status; existing orders start out pending
+	err = db.Exec("ALTER TABLE orders ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT 'pending'").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added status column to orders table")
+	}
+
+	// Add the reason a cancelled order was cancelled
+	err = db.Exec("ALTER TABLE orders ADD COLUMN cancel_reason VARCHAR(255)").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added cancel_reason column to orders table")
+	}
+
+	// Convert float prices and totals to integer cents. Existing amounts are
+	// all in US dollars.
+	moneyColumns := []struct{ table, column string }{
+		{"items", "price"},
+		{"orders", "total"},
+		{"order_items", "price"},
+		{"order_items", "subtotal"},
+	}
+	for _, money := range moneyColumns {
+		if err := migrateMoneyColumn(db, money.table, money.column); err != nil {
+			log.Println("Error converting", money.table+"."+money.column, "to cents:", err)
+		}
+	}
+
+	// Add the coupon applied to a cart
+	err = db.Exec("ALTER TABLE carts ADD COLUMN promotion_id INTEGER").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added promotion_id column to carts table")
+	}
+
+	// Add order subtotals before discounts. Orders placed before coupons
+	// existed had no discounts, so their subtotal is their total. A subtotal
+	// is never below its total, so only orders still at zero need filling in,
+	// including when the server added the columns first.
+	if !db.Dialect().HasColumn("orders", "subtotal_amount") {
+		err = db.Exec("ALTER TABLE orders ADD COLUMN subtotal_amount BIGINT NOT NULL DEFAULT 0").Error
+		if err == nil {
+			err = db.Exec("ALTER TABLE orders ADD COLUMN subtotal_currency VARCHAR(255) NOT NULL DEFAULT 'USD'").Error
+		}
+		if err != nil {
+			log.Println("Error adding subtotal columns to orders table:", err)
+		}
+	}
+	result := db.Exec("UPDATE orders SET subtotal_amount = total_amount, subtotal_currency = total_currency WHERE subtotal_amount = 0")
+	if result.Error != nil {
+		log.Println("Error filling in order subtotals:", result.Error)
+	} else {
+		log.Println("Filled in subtotals of", result.RowsAffected, "orders")
+	}
+
+	// Add free shipping earned by a coupon
+	err = db.Exec("ALTER TABLE orders ADD COLUMN free_shipping BOOLEAN NOT NULL DEFAULT false").Error
+	if err != nil {
+		log.Println("Column might already exist or error occurred:", err)
+	} else {
+		log.Println("Successfully added free_shipping column to orders table")
+	}
+
+	// Add the tax charged on orders and their lines. Orders placed before
+	// taxes were charged keep a tax of zero.
+	taxColumns := []struct{ table, column, definition string }{
+		{"orders", "tax_region", "VARCHAR(255)"},
+		{"orders", "prices_include_tax", "BOOLEAN NOT NULL DEFAULT false"},
+		{"orders", "tax_total_amount", "BIGINT NOT NULL DEFAULT 0"},
+		{"orders", "tax_total_currency", "VARCHAR(255) NOT NULL DEFAULT 'USD'"},
+		{"order_items", "tax_rate", "BIGINT NOT NULL DEFAULT 0"},
+		{"order_items", "tax_amount", "BIGINT NOT NULL DEFAULT 0"},
+		{"order_items", "tax_currency", "VARCHAR(255) NOT NULL DEFAULT 'USD'"},
+	}
+	for _, tax := range taxColumns {
+		if db.Dialect().HasColumn(tax.table, tax.column) {
+			continue
+		}
+		err = db.Exec("ALTER TABLE " + tax.table + " ADD COLUMN " + tax.column + " " + tax.definition).Error
+		if err != nil {
+			log.Println("Error adding", tax.table+"."+tax.column, "column:", err)
+		} else {
+			log.Println("Successfully added", tax.column, "column to", tax.table, "table")
+		}
+	}
+
+	// Add item weights and the addresses and shipping of orders. Orders
+	// placed before shipping was charged keep no address and a cost of zero.
+	shippingColumns := []struct{ table, column, definition string }{
+		{"items", "weight_grams", "INTEGER NOT NULL DEFAULT 0"},
+		{"orders", "shipping_address_id", "INTEGER"},
+		{"orders", "billing_address_id", "INTEGER"},
+		{"orders", "shipping_method", "VARCHAR(255)"},
+		{"orders", "shipping_cost_amount", "BIGINT NOT NULL DEFAULT 0"},
+		{"orders", "shipping_cost_currency", "VARCHAR(255) NOT NULL DEFAULT 'USD'"},
+	}
+	for _, prefix := range []string{"shipping_", "billing_"} {
+		for _, field := range []string{"name", "line1", "line2", "city", "region", "postal_code", "country", "phone"} {
+			shippingColumns = append(shippingColumns, struct{ table, column, definition string }{"orders", prefix + field, "VARCHAR(255)"})
+		}
+	}
+	for _, shipping := range shippingColumns {
+		if db.Dialect().HasColumn(shipping.table, shipping.column) {
+			continue
+		}
+		err = db.Exec("ALTER TABLE " + shipping.table + " ADD COLUMN " + shipping.column + " " + shipping.definition).Error
+		if err != nil {
+			log.Println("Error adding", shipping.table+"."+shipping.column, "column:", err)
+		} else {
+			log.Println("Successfully added", shipping.column, "column to", shipping.table, "table")
+		}
+	}
+
+	// Let carts belong to a guest until they sign in
+	if !db.Dialect().HasColumn("carts", "guest_id") {
+		if err := db.Exec("ALTER TABLE carts ADD COLUMN guest_id VARCHAR(255)").Error; err != nil {
+			log.Println("Error adding guest_id column to carts table:", err)
+		} else if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_carts_guest_id ON carts(guest_id)").Error; err != nil {
+			log.Println("Error indexing carts.guest_id:", err)
+		} else {
+			log.Println("Successfully added guest_id column to carts table")
+		}
+	}
+
+	// Record the price cart lines were added at. Lines added before take the
+	// item's current price, so they are not flagged as changed.
+	for _, column := range []struct{ name, definition string }{
+		{"price_amount", "BIGINT NOT NULL DEFAULT 0"},
+		{"price_currency", "VARCHAR(255) NOT NULL DEFAULT 'USD'"},
+	} {
+		if db.Dialect().HasColumn("cart_items", column.name) {
+			continue
+		}
+		if err := db.Exec("ALTER TABLE cart_items ADD COLUMN " + column.name + " " + column.definition).Error; err != nil {
+			log.Println("Error adding", column.name, "column to cart_items table:", err)
+		} else {
+			log.Println("Successfully added", column.name, "column to cart_items table")
+		}
+	}
+	err = db.Exec(`UPDATE cart_items SET
+		price_amount = (SELECT price_amount FROM items WHERE items.id = cart_items.item_id),
+		price_currency = (SELECT price_currency FROM items WHERE items.id = cart_items.item_id)
+		WHERE price_amount = 0 AND EXISTS (SELECT 1 FROM items WHERE items.id = cart_items.item_id)`).Error
+	if err != nil {
+		log.Println("Error backfilling cart item prices:", err)
+	} else {
+		log.Println("Successfully backfilled cart item prices")
+	}
+
+	// Let cart, wishlist and order lines and order discounts name a variant of
+	// their item. Rows from before variants have none, and order lines keep
+	// an empty SKU.
+	for _, variant := range []struct{ table, column, definition string }{
+		{"cart_items", "variant_id", "INTEGER"},
+		{"wishlist_items", "variant_id", "INTEGER"},
+		{"order_items", "variant_id", "INTEGER"},
+		{"order_items", "sku", "VARCHAR(255)"},
+		{"order_items", "options", "TEXT"},
+		{"order_discounts", "variant_id", "INTEGER"},
+	} {
+		if db.Dialect().HasColumn(variant.table, variant.column) {
+			continue
+		}
+		err = db.Exec("ALTER TABLE " + variant.table + " ADD COLUMN " + variant.column + " " + variant.definition).Error
+		if err != nil {
+			log.Println("Error adding", variant.table+"."+variant.column, "column:", err)
+		} else {
+			log.Println("Successfully added", variant.column, "column to", variant.table, "table")
+		}
+	}
+	if err := db.Exec("CREATE INDEX IF NOT EXISTS idx_cart_items_variant_id ON cart_items(variant_id)").Error; err != nil {
+		log.Println("Error indexing cart_items.variant_id:", err)
+	}
+
+	// Let items carry their average rating and review count. Reviews are
+	// new, so every item starts without any.
+	for _, column := range []struct{ name, definition string }{
+		{"rating", "REAL NOT NULL DEFAULT 0"},
+		{"review_count", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if db.Dialect().HasColumn("items", column.name) {
+			continue
+		}
+		if err := db.Exec("ALTER TABLE items ADD COLUMN " + column.name + " " + column.definition).Error; err != nil {
+			log.Println("Error adding", column.name, "column to items table:", err)
+		} else {
+			log.Println("Successfully added", column.name, "column to items table")
+		}
+	}
+
 	log.Println("Migration completed successfully!")
+}
+
+// DefaultInitialStock is the stock existing items start with when stock
+// tracking is added, the same as the sample items are seeded with
+const DefaultInitialStock = 50
+
+// initialStockFromEnv reads the stock existing items start with from
+// INITIAL_STOCK, defaulting to DefaultInitialStock
+func initialStockFromEnv() (uint, error) {
+	value := os.Getenv("INITIAL_STOCK")
+	if value == "" {
+		return DefaultInitialStock, nil
+	}
+
+	stock, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid INITIAL_STOCK %q", value)
+	}
+	return uint(stock), nil
+}
+
+// migrateMoneyColumn replaces a float column with <column>_amount in cents and
+// <column>_currency. Only rows whose amount is still zero are converted, so
+// amounts the new server already wrote are kept. It refuses to convert when
+// any of those values has fractions of a cent, and checks that every one was
+// converted before dropping the float column.
+func migrateMoneyColumn(db *gorm.DB, table string, column string) error {
+	if !db.Dialect().HasColumn(table, column) {
+		log.Println("Column", table+"."+column, "already converted to cents")
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		amount, currency := column+"_amount", column+"_currency"
+
+		// The columns may already exist if the server was started first
+		if !tx.Dialect().HasColumn(table, amount) {
+			if err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + amount + " INTEGER NOT NULL DEFAULT 0").Error; err != nil {
+				return err
+			}
+		}
+		if !tx.Dialect().HasColumn(table, currency) {
+			if err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + currency + " VARCHAR(3) NOT NULL DEFAULT 'USD'").Error; err != nil {
+				return err
+			}
+		}
+
+		var lossy int
+		err := tx.Table(table).Where(amount + " = 0 AND " + column + " IS NOT NULL AND ABS(" + column + " * 100 - ROUND(" + column + " * 100)) > 0.000001").Count(&lossy).Error
+		if err != nil {
+			return err
+		}
+		if lossy > 0 {
+			return fmt.Errorf("%d rows have fractions of a cent; fix them before migrating", lossy)
+		}
+
+		err = tx.Exec("UPDATE " + table + " SET " + amount + " = CAST(ROUND(COALESCE(" + column + ", 0) * 100) AS INTEGER), " + currency + " = 'USD' WHERE " + amount + " = 0").Error
+		if err != nil {
+			return err
+		}
+
+		// A row still at zero must have had no amount to convert
+		var unconverted int
+		err = tx.Table(table).Where(amount + " = 0 AND ABS(COALESCE(" + column + ", 0)) > 0.000001").Count(&unconverted).Error
+		if err != nil {
+			return err
+		}
+		if unconverted > 0 {
+			return fmt.Errorf("%d rows did not convert", unconverted)
+		}
+
+		if err := tx.Exec("ALTER TABLE " + table + " DROP COLUMN " + column).Error; err != nil {
+			return err
+		}
+
+		log.Println("Successfully converted", table+"."+column, "to cents")
+		return nil
+	})
 } 
\ No newline at end of file
@@ -1,65 +1,521 @@
 package main
 
 import (
+	"fmt"
 	"time"
 )
 
-// User represents a user in the system
+// User represents a user in the system. Token is never stored; it carries a
+// freshly issued access token in responses.
 type User struct {
 	ID        uint      `json:"id" gorm:"primary_key"`
 	Username  string    `json:"username" gorm:"unique;not null"`
 	Password  string    `json:"password" gorm:"not null"`
-	Token     string    `json:"token" gorm:"unique"`
+	Token     string    `json:"token,omitempty" gorm:"-"`
+	Role      string    `json:"role" gorm:"not null;default:'customer'"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// Item represents a product in the store
+// User roles. New users are customers; only admins may change roles.
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// validRoles lists the roles a user may be given
+var validRoles = []string{RoleCustomer, RoleStaff, RoleAdmin}
+
+// HasRole reports whether the user has one of roles
+func (user User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Session is one signed-in device of a user. Every token carries its
+// session's ID, so revoking the session invalidates the tokens issued for it.
+type Session struct {
+	ID         uint       `json:"id" gorm:"primary_key"`
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	Device     string     `json:"device"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current" gorm:"-"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Active reports whether the session can still be used at now
+func (session Session) Active(now time.Time) bool {
+	return session.RevokedAt == nil && now.Before(session.ExpiresAt)
+}
+
+// Item represents a product in the store. Deleting an item archives it by
+// setting DeletedAt, so existing order items can still load it. An item with
+// Variants is bought by variant, and each variant keeps its own stock. The
+// first of its Images is its main image. Rating and ReviewCount sum up its
+// visible reviews.
 type Item struct {
-	ID          uint      `json:"id" gorm:"primary_key"`
-	Name        string    `json:"name" gorm:"not null"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price" gorm:"not null"`
-	Category    string    `json:"category" gorm:"not null"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          uint          `json:"id" gorm:"primary_key"`
+	Name        string        `json:"name" gorm:"not null"`
+	Description string        `json:"description"`
+	Price       Money         `json:"price" gorm:"embedded;embedded_prefix:price_"`
+	Category    string        `json:"category" gorm:"not null"`
+	CategoryID  *uint         `json:"category_id" gorm:"index"`
+	MaxQuantity uint          `json:"max_quantity"`
+	WeightGrams uint          `json:"weight_grams"`
+	Stock       uint          `json:"stock" gorm:"not null;default:0"`
+	Variants    []ItemVariant `json:"variants,omitempty" gorm:"foreignkey:ItemID"`
+	Images      []ItemImage   `json:"images,omitempty" gorm:"foreignkey:ItemID"`
+	Rating      float64       `json:"rating" gorm:"not null;default:0"`
+	ReviewCount uint          `json:"review_count" gorm:"not null;default:0"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	DeletedAt   *time.Time    `json:"deleted_at,omitempty" sql:"index"`
 }
 
-// Cart represents a user's shopping cart
-type Cart struct {
+// DefaultMaxQuantity is the most units of an item a cart line may hold when
+// the item does not set its own MaxQuantity
+const DefaultMaxQuantity = 10
+
+// QuantityLimit returns the most units of the item a single cart line may hold
+func (item Item) QuantityLimit() uint {
+	if item.MaxQuantity == 0 {
+		return DefaultMaxQuantity
+	}
+	return item.MaxQuantity
+}
+
+// ItemImage is a picture of an item kept in the image store with a
+// thumbnail. Key and ThumbnailKey name the stored files, and URL and
+// ThumbnailURL are where the store serves them.
+type ItemImage struct {
+	ID           uint      `json:"id" gorm:"primary_key"`
+	ItemID       uint      `json:"item_id" gorm:"not null;index"`
+	Key          string    `json:"-" gorm:"not null"`
+	ThumbnailKey string    `json:"-" gorm:"not null"`
+	URL          string    `json:"url" gorm:"not null"`
+	ThumbnailURL string    `json:"thumbnail_url" gorm:"not null"`
+	ContentType  string    `json:"content_type" gorm:"not null"`
+	Size         int       `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Review is a customer's rating of an item they bought, from 1 to 5. Each
+// customer reviews an item once. Author copies the reviewer's username;
+// HelpfulCount and FlagCount count the votes and flags of other customers,
+// and Flags is loaded for moderators.
+type Review struct {
+	ID           uint         `json:"id" gorm:"primary_key"`
+	ItemID       uint         `json:"item_id" gorm:"not null;unique_index:idx_reviews_item_user"`
+	UserID       uint         `json:"user_id" gorm:"not null;unique_index:idx_reviews_item_user"`
+	Author       string       `json:"author" gorm:"not null"`
+	Rating       int          `json:"rating" gorm:"not null"`
+	Title        string       `json:"title" gorm:"not null"`
+	Body         string       `json:"body" gorm:"type:text"`
+	HelpfulCount uint         `json:"helpful_count" gorm:"not null;default:0"`
+	FlagCount    uint         `json:"flag_count" gorm:"not null;default:0"`
+	Status       string       `json:"status" gorm:"not null;default:'published';index"`
+	Flags        []ReviewFlag `json:"flags,omitempty" gorm:"foreignkey:ReviewID"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// ReviewVote marks a review as helpful to a customer
+type ReviewVote struct {
 	ID        uint      `json:"id" gorm:"primary_key"`
-	UserID    uint      `json:"user_id" gorm:"not null"`
-	User      User      `json:"user" gorm:"foreignkey:UserID"`
-	Items     []CartItem `json:"items" gorm:"foreignkey:CartID"`
+	ReviewID  uint      `json:"review_id" gorm:"not null;unique_index:idx_review_votes_review_user"`
+	UserID    uint      `json:"user_id" gorm:"not null;unique_index:idx_review_votes_review_user"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// CartItem represents an item in a cart
-type CartItem struct {
-	ID       uint  `json:"id" gorm:"primary_key"`
-	CartID   uint  `json:"cart_id" gorm:"not null"`
-	ItemID   uint  `json:"item_id" gorm:"not null"`
-	Quantity uint  `json:"quantity" gorm:"default:1"`
-	Item     Item  `json:"item" gorm:"foreignkey:ItemID"`
+// ReviewFlag reports a review to the moderators
+type ReviewFlag struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	ReviewID  uint      `json:"review_id" gorm:"not null;unique_index:idx_review_flags_review_user"`
+	UserID    uint      `json:"user_id" gorm:"not null;unique_index:idx_review_flags_review_user"`
+	Reason    string    `json:"reason" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
-// Order represents a completed order
-type Order struct {
+// ItemVariant is one buyable version of an item, such as a size or colour,
+// with its own SKU and stock. PriceOverride replaces the item's price when
+// its amount is set; Price is what the variant costs either way. Deleting a
+// variant archives it like an item.
+type ItemVariant struct {
+	ID            uint           `json:"id" gorm:"primary_key"`
+	ItemID        uint           `json:"item_id" gorm:"not null;index"`
+	SKU           string         `json:"sku" gorm:"not null;unique_index"`
+	Options       VariantOptions `json:"options" gorm:"type:text"`
+	PriceOverride Money          `json:"price_override" gorm:"embedded;embedded_prefix:price_override_"`
+	Price         Money          `json:"price" gorm:"-"`
+	Stock         uint           `json:"stock" gorm:"not null;default:0"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     *time.Time     `json:"deleted_at,omitempty" sql:"index"`
+}
+
+// priceFor returns what the variant of item costs
+func (variant ItemVariant) priceFor(item Item) Money {
+	if variant.PriceOverride.Amount != 0 {
+		return variant.PriceOverride
+	}
+	return item.Price
+}
+
+// Category groups items in the catalog. Categories nest by pointing ParentID
+// at another category. Item.Category keeps a copy of the category name.
+type Category struct {
 	ID        uint      `json:"id" gorm:"primary_key"`
-	UserID    uint      `json:"user_id" gorm:"not null"`
-	User      User      `json:"user" gorm:"foreignkey:UserID"`
-	Items     []OrderItem `json:"items" gorm:"foreignkey:OrderID"`
-	Total     float64   `json:"total"`
+	Slug      string    `json:"slug" gorm:"unique;not null"`
+	Name      string    `json:"name" gorm:"not null"`
+	ParentID  *uint     `json:"parent_id" gorm:"index"`
+	ItemCount int       `json:"item_count" gorm:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PostalAddress is a place orders are shipped or billed to. Region is the
+// state or province code and Country the ISO 3166-1 alpha-2 code.
+type PostalAddress struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone"`
+}
+
+// TaxRegion names the tax region of the address, such as "US-CA", or just
+// the country when it has no region
+func (address PostalAddress) TaxRegion() string {
+	if address.Region == "" {
+		return address.Country
+	}
+	return address.Country + "-" + address.Region
+}
+
+// Address is one of a user's saved addresses. Each user has at most one
+// default address, which checkout uses when no address is given.
+type Address struct {
+	ID     uint `json:"id" gorm:"primary_key"`
+	UserID uint `json:"user_id" gorm:"not null;index"`
+	PostalAddress
+	IsDefault bool      `json:"is_default" gorm:"not null;default:false"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// OrderItem represents an item in an order
+// Cart represents a user's shopping cart. PromotionID is the coupon applied
+// to it; the discounts it earns are worked out whenever the cart is priced.
+type Cart struct {
+	ID               uint       `json:"id" gorm:"primary_key"`
+	UserID           uint       `json:"user_id" gorm:"not null"`
+	User             User       `json:"user" gorm:"foreignkey:UserID"`
+	GuestID          string     `json:"-" gorm:"index"`
+	Items            []CartItem `json:"items" gorm:"foreignkey:CartID"`
+	PromotionID      *uint      `json:"promotion_id"`
+	Coupon           string     `json:"coupon,omitempty" gorm:"-"`
+	CouponError      string     `json:"coupon_error,omitempty" gorm:"-"`
+	Discounts        []Discount `json:"discounts" gorm:"-"`
+	FreeShipping     bool       `json:"free_shipping" gorm:"-"`
+	Subtotal         Money      `json:"subtotal" gorm:"-"`
+	DiscountTotal    Money      `json:"discount_total" gorm:"-"`
+	TaxRegion        string     `json:"tax_region" gorm:"-"`
+	PricesIncludeTax bool       `json:"prices_include_tax" gorm:"-"`
+	Taxes            []TaxLine  `json:"taxes" gorm:"-"`
+	TaxTotal         Money      `json:"tax_total" gorm:"-"`
+	Total            Money      `json:"total" gorm:"-"`
+	PricesChanged    bool       `json:"prices_changed" gorm:"-"`
+	Version          string     `json:"version" gorm:"-"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// CalculateTotals fills in the line subtotals, the cart subtotal and the
+// total after cart.Discounts from the loaded items, adding cart.TaxTotal
+// unless prices include tax. Lines are charged at the current price of their
+// item or variant. It must be called after the items and variants have been
+// preloaded, and fails with ErrCurrencyMismatch if the items are priced in
+// different currencies.
+func (cart *Cart) CalculateTotals() error {
+	cart.Subtotal = Money{}
+	for i := range cart.Items {
+		if variant := cart.Items[i].Variant; variant != nil {
+			variant.Price = cart.Items[i].UnitPrice()
+		}
+		cart.Items[i].Subtotal = cart.Items[i].UnitPrice().Mul(cart.Items[i].Quantity)
+
+		subtotal, err := cart.Subtotal.Add(cart.Items[i].Subtotal)
+		if err != nil {
+			return err
+		}
+		cart.Subtotal = subtotal
+	}
+
+	cart.DiscountTotal = Money{}
+	for _, discount := range cart.Discounts {
+		discountTotal, err := cart.DiscountTotal.Add(discount.Amount)
+		if err != nil {
+			return err
+		}
+		cart.DiscountTotal = discountTotal
+	}
+
+	total, err := cart.Subtotal.Sub(cart.DiscountTotal)
+	if err != nil {
+		return err
+	}
+	if !cart.PricesIncludeTax {
+		if total, err = total.Add(cart.TaxTotal); err != nil {
+			return err
+		}
+	}
+	cart.Total = total
+	return nil
+}
+
+// Discount is one line of the discount breakdown a promotion earns. ItemID is
+// set when the discount belongs to a single item, and VariantID when it
+// belongs to one variant of it.
+type Discount struct {
+	PromotionID uint   `json:"promotion_id"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	ItemID      *uint  `json:"item_id,omitempty"`
+	VariantID   *uint  `json:"variant_id,omitempty"`
+	Amount      Money  `json:"amount"`
+}
+
+// CartItem represents an item in a cart, or one variant of it. Its quantity
+// is held out of other carts' reach until ReservedUntil. Price is what the
+// line cost when it was added, and PriceChanged is set when it costs
+// something else now.
+type CartItem struct {
+	ID            uint         `json:"id" gorm:"primary_key"`
+	CartID        uint         `json:"cart_id" gorm:"not null"`
+	ItemID        uint         `json:"item_id" gorm:"not null;index"`
+	VariantID     *uint        `json:"variant_id" gorm:"index"`
+	Quantity      uint         `json:"quantity" gorm:"default:1"`
+	ReservedUntil *time.Time   `json:"reserved_until"`
+	Item          Item         `json:"item" gorm:"foreignkey:ItemID"`
+	Variant       *ItemVariant `json:"variant,omitempty" gorm:"foreignkey:VariantID"`
+	Price         Money        `json:"price" gorm:"embedded;embedded_prefix:price_"`
+	PriceChanged  bool         `json:"price_changed" gorm:"-"`
+	Subtotal      Money        `json:"subtotal" gorm:"-"`
+	TaxRate       TaxRate      `json:"tax_rate" gorm:"-"`
+	Tax           Money        `json:"tax" gorm:"-"`
+}
+
+// UnitPrice returns what one unit of the line costs now. The item and its
+// variant must have been preloaded.
+func (cartItem CartItem) UnitPrice() Money {
+	if cartItem.Variant != nil {
+		return cartItem.Variant.priceFor(cartItem.Item)
+	}
+	return cartItem.Item.Price
+}
+
+// Wishlist is a named list of items a user saved for later. A public
+// wishlist can be read by anyone with its ShareToken, which is replaced
+// whenever the list is shared again.
+type Wishlist struct {
+	ID         uint           `json:"id" gorm:"primary_key"`
+	UserID     uint           `json:"user_id" gorm:"not null;index"`
+	Name       string         `json:"name" gorm:"not null"`
+	IsPublic   bool           `json:"is_public" gorm:"not null;default:false"`
+	ShareToken *string        `json:"share_token,omitempty" gorm:"unique_index"`
+	Items      []WishlistItem `json:"items" gorm:"foreignkey:WishlistID"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// WishlistItem is an item, or one variant of it, saved on a wishlist. Price
+// and Available report what it costs now and how many units are left after
+// every cart's reservations; an archived item or variant is never available.
+type WishlistItem struct {
+	ID         uint         `json:"id" gorm:"primary_key"`
+	WishlistID uint         `json:"wishlist_id" gorm:"not null;index"`
+	ItemID     uint         `json:"item_id" gorm:"not null;index"`
+	VariantID  *uint        `json:"variant_id"`
+	Item       Item         `json:"item" gorm:"foreignkey:ItemID"`
+	Variant    *ItemVariant `json:"variant,omitempty" gorm:"foreignkey:VariantID"`
+	Quantity   uint         `json:"quantity" gorm:"not null;default:1"`
+	Price      Money        `json:"price" gorm:"-"`
+	Available  uint         `json:"available" gorm:"-"`
+	InStock    bool         `json:"in_stock" gorm:"-"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+// Order represents a placed order. Total is Subtotal less the Discounts
+// earned at checkout, plus ShippingCost and TaxTotal unless PricesIncludeTax.
+// Taxes holds the tax charged per rate in TaxRegion. The addresses are copied
+// onto the order, so later changes to the user's addresses leave it alone.
+// Status moves through the states in orderTransitions, and every change is
+// kept in StatusHistory. Payments holds every attempt to charge the order.
+type Order struct {
+	ID                uint               `json:"id" gorm:"primary_key"`
+	UserID            uint               `json:"user_id" gorm:"not null"`
+	User              User               `json:"user" gorm:"foreignkey:UserID"`
+	Items             []OrderItem        `json:"items" gorm:"foreignkey:OrderID"`
+	Subtotal          Money              `json:"subtotal" gorm:"embedded;embedded_prefix:subtotal_"`
+	Total             Money              `json:"total" gorm:"embedded;embedded_prefix:total_"`
+	FreeShipping      bool               `json:"free_shipping"`
+	Discounts         []OrderDiscount    `json:"discounts,omitempty" gorm:"foreignkey:OrderID"`
+	TaxRegion         string             `json:"tax_region"`
+	PricesIncludeTax  bool               `json:"prices_include_tax"`
+	TaxTotal          Money              `json:"tax_total" gorm:"embedded;embedded_prefix:tax_total_"`
+	Taxes             []OrderTax         `json:"taxes,omitempty" gorm:"foreignkey:OrderID"`
+	ShippingAddressID *uint              `json:"shipping_address_id"`
+	ShippingAddress   PostalAddress      `json:"shipping_address" gorm:"embedded;embedded_prefix:shipping_"`
+	BillingAddressID  *uint              `json:"billing_address_id"`
+	BillingAddress    PostalAddress      `json:"billing_address" gorm:"embedded;embedded_prefix:billing_"`
+	ShippingMethod    string             `json:"shipping_method,omitempty"`
+	ShippingCost      Money              `json:"shipping_cost" gorm:"embedded;embedded_prefix:shipping_cost_"`
+	Status            string             `json:"status" gorm:"not null;default:'pending';index"`
+	CancelReason      string             `json:"cancel_reason,omitempty"`
+	StatusHistory     []OrderStatusEvent `json:"status_history,omitempty" gorm:"foreignkey:OrderID"`
+	Payments          []Payment          `json:"payments,omitempty" gorm:"foreignkey:OrderID"`
+	CreatedAt         time.Time          `json:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+}
+
+// OrderStatusEvent records one change of an order's status and the user who
+// made it. The first event of every order has an empty FromStatus.
+type OrderStatusEvent struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	OrderID    uint      `json:"order_id" gorm:"not null;index"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status" gorm:"not null"`
+	ActorID    uint      `json:"actor_id"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OrderDiscount is a Discount as it was applied to a placed order
+type OrderDiscount struct {
+	ID          uint   `json:"id" gorm:"primary_key"`
+	OrderID     uint   `json:"order_id" gorm:"not null;index"`
+	PromotionID uint   `json:"promotion_id" gorm:"not null"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	ItemID      *uint  `json:"item_id,omitempty"`
+	VariantID   *uint  `json:"variant_id,omitempty"`
+	Amount      Money  `json:"amount" gorm:"embedded;embedded_prefix:amount_"`
+}
+
+// OrderTax is a TaxLine as it was charged on a placed order
+type OrderTax struct {
+	ID      uint    `json:"id" gorm:"primary_key"`
+	OrderID uint    `json:"order_id" gorm:"not null;index"`
+	Name    string  `json:"name"`
+	Rate    TaxRate `json:"rate"`
+	Amount  Money   `json:"amount" gorm:"embedded;embedded_prefix:amount_"`
+}
+
+// Promotion is a coupon code customers can apply to their cart. Type decides
+// which of PercentOff, AmountOff or BuyQuantity and GetQuantity it uses. It
+// only applies to the listed Items and Categories (with their subcategories),
+// or to every item when neither is set. A zero UsageLimit or PerUserLimit
+// means unlimited; orders that were cancelled do not count towards them.
+type Promotion struct {
+	ID           uint       `json:"id" gorm:"primary_key"`
+	Code         string     `json:"code" gorm:"unique;not null"`
+	Description  string     `json:"description"`
+	Type         string     `json:"type" gorm:"not null"`
+	PercentOff   uint       `json:"percent_off,omitempty"`
+	AmountOff    Money      `json:"amount_off" gorm:"embedded;embedded_prefix:amount_off_"`
+	BuyQuantity  uint       `json:"buy_quantity,omitempty"`
+	GetQuantity  uint       `json:"get_quantity,omitempty"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+	UsageLimit   uint       `json:"usage_limit"`
+	PerUserLimit uint       `json:"per_user_limit"`
+	Items        []Item     `json:"items,omitempty" gorm:"many2many:promotion_items"`
+	Categories   []Category `json:"categories,omitempty" gorm:"many2many:promotion_categories"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Promotion types
+const (
+	PromotionPercentage   = "percentage"
+	PromotionFixedAmount  = "fixed_amount"
+	PromotionBuyXGetY     = "buy_x_get_y"
+	PromotionFreeShipping = "free_shipping"
+)
+
+// PromotionRedemption records that an order used a promotion
+type PromotionRedemption struct {
+	ID          uint      `json:"id" gorm:"primary_key"`
+	PromotionID uint      `json:"promotion_id" gorm:"not null;index"`
+	UserID      uint      `json:"user_id" gorm:"not null;index"`
+	OrderID     uint      `json:"order_id" gorm:"not null;index"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Payment is one attempt to charge an order through a PaymentProvider.
+// AuthorizationID is the provider's reference for the charge, and
+// ChallengeURL is where the customer authenticates while the payment
+// requires action.
+type Payment struct {
+	ID              uint      `json:"id" gorm:"primary_key"`
+	OrderID         uint      `json:"order_id" gorm:"not null;index"`
+	Provider        string    `json:"provider" gorm:"not null"`
+	AuthorizationID string    `json:"authorization_id,omitempty" gorm:"index"`
+	Amount          Money     `json:"amount" gorm:"embedded;embedded_prefix:amount_"`
+	Status          string    `json:"status" gorm:"not null;default:'pending'"`
+	FailureCode     string    `json:"failure_code,omitempty"`
+	ChallengeURL    string    `json:"challenge_url,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Payment statuses. A payment is pending until the provider answers; a
+// captured payment is refunded and an uncaptured one voided when its order
+// is cancelled or refunded.
+const (
+	PaymentPending        = "pending"
+	PaymentRequiresAction = "requires_action"
+	PaymentAuthorized     = "authorized"
+	PaymentCaptured       = "captured"
+	PaymentVoided         = "voided"
+	PaymentRefunded       = "refunded"
+	PaymentFailed         = "failed"
+)
+
+// Reference identifies the payment to the provider
+func (payment Payment) Reference() string {
+	return fmt.Sprintf("order-%d-payment-%d", payment.OrderID, payment.ID)
+}
+
+// OrderItem represents an item in an order. Price is the unit price at the
+// time of purchase and Subtotal is Price multiplied by Quantity. Tax is the
+// tax charged on the line at TaxRate after discounts. A line bought by
+// variant keeps a copy of the variant's SKU and Options.
 type OrderItem struct {
-	ID      uint  `json:"id" gorm:"primary_key"`
-	OrderID uint  `json:"order_id" gorm:"not null"`
-	ItemID  uint  `json:"item_id" gorm:"not null"`
-	Item    Item  `json:"item" gorm:"foreignkey:ItemID"`
-	Price   float64 `json:"price"`
-} 
\ No newline at end of file
+	ID        uint           `json:"id" gorm:"primary_key"`
+	OrderID   uint           `json:"order_id" gorm:"not null"`
+	ItemID    uint           `json:"item_id" gorm:"not null"`
+	Item      Item           `json:"item" gorm:"foreignkey:ItemID"`
+	VariantID *uint          `json:"variant_id,omitempty"`
+	SKU       string         `json:"sku,omitempty"`
+	Options   VariantOptions `json:"options,omitempty" gorm:"type:text"`
+	Quantity  uint           `json:"quantity" gorm:"not null;default:1"`
+	Price     Money          `json:"price" gorm:"embedded;embedded_prefix:price_"`
+	Subtotal  Money          `json:"subtotal" gorm:"embedded;embedded_prefix:subtotal_"`
+	TaxRate   TaxRate        `json:"tax_rate"`
+	Tax       Money          `json:"tax" gorm:"embedded;embedded_prefix:tax_"`
+}
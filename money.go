@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for amounts given without a currency
+const DefaultCurrency = "USD"
+
+// currencyExponents holds the number of minor unit digits of every supported
+// ISO 4217 currency
+var currencyExponents = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CAD": 2,
+	"AUD": 2,
+	"CHF": 2,
+	"JPY": 0,
+	"KWD": 3,
+}
+
+// ErrCurrencyMismatch is returned when amounts in different currencies are
+// combined
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// Money is an amount in integer minor units (cents for USD) of an ISO 4217
+// currency, so sums never pick up floating point drift. It is stored as two
+// columns, <prefix>amount and <prefix>currency, and serialized as
+// {"amount": "12.99", "currency": "USD"}.
+type Money struct {
+	Amount   int64  `gorm:"not null;default:0"`
+	Currency string `gorm:"not null;default:'USD'"`
+}
+
+// NewMoney returns amount minor units of currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// ParseMoney parses a decimal amount such as "12.99" in currency. It rejects
+// amounts with more decimal places than the currency has minor units.
+func ParseMoney(amount string, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency %q", currency)
+	}
+
+	text := strings.TrimSpace(amount)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+	if whole == "" || len(fraction) > exponent || (strings.Contains(text, ".") && fraction == "") {
+		return Money{}, fmt.Errorf("invalid amount %q for %s", amount, currency)
+	}
+	for _, r := range whole + fraction {
+		if r < '0' || r > '9' {
+			return Money{}, fmt.Errorf("invalid amount %q for %s", amount, currency)
+		}
+	}
+
+	minor, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", exponent-len(fraction)), 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q for %s", amount, currency)
+	}
+	if negative {
+		minor = -minor
+	}
+
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+// String formats the amount as a decimal without the currency, such as "12.99"
+func (m Money) String() string {
+	exponent := currencyExponents[m.currency()]
+
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// IsPositive reports whether the amount is above zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// Mul multiplies the amount by a quantity
+func (m Money) Mul(quantity uint) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.currency()}
+}
+
+// Add sums two amounts of the same currency. A zero amount without a
+// currency takes on the other's currency, so sums can start from Money{}.
+func (m Money) Add(other Money) (Money, error) {
+	switch {
+	case m.Currency == "" && m.Amount == 0:
+		return other, nil
+	case other.Currency == "" && other.Amount == 0:
+		return m, nil
+	case m.currency() != other.currency():
+		return Money{}, ErrCurrencyMismatch
+	}
+
+	return Money{Amount: m.Amount + other.Amount, Currency: m.currency()}, nil
+}
+
+// Sub subtracts an amount of the same currency, treating a zero amount
+// without a currency like Add does
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Percent returns percent per cent of the amount, rounded half away from zero
+// to the nearest minor unit
+func (m Money) Percent(percent uint) Money {
+	scaled := m.Amount * int64(percent)
+	if scaled < 0 {
+		return Money{Amount: (scaled - 50) / 100, Currency: m.currency()}
+	}
+	return Money{Amount: (scaled + 50) / 100, Currency: m.currency()}
+}
+
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+	return m.Currency
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+// MarshalJSON writes the amount as a decimal string so that clients never
+// see a float
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.currency()})
+}
+
+// UnmarshalJSON accepts {"amount": "12.99", "currency": "EUR"}, or just an
+// amount in the default currency as a string ("12.99") or number (12.99).
+// Numbers are read from their decimal text, never through a float.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	amount, currency := data, ""
+	if len(data) > 0 && data[0] == '{' {
+		var object moneyJSON
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		amount, currency = object.Amount, object.Currency
+	}
+
+	var text string
+	if len(amount) > 0 && amount[0] == '"' {
+		if err := json.Unmarshal(amount, &text); err != nil {
+			return err
+		}
+	} else {
+		var number json.Number
+		decoder := json.NewDecoder(bytes.NewReader(amount))
+		decoder.UseNumber()
+		if err := decoder.Decode(&number); err != nil {
+			return fmt.Errorf("invalid amount %s", amount)
+		}
+		text = number.String()
+	}
+
+	parsed, err := ParseMoney(text, currency)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Order statuses
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderFulfilled = "fulfilled"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Cancelled and refunded orders are final.
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderCancelled, OrderRefunded},
+	OrderFulfilled: {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:   {OrderDelivered, OrderRefunded},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+// TransitionError reports a status change that the state machine does not
+// allow from the order's current status
+type TransitionError struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot move an order from %s to %s", e.From, e.To)
+}
+
+// validOrderStatus reports whether status is one of the order statuses
+func validOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransition reports whether an order may move from one status to another
+func canTransition(from string, to string) bool {
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// recordOrderStatus appends a status change to the order's history
+func recordOrderStatus(tx *gorm.DB, orderID uint, from string, to string, actorID uint, note string) error {
+	return tx.Create(&OrderStatusEvent{
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorID:    actorID,
+		Note:       note,
+	}).Error
+}
+
+// customerCancellable reports whether a customer may still cancel their own
+// order, which is only before it is fulfilled
+func customerCancellable(status string) bool {
+	return status == OrderPending || status == OrderPaid
+}
+
+// transitionOrder moves an order to a new status and records who did it. The
+// update only applies if the order still has the status it was loaded with,
+// so two concurrent changes cannot both succeed. Cancelling an order keeps
+// the note as its reason and puts its units back in stock.
+func transitionOrder(tx *gorm.DB, order *Order, to string, actorID uint, note string) error {
+	from := order.Status
+	if !canTransition(from, to) {
+		return &TransitionError{From: from, To: to, Allowed: orderTransitions[from]}
+	}
+
+	updates := map[string]interface{}{"status": to, "updated_at": time.Now()}
+	if to == OrderCancelled {
+		updates["cancel_reason"] = note
+	}
+
+	result := tx.Model(&Order{}).Where("id = ? AND status = ?", order.ID, from).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var current Order
+		if err := tx.Select("status").First(&current, order.ID).Error; err != nil {
+			return err
+		}
+		return &TransitionError{From: current.Status, To: to, Allowed: orderTransitions[current.Status]}
+	}
+
+	if to == OrderCancelled {
+		var orderItems []OrderItem
+		if err := tx.Where("order_id = ?", order.ID).Find(&orderItems).Error; err != nil {
+			return err
+		}
+		for _, orderItem := range orderItems {
+			table, _, id := stockRow(orderItem.ItemID, orderItem.VariantID)
+			if err := tx.Exec("UPDATE "+table+" SET stock = stock + ? WHERE id = ?", orderItem.Quantity, id).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	order.Status = to
+	if to == OrderCancelled {
+		order.CancelReason = note
+	}
+	return recordOrderStatus(tx, order.ID, from, to, actorID, note)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Page size limits for list endpoints
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// itemSortColumns maps the sort names accepted by ListItems to their columns
+var itemSortColumns = map[string]string{
+	"price":      "price_amount",
+	"name":       "name",
+	"created_at": "created_at",
+	"rating":     "rating",
+}
+
+// pageCursor marks the last row of a page. Value holds that row's sort column
+// so the next page can continue after it, with ID breaking ties.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func (cursor pageCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageCursor(encoded string) (pageCursor, error) {
+	var cursor pageCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, errors.New("Invalid cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, errors.New("Invalid cursor")
+	}
+
+	return cursor, nil
+}
+
+// parsePageSize reads a limit query parameter, defaulting when it is empty
+func parsePageSize(limit string) (int, error) {
+	if limit == "" {
+		return DefaultPageSize, nil
+	}
+
+	size, err := strconv.Atoi(limit)
+	if err != nil || size < 1 {
+		return 0, errors.New("limit must be a positive number")
+	}
+	if size > MaxPageSize {
+		return 0, errors.New("limit must not exceed " + strconv.Itoa(MaxPageSize))
+	}
+
+	return size, nil
+}
+
+// itemCursor builds the cursor that continues after item
+func itemCursor(item Item, sort string, order string) pageCursor {
+	cursor := pageCursor{Sort: sort, Order: order, ID: item.ID}
+
+	switch sort {
+	case "price":
+		cursor.Value = strconv.FormatInt(item.Price.Amount, 10)
+	case "name":
+		cursor.Value = item.Name
+	case "created_at":
+		cursor.Value = item.CreatedAt.Format(time.RFC3339Nano)
+	case "rating":
+		cursor.Value = strconv.FormatFloat(item.Rating, 'f', -1, 64)
+	}
+
+	return cursor
+}
+
+// itemCursorValue converts a cursor value back into the type of its column
+func itemCursorValue(cursor pageCursor) (interface{}, error) {
+	switch cursor.Sort {
+	case "price":
+		amount, err := strconv.ParseInt(cursor.Value, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid cursor")
+		}
+		return amount, nil
+	case "name":
+		return cursor.Value, nil
+	case "created_at":
+		createdAt, err := time.Parse(time.RFC3339Nano, cursor.Value)
+		if err != nil {
+			return nil, errors.New("Invalid cursor")
+		}
+		return createdAt, nil
+	case "rating":
+		rating, err := strconv.ParseFloat(cursor.Value, 64)
+		if err != nil {
+			return nil, errors.New("Invalid cursor")
+		}
+		return rating, nil
+	}
+
+	return nil, errors.New("Invalid cursor")
+}
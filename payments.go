@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PaymentTimeout bounds every call to the payment provider
+const PaymentTimeout = 30 * time.Second
+
+// PaymentProvider charges customers through a payment gateway. A charge is
+// authorized first, which holds the funds, and then captured. An
+// authorization that is never captured is voided, and a captured charge is
+// given back with a refund.
+type PaymentProvider interface {
+	// Name identifies the provider on stored payments
+	Name() string
+	// Authorize holds req.Amount on req.Source. It returns a *DeclineError
+	// when the payment is refused, a *ChallengeError when the customer must
+	// authenticate first, and an error wrapping ErrPaymentTimeout when the
+	// provider does not answer in time.
+	Authorize(ctx context.Context, req PaymentRequest) (Authorization, error)
+	// Capture takes amount, at most the authorized amount
+	Capture(ctx context.Context, authorizationID string, amount Money) error
+	// Void releases an authorization that was not captured
+	Void(ctx context.Context, authorizationID string) error
+	// Refund gives back amount of a captured authorization
+	Refund(ctx context.Context, authorizationID string, amount Money) error
+}
+
+// PaymentRequest asks a provider to authorize a payment. To finish a
+// challenge, Authorize is called again with the AuthorizationID from the
+// *ChallengeError and the customer's ChallengeResponse.
+type PaymentRequest struct {
+	Reference         string
+	Amount            Money
+	Source            string
+	AuthorizationID   string
+	ChallengeResponse string
+}
+
+// Authorization is a successful authorization
+type Authorization struct {
+	ID string
+}
+
+// ErrPaymentTimeout is returned when the payment provider does not answer in
+// time. Whether the authorization went through is unknown, but providers
+// drop authorizations that are never captured.
+var ErrPaymentTimeout = errors.New("payment provider timed out")
+
+// DeclineError reports a payment refused by the provider, with its reason
+type DeclineError struct {
+	Code string
+}
+
+func (e *DeclineError) Error() string {
+	return "payment declined: " + e.Code
+}
+
+// ChallengeError reports that the customer must complete a challenge, such as
+// 3-D Secure, at URL before the authorization takes effect
+type ChallengeError struct {
+	AuthorizationID string
+	URL             string
+}
+
+func (e *ChallengeError) Error() string {
+	return "payment requires authentication at " + e.URL
+}
+
+// FakePaymentProvider is an in-process PaymentProvider for development and
+// tests. It never moves money. The payment source picks the outcome:
+//
+//	tok_declined            declined as card_declined
+//	tok_insufficient_funds  declined as insufficient_funds
+//	tok_challenge           challenged; answering "pass" authorizes it
+//	tok_capture_declined    authorized, but the capture is declined
+//	tok_timeout             never answers, so the call times out
+//
+// Any other source is authorized.
+type FakePaymentProvider struct {
+	mu      sync.Mutex
+	charges map[string]*fakeCharge
+}
+
+type fakeCharge struct {
+	source string
+	amount Money
+	status string
+}
+
+// NewFakePaymentProvider returns a FakePaymentProvider without charges
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{charges: make(map[string]*fakeCharge)}
+}
+
+// Name identifies the fake provider
+func (p *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+// Authorize decides the outcome from the payment source
+func (p *FakePaymentProvider) Authorize(ctx context.Context, req PaymentRequest) (Authorization, error) {
+	if req.Source == "tok_timeout" {
+		<-ctx.Done()
+		return Authorization{}, fmt.Errorf("%w: %v", ErrPaymentTimeout, ctx.Err())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if req.AuthorizationID != "" {
+		charge, ok := p.charges[req.AuthorizationID]
+		if !ok || charge.status != PaymentRequiresAction {
+			return Authorization{}, fmt.Errorf("no challenge pending for %s", req.AuthorizationID)
+		}
+		if req.ChallengeResponse != "pass" {
+			charge.status = PaymentFailed
+			return Authorization{}, &DeclineError{Code: "authentication_failed"}
+		}
+		charge.status = PaymentAuthorized
+		return Authorization{ID: req.AuthorizationID}, nil
+	}
+
+	switch req.Source {
+	case "tok_declined":
+		return Authorization{}, &DeclineError{Code: "card_declined"}
+	case "tok_insufficient_funds":
+		return Authorization{}, &DeclineError{Code: "insufficient_funds"}
+	}
+
+	id := fmt.Sprintf("fake_auth_%d", len(p.charges)+1)
+	charge := &fakeCharge{source: req.Source, amount: req.Amount, status: PaymentAuthorized}
+	p.charges[id] = charge
+
+	if req.Source == "tok_challenge" {
+		charge.status = PaymentRequiresAction
+		return Authorization{}, &ChallengeError{AuthorizationID: id, URL: "/fake-3ds/" + id}
+	}
+	return Authorization{ID: id}, nil
+}
+
+// Capture takes an authorized charge
+func (p *FakePaymentProvider) Capture(ctx context.Context, authorizationID string, amount Money) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	charge, err := p.charge(authorizationID, PaymentAuthorized)
+	if err != nil {
+		return err
+	}
+	if amount.currency() != charge.amount.currency() || amount.Amount > charge.amount.Amount {
+		return fmt.Errorf("cannot capture %s %s of %s", amount, amount.currency(), authorizationID)
+	}
+	if charge.source == "tok_capture_declined" {
+		return &DeclineError{Code: "capture_declined"}
+	}
+
+	charge.status = PaymentCaptured
+	return nil
+}
+
+// Void releases an authorized or challenged charge
+func (p *FakePaymentProvider) Void(ctx context.Context, authorizationID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	charge, err := p.charge(authorizationID, PaymentAuthorized, PaymentRequiresAction)
+	if err != nil {
+		return err
+	}
+
+	charge.status = PaymentVoided
+	return nil
+}
+
+// Refund gives back a captured charge
+func (p *FakePaymentProvider) Refund(ctx context.Context, authorizationID string, amount Money) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	charge, err := p.charge(authorizationID, PaymentCaptured)
+	if err != nil {
+		return err
+	}
+
+	charge.status = PaymentRefunded
+	return nil
+}
+
+// Status returns the state of a charge, using the Payment statuses, or an
+// empty string for an unknown authorization
+func (p *FakePaymentProvider) Status(authorizationID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if charge, ok := p.charges[authorizationID]; ok {
+		return charge.status
+	}
+	return ""
+}
+
+// charge finds a charge that is in one of statuses. The caller holds p.mu.
+func (p *FakePaymentProvider) charge(authorizationID string, statuses ...string) (*fakeCharge, error) {
+	charge, ok := p.charges[authorizationID]
+	if !ok {
+		return nil, fmt.Errorf("unknown authorization %s", authorizationID)
+	}
+	for _, status := range statuses {
+		if charge.status == status {
+			return charge, nil
+		}
+	}
+	return nil, fmt.Errorf("authorization %s is %s", authorizationID, charge.status)
+}
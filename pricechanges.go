@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PriceChange is a cart line whose item costs something else now than when
+// it was added to the cart
+type PriceChange struct {
+	ItemID       uint  `json:"item_id"`
+	VariantID    *uint `json:"variant_id,omitempty"`
+	Price        Money `json:"price"`
+	CurrentPrice Money `json:"current_price"`
+}
+
+// flagPriceChanges marks the lines whose unit price changed since they were
+// added and sets the cart's version. The version changes whenever the lines,
+// their quantities or the prices they would be charged at change, so a
+// checkout naming it proves the user saw the cart as it is.
+func (cart *Cart) flagPriceChanges() {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "cart %d\n", cart.ID)
+
+	cart.PricesChanged = false
+	for i := range cart.Items {
+		line := &cart.Items[i]
+		price := line.UnitPrice()
+		line.PriceChanged = line.Price != price
+		if line.PriceChanged {
+			cart.PricesChanged = true
+		}
+		variantID := uint(0)
+		if line.VariantID != nil {
+			variantID = *line.VariantID
+		}
+		fmt.Fprintf(hash, "%d %d %d %d %s\n", line.ItemID, variantID, line.Quantity, price.Amount, price.Currency)
+	}
+
+	cart.Version = hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// priceChanges lists the lines flagPriceChanges marked as changed
+func (cart *Cart) priceChanges() []PriceChange {
+	changes := []PriceChange{}
+	for _, line := range cart.Items {
+		if line.PriceChanged {
+			changes = append(changes, PriceChange{ItemID: line.ItemID, VariantID: line.VariantID, Price: line.Price, CurrentPrice: line.UnitPrice()})
+		}
+	}
+	return changes
+}
+
+// acknowledgePrices records the current price of every line flagPriceChanges
+// marked as changed as the price the user agreed to
+func (cart *Cart) acknowledgePrices(tx *gorm.DB) error {
+	for i := range cart.Items {
+		line := &cart.Items[i]
+		if !line.PriceChanged {
+			continue
+		}
+
+		line.Price = line.UnitPrice()
+		err := tx.Model(line).UpdateColumns(map[string]interface{}{
+			"price_amount":   line.Price.Amount,
+			"price_currency": line.Price.Currency,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCartVersion refuses a checkout of cart unless the user saw its
+// current prices. A version must be given once a price changed, and a
+// version that is given must match the cart.
+func checkCartVersion(cart *Cart, version string) error {
+	cart.flagPriceChanges()
+
+	switch {
+	case version != "" && version != cart.Version:
+		return &CheckoutError{Status: http.StatusConflict, Step: "check_prices", Message: "Cart has changed; review it and check out again",
+			PriceChanges: cart.priceChanges(), CartVersion: cart.Version}
+	case version == "" && cart.PricesChanged:
+		return &CheckoutError{Status: http.StatusConflict, Step: "check_prices", Message: "Prices have changed; review them and check out with the cart's version",
+			PriceChanges: cart.priceChanges(), CartVersion: cart.Version}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PromotionError explains why a promotion cannot be applied to a cart
+type PromotionError struct {
+	Message string
+}
+
+func (e *PromotionError) Error() string {
+	return e.Message
+}
+
+// normalizeCouponCode makes coupon codes case-insensitive
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// redemptionCount is the SQL for how often a promotion was used by orders
+// that were not cancelled
+const redemptionCount = `SELECT COUNT(*) AS count FROM promotion_redemptions
+	JOIN orders ON orders.id = promotion_redemptions.order_id
+	WHERE promotion_redemptions.promotion_id = ? AND orders.status <> ?`
+
+// evaluatePromotion loads a promotion and works out the discounts it earns on
+// cart, whose totals must have been calculated. It returns a *PromotionError
+// when the promotion has not started, has ended, is used up overall or by
+// the cart's user, or applies to none of the cart's items. Inside a
+// transaction the usage counts cannot change before the order is placed.
+func evaluatePromotion(db *gorm.DB, promotionID uint, cart *Cart, now time.Time) (Promotion, []Discount, error) {
+	var promotion Promotion
+	if err := db.Preload("Items").Preload("Categories").First(&promotion, promotionID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return promotion, nil, &PromotionError{Message: "Coupon no longer exists"}
+		}
+		return promotion, nil, err
+	}
+
+	if promotion.StartsAt != nil && now.Before(*promotion.StartsAt) {
+		return promotion, nil, &PromotionError{Message: "Coupon is not active yet"}
+	}
+	if promotion.EndsAt != nil && !now.Before(*promotion.EndsAt) {
+		return promotion, nil, &PromotionError{Message: "Coupon has expired"}
+	}
+
+	var used struct {
+		Count uint
+	}
+	if promotion.UsageLimit > 0 {
+		if err := db.Raw(redemptionCount, promotion.ID, OrderCancelled).Scan(&used).Error; err != nil {
+			return promotion, nil, err
+		}
+		if used.Count >= promotion.UsageLimit {
+			return promotion, nil, &PromotionError{Message: "Coupon has been used up"}
+		}
+	}
+	if promotion.PerUserLimit > 0 {
+		if err := db.Raw(redemptionCount+" AND promotion_redemptions.user_id = ?", promotion.ID, OrderCancelled, cart.UserID).Scan(&used).Error; err != nil {
+			return promotion, nil, err
+		}
+		if used.Count >= promotion.PerUserLimit {
+			return promotion, nil, &PromotionError{Message: "You have already used this coupon"}
+		}
+	}
+
+	eligible, err := eligibleItems(db, promotion)
+	if err != nil {
+		return promotion, nil, err
+	}
+
+	var lines []CartItem
+	for _, line := range cart.Items {
+		if eligible(line.Item) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return promotion, nil, &PromotionError{Message: "Coupon does not apply to any item in your cart"}
+	}
+
+	discounts, err := promotionDiscounts(promotion, lines)
+	return promotion, discounts, err
+}
+
+// eligibleItems returns a check for whether a promotion applies to an item
+func eligibleItems(db *gorm.DB, promotion Promotion) (func(Item) bool, error) {
+	if len(promotion.Items) == 0 && len(promotion.Categories) == 0 {
+		return func(Item) bool { return true }, nil
+	}
+
+	itemIDs := make(map[uint]bool)
+	for _, item := range promotion.Items {
+		itemIDs[item.ID] = true
+	}
+
+	categoryIDs := make(map[uint]bool)
+	categoryNames := make(map[string]bool)
+	if len(promotion.Categories) > 0 {
+		var categories []Category
+		if err := db.Find(&categories).Error; err != nil {
+			return nil, err
+		}
+		for _, category := range promotion.Categories {
+			for _, id := range categoryWithDescendants(categories, category.ID) {
+				categoryIDs[id] = true
+			}
+		}
+		for _, category := range categories {
+			if categoryIDs[category.ID] {
+				categoryNames[category.Name] = true
+			}
+		}
+	}
+
+	return func(item Item) bool {
+		if itemIDs[item.ID] {
+			return true
+		}
+		if item.CategoryID != nil {
+			return categoryIDs[*item.CategoryID]
+		}
+		return categoryNames[item.Category]
+	}, nil
+}
+
+// promotionDiscounts works out the discount breakdown of a promotion over
+// the cart lines it applies to
+func promotionDiscounts(promotion Promotion, lines []CartItem) ([]Discount, error) {
+	discount := func(line *CartItem, description string, amount Money) Discount {
+		d := Discount{PromotionID: promotion.ID, Code: promotion.Code, Description: description, Amount: amount}
+		if line != nil {
+			itemID := line.ItemID
+			d.ItemID, d.VariantID = &itemID, line.VariantID
+		}
+		return d
+	}
+
+	var discounts []Discount
+	switch promotion.Type {
+	case PromotionPercentage:
+		for i, line := range lines {
+			description := fmt.Sprintf("%d%% off %s", promotion.PercentOff, line.Item.Name)
+			discounts = append(discounts, discount(&lines[i], description, line.Subtotal.Percent(promotion.PercentOff)))
+		}
+
+	case PromotionFixedAmount:
+		var eligible Money
+		for _, line := range lines {
+			sum, err := eligible.Add(line.Subtotal)
+			if err != nil {
+				return nil, err
+			}
+			eligible = sum
+		}
+		if promotion.AmountOff.currency() != eligible.currency() {
+			return nil, &PromotionError{Message: "Coupon is for carts priced in " + promotion.AmountOff.currency()}
+		}
+
+		// Never take off more than the items cost
+		amount := promotion.AmountOff
+		if amount.Amount > eligible.Amount {
+			amount = eligible
+		}
+		discounts = append(discounts, discount(nil, fmt.Sprintf("%s %s off", promotion.AmountOff, promotion.AmountOff.currency()), amount))
+
+	case PromotionBuyXGetY:
+		// Every BuyQuantity units paid for earn GetQuantity free units of the
+		// same item
+		group := promotion.BuyQuantity + promotion.GetQuantity
+		for i, line := range lines {
+			free := line.Quantity / group * promotion.GetQuantity
+			if free == 0 {
+				continue
+			}
+			description := fmt.Sprintf("Buy %d get %d free: %s", promotion.BuyQuantity, promotion.GetQuantity, line.Item.Name)
+			discounts = append(discounts, discount(&lines[i], description, line.UnitPrice().Mul(free)))
+		}
+		if len(discounts) == 0 {
+			return nil, &PromotionError{Message: fmt.Sprintf("Add %d of an item to get %d free", group, promotion.GetQuantity)}
+		}
+
+	case PromotionFreeShipping:
+		discounts = append(discounts, discount(nil, "Free shipping", Money{}))
+
+	default:
+		return nil, fmt.Errorf("unknown promotion type %q", promotion.Type)
+	}
+
+	return discounts, nil
+}
+
+// priceCart calculates a cart's totals, the discounts of its coupon and the
+// tax for region, or the default tax region when it is empty. A coupon that
+// no longer applies stays on the cart with CouponError saying why, and earns
+// nothing until the cart changes or the coupon is removed. Lines whose price
+// changed since they were added are flagged.
+func priceCart(db *gorm.DB, taxes TaxCalculator, region string, cart *Cart) error {
+	cart.Coupon = ""
+	cart.CouponError = ""
+	cart.Discounts = []Discount{}
+	cart.FreeShipping = false
+	cart.Taxes = []TaxLine{}
+	cart.TaxTotal = Money{}
+	cart.flagPriceChanges()
+	if err := cart.CalculateTotals(); err != nil {
+		return err
+	}
+
+	if cart.PromotionID != nil {
+		promotion, discounts, err := evaluatePromotion(db, *cart.PromotionID, cart, time.Now())
+		cart.Coupon = promotion.Code
+
+		var promotionErr *PromotionError
+		switch {
+		case errors.As(err, &promotionErr):
+			cart.CouponError = promotionErr.Message
+		case err != nil:
+			return err
+		default:
+			cart.Discounts = discounts
+			cart.FreeShipping = promotion.Type == PromotionFreeShipping
+		}
+	}
+
+	if err := taxCart(taxes, region, cart); err != nil {
+		return err
+	}
+	return cart.CalculateTotals()
+}
+
+// validatePromotion checks a new promotion's type and the fields it needs
+func validatePromotion(promotion Promotion) error {
+	switch promotion.Type {
+	case PromotionPercentage:
+		if promotion.PercentOff == 0 || promotion.PercentOff > 100 {
+			return errors.New("percent_off must be between 1 and 100")
+		}
+	case PromotionFixedAmount:
+		if !promotion.AmountOff.IsPositive() {
+			return errors.New("amount_off must be greater than zero")
+		}
+	case PromotionBuyXGetY:
+		if promotion.BuyQuantity == 0 || promotion.GetQuantity == 0 {
+			return errors.New("buy_quantity and get_quantity must be at least 1")
+		}
+	case PromotionFreeShipping:
+	default:
+		return fmt.Errorf("type must be one of %s, %s, %s or %s", PromotionPercentage, PromotionFixedAmount, PromotionBuyXGetY, PromotionFreeShipping)
+	}
+
+	if promotion.StartsAt != nil && promotion.EndsAt != nil && !promotion.EndsAt.After(*promotion.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
@@ -21,59 +21,117 @@ func main() {
 	defer db.Close()
 
 	// Auto migrate the schema
-	db.AutoMigrate(&User{}, &Item{}, &Cart{}, &CartItem{}, &Order{}, &OrderItem{})
+	db.AutoMigrate(&User{}, &Session{}, &Address{}, &Item{}, &ItemVariant{}, &ItemImage{}, &Review{}, &ReviewVote{}, &ReviewFlag{}, &Category{}, &Cart{}, &CartItem{}, &Wishlist{}, &WishlistItem{}, &Order{}, &OrderItem{}, &OrderStatusEvent{}, &Payment{}, &Promotion{}, &PromotionRedemption{}, &OrderDiscount{}, &OrderTax{})
 
 	// Create sample user
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	sampleUser := User{
 		Username: "testuser",
 		Password: string(hashedPassword),
-		Token:    "sample-token-123",
 	}
 	db.Create(&sampleUser)
 
+	// Give the sample user a default address
+	db.Create(&Address{UserID: sampleUser.ID, PostalAddress: PostalAddress{Name: "Test User", Line1: "1 Market St", City: "San Francisco", Region: "CA", PostalCode: "94105", Country: "US"}, IsDefault: true})
+
+	// Create sample admin
+	hashedAdminPassword, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+	adminUser := User{
+		Username: "admin",
+		Password: string(hashedAdminPassword),
+		Role:     RoleAdmin,
+	}
+	db.Create(&adminUser)
+
+	// Create sample categories
+	sampleCategories := []Category{
+		{Slug: "electronics", Name: "Electronics"},
+		{Slug: "clothing", Name: "Clothing"},
+		{Slug: "home-garden", Name: "Home & Garden"},
+		{Slug: "books", Name: "Books"},
+		{Slug: "sports", Name: "Sports"},
+	}
+	categoryIDs := make(map[string]uint)
+	for _, category := range sampleCategories {
+		db.Create(&category)
+		categoryIDs[category.Name] = category.ID
+	}
+
 	// Create sample items with categories
 	sampleItems := []Item{
 		// Electronics
-		{Name: "MacBook Pro", Description: "High-performance laptop with M2 chip", Price: 1299.99, Category: "Electronics"},
-		{Name: "iPhone 15", Description: "Latest smartphone with advanced camera", Price: 899.99, Category: "Electronics"},
-		{Name: "Sony WH-1000XM4", Description: "Premium noise-canceling headphones", Price: 349.99, Category: "Electronics"},
-		{Name: "iPad Air", Description: "Lightweight tablet for productivity", Price: 599.99, Category: "Electronics"},
-		{Name: "Apple Watch", Description: "Smartwatch with health tracking", Price: 399.99, Category: "Electronics"},
+		{Name: "MacBook Pro", Description: "High-performance laptop with M2 chip", Price: NewMoney(129999, DefaultCurrency), Category: "Electronics"},
+		{Name: "iPhone 15", Description: "Latest smartphone with advanced camera", Price: NewMoney(89999, DefaultCurrency), Category: "Electronics"},
+		{Name: "Sony WH-1000XM4", Description: "Premium noise-canceling headphones", Price: NewMoney(34999, DefaultCurrency), Category: "Electronics"},
+		{Name: "iPad Air", Description: "Lightweight tablet for productivity", Price: NewMoney(59999, DefaultCurrency), Category: "Electronics"},
+		{Name: "Apple Watch", Description: "Smartwatch with health tracking", Price: NewMoney(39999, DefaultCurrency), Category: "Electronics"},
 		
 		// Clothing
-		{Name: "Nike Air Max", Description: "Comfortable running shoes", Price: 129.99, Category: "Clothing"},
-		{Name: "Levi's Jeans", Description: "Classic blue denim jeans", Price: 79.99, Category: "Clothing"},
-		{Name: "Adidas Hoodie", Description: "Warm and stylish hoodie", Price: 59.99, Category: "Clothing"},
-		{Name: "Ray-Ban Aviator", Description: "Classic sunglasses", Price: 159.99, Category: "Clothing"},
-		{Name: "Rolex Submariner", Description: "Luxury diving watch", Price: 8999.99, Category: "Clothing"},
+		{Name: "Nike Air Max", Description: "Comfortable running shoes", Price: NewMoney(12999, DefaultCurrency), Category: "Clothing"},
+		{Name: "Levi's Jeans", Description: "Classic blue denim jeans", Price: NewMoney(7999, DefaultCurrency), Category: "Clothing"},
+		{Name: "Adidas Hoodie", Description: "Warm and stylish hoodie", Price: NewMoney(5999, DefaultCurrency), Category: "Clothing"},
+		{Name: "Ray-Ban Aviator", Description: "Classic sunglasses", Price: NewMoney(15999, DefaultCurrency), Category: "Clothing"},
+		{Name: "Rolex Submariner", Description: "Luxury diving watch", Price: NewMoney(899999, DefaultCurrency), Category: "Clothing"},
 		
 		// Home & Garden
-		{Name: "Dyson V15", Description: "Cordless vacuum cleaner", Price: 699.99, Category: "Home & Garden"},
-		{Name: "Philips Hue", Description: "Smart LED light bulbs", Price: 199.99, Category: "Home & Garden"},
-		{Name: "IKEA Furniture", Description: "Modern living room set", Price: 899.99, Category: "Home & Garden"},
-		{Name: "KitchenAid Mixer", Description: "Professional stand mixer", Price: 399.99, Category: "Home & Garden"},
-		{Name: "Nest Thermostat", Description: "Smart home temperature control", Price: 249.99, Category: "Home & Garden"},
+		{Name: "Dyson V15", Description: "Cordless vacuum cleaner", Price: NewMoney(69999, DefaultCurrency), Category: "Home & Garden"},
+		{Name: "Philips Hue", Description: "Smart LED light bulbs", Price: NewMoney(19999, DefaultCurrency), Category: "Home & Garden"},
+		{Name: "IKEA Furniture", Description: "Modern living room set", Price: NewMoney(89999, DefaultCurrency), Category: "Home & Garden"},
+		{Name: "KitchenAid Mixer", Description: "Professional stand mixer", Price: NewMoney(39999, DefaultCurrency), Category: "Home & Garden"},
+		{Name: "Nest Thermostat", Description: "Smart home temperature control", Price: NewMoney(24999, DefaultCurrency), Category: "Home & Garden"},
 		
 		// Books
-		{Name: "The Great Gatsby", Description: "Classic American novel", Price: 12.99, Category: "Books"},
-		{Name: "Harry Potter Set", Description: "Complete 7-book collection", Price: 89.99, Category: "Books"},
-		{Name: "Programming Guide", Description: "Learn coding from scratch", Price: 49.99, Category: "Books"},
-		{Name: "Cookbook Collection", Description: "1000+ recipes", Price: 34.99, Category: "Books"},
-		{Name: "Business Strategy", Description: "Modern business insights", Price: 24.99, Category: "Books"},
+		{Name: "The Great Gatsby", Description: "Classic American novel", Price: NewMoney(1299, DefaultCurrency), Category: "Books"},
+		{Name: "Harry Potter Set", Description: "Complete 7-book collection", Price: NewMoney(8999, DefaultCurrency), Category: "Books"},
+		{Name: "Programming Guide", Description: "Learn coding from scratch", Price: NewMoney(4999, DefaultCurrency), Category: "Books"},
+		{Name: "Cookbook Collection", Description: "1000+ recipes", Price: NewMoney(3499, DefaultCurrency), Category: "Books"},
+		{Name: "Business Strategy", Description: "Modern business insights", Price: NewMoney(2499, DefaultCurrency), Category: "Books"},
 		
 		// Sports
-		{Name: "Wilson Tennis Racket", Description: "Professional tennis equipment", Price: 199.99, Category: "Sports"},
-		{Name: "Nike Basketball", Description: "Official size basketball", Price: 29.99, Category: "Sports"},
-		{Name: "Yoga Mat", Description: "Premium non-slip yoga mat", Price: 39.99, Category: "Sports"},
-		{Name: "Gym Equipment", Description: "Complete home gym set", Price: 599.99, Category: "Sports"},
-		{Name: "Bicycle", Description: "Mountain bike for adventure", Price: 799.99, Category: "Sports"},
+		{Name: "Wilson Tennis Racket", Description: "Professional tennis equipment", Price: NewMoney(19999, DefaultCurrency), Category: "Sports"},
+		{Name: "Nike Basketball", Description: "Official size basketball", Price: NewMoney(2999, DefaultCurrency), Category: "Sports"},
+		{Name: "Yoga Mat", Description: "Premium non-slip yoga mat", Price: NewMoney(3999, DefaultCurrency), Category: "Sports"},
+		{Name: "Gym Equipment", Description: "Complete home gym set", Price: NewMoney(59999, DefaultCurrency), Category: "Sports"},
+		{Name: "Bicycle", Description: "Mountain bike for adventure", Price: NewMoney(79999, DefaultCurrency), Category: "Sports"},
 	}
 	
+	// Clothing is sold by size
+	sampleVariants := map[string][]ItemVariant{
+		"Nike Air Max": {
+			{SKU: "NIKE-AIRMAX-9", Options: VariantOptions{"size": "9"}, Stock: 15},
+			{SKU: "NIKE-AIRMAX-10", Options: VariantOptions{"size": "10"}, Stock: 20},
+			{SKU: "NIKE-AIRMAX-11", Options: VariantOptions{"size": "11"}, Stock: 15},
+		},
+		"Levi's Jeans": {
+			{SKU: "LEVIS-501-30", Options: VariantOptions{"size": "30"}, Stock: 15},
+			{SKU: "LEVIS-501-32", Options: VariantOptions{"size": "32"}, Stock: 20},
+			{SKU: "LEVIS-501-34", Options: VariantOptions{"size": "34"}, Stock: 15},
+		},
+		"Adidas Hoodie": {
+			{SKU: "ADIDAS-HOODIE-S", Options: VariantOptions{"size": "S"}, Stock: 15},
+			{SKU: "ADIDAS-HOODIE-M", Options: VariantOptions{"size": "M"}, Stock: 20},
+			{SKU: "ADIDAS-HOODIE-L", Options: VariantOptions{"size": "L"}, Stock: 15},
+			{SKU: "ADIDAS-HOODIE-XL", Options: VariantOptions{"size": "XL"}, PriceOverride: NewMoney(6499, DefaultCurrency), Stock: 10},
+		},
+	}
+
 	for _, item := range sampleItems {
+		categoryID := categoryIDs[item.Category]
+		item.CategoryID = &categoryID
+		item.Stock = 50
+		item.Variants = sampleVariants[item.Name]
 		db.Create(&item)
 	}
 
-	log.Println("Database reset successfully! Created 25 items with categories.")
-	log.Println("Now restart the main application: go run main.go models.go handlers.go")
+	// Create sample coupons
+	samplePromotions := []Promotion{
+		{Code: "WELCOME10", Description: "10% off your order", Type: PromotionPercentage, PercentOff: 10, PerUserLimit: 1},
+		{Code: "FREESHIP", Description: "Free shipping", Type: PromotionFreeShipping},
+	}
+	for _, promotion := range samplePromotions {
+		db.Create(&promotion)
+	}
+
+	log.Println("Database reset successfully! Created 25 items with categories, sized clothing and 2 coupons.")
+	log.Println("Now restart the main application: go run main.go handlers.go models.go pagination.go search.go tokens.go inventory.go money.go orderstatus.go payments.go idempotency.go promotions.go tax.go shipping.go addresses.go guestcarts.go pricechanges.go wishlists.go variants.go images.go reviews.go")
 } 
\ No newline at end of file
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Review statuses. New and edited reviews are published; a moderator keeps a
+// flagged review by approving it or takes it down by hiding it.
+const (
+	ReviewPublished = "published"
+	ReviewApproved  = "approved"
+	ReviewHidden    = "hidden"
+)
+
+// visibleReviewStatuses are the statuses of reviews shown on an item and
+// counted in its rating
+var visibleReviewStatuses = []string{ReviewPublished, ReviewApproved}
+
+// reviewedOrderStatuses are the statuses of orders whose buyers may review
+// the items in them: the order was fulfilled, whether or not it has arrived
+var reviewedOrderStatuses = []string{OrderFulfilled, OrderShipped, OrderDelivered}
+
+// reviewSortColumns maps the sort names accepted when listing reviews to
+// their columns
+var reviewSortColumns = map[string]string{
+	"recent":  "created_at",
+	"helpful": "helpful_count",
+	"rating":  "rating",
+}
+
+// verifiedPurchaser reports whether the user has a fulfilled order with the
+// item in it
+func verifiedPurchaser(db *gorm.DB, userID uint, itemID uint) (bool, error) {
+	var count int
+	err := db.Model(&OrderItem{}).
+		Joins("JOIN orders ON orders.id = order_items.order_id").
+		Where("orders.user_id = ? AND order_items.item_id = ? AND orders.status IN (?)", userID, itemID, reviewedOrderStatuses).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// normalizeReview trims a review's title and body and checks its rating
+func normalizeReview(review *Review) error {
+	review.Title = strings.TrimSpace(review.Title)
+	review.Body = strings.TrimSpace(review.Body)
+	if review.Rating < 1 || review.Rating > 5 {
+		return errors.New("Rating must be from 1 to 5")
+	}
+	if review.Title == "" {
+		return errors.New("Title cannot be blank")
+	}
+	return nil
+}
+
+// refreshItemRating recomputes an item's average rating, rounded to two
+// decimal places, and review count from its visible reviews. Archived items
+// are kept up to date too, as they can be restored.
+func refreshItemRating(tx *gorm.DB, itemID uint) error {
+	var summary struct {
+		Average float64
+		Count   uint
+	}
+	err := tx.Model(&Review{}).
+		Select("COALESCE(AVG(rating), 0) AS average, COUNT(*) AS count").
+		Where("item_id = ? AND status IN (?)", itemID, visibleReviewStatuses).
+		Scan(&summary).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Model(&Item{}).Where("id = ?", itemID).UpdateColumns(map[string]interface{}{
+		"rating":       math.Round(summary.Average*100) / 100,
+		"review_count": summary.Count,
+	}).Error
+}
+
+// refreshReviewCounts recounts a review's helpful votes and flags
+func refreshReviewCounts(tx *gorm.DB, review *Review) error {
+	var helpful, flags uint
+	if err := tx.Model(&ReviewVote{}).Where("review_id = ?", review.ID).Count(&helpful).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&ReviewFlag{}).Where("review_id = ?", review.ID).Count(&flags).Error; err != nil {
+		return err
+	}
+
+	review.HelpfulCount, review.FlagCount = helpful, flags
+	return tx.Model(review).UpdateColumns(map[string]interface{}{
+		"helpful_count": helpful,
+		"flag_count":    flags,
+	}).Error
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// RouterConfig is what the API's handlers depend on besides the database
+type RouterConfig struct {
+	Tokens            *TokenService
+	IdempotencyWindow time.Duration
+	Taxes             TaxCalculator
+	Shipping          ShippingRateProvider
+	Images            ImageStore
+	Payments          PaymentProvider
+	PaymentTimeout    time.Duration
+}
+
+// setupRouter adds CORS handling and the API routes to router
+func setupRouter(router *gin.Engine, db *gorm.DB, config RouterConfig) {
+	tokens := config.Tokens
+	idempotencyWindow := config.IdempotencyWindow
+
+	// Enable CORS
+	router.Use(func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key, X-Cart-Token")
+		c.Header("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, Idempotent-Replayed, X-Cart-Token")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	})
+
+	// Initialize handlers
+	userHandler := &UserHandler{db: db, tokens: tokens}
+	itemHandler := &ItemHandler{db: db, fullTextSearch: setupItemSearch(db), images: config.Images}
+	categoryHandler := &CategoryHandler{db: db}
+	cartHandler := &CartHandler{db: db, taxes: config.Taxes, shipping: config.Shipping}
+	addressHandler := &AddressHandler{db: db}
+	wishlistHandler := &WishlistHandler{db: db, taxes: config.Taxes}
+	reviewHandler := &ReviewHandler{db: db}
+	promotionHandler := &PromotionHandler{db: db}
+	orderHandler := &OrderHandler{db: db, taxes: config.Taxes, shipping: config.Shipping, payments: config.Payments, paymentTimeout: config.PaymentTimeout}
+
+	// Routes
+	api := router.Group("/api")
+	{
+		// User routes
+		api.POST("/users", userHandler.CreateUser)
+		api.GET("/users", authMiddleware(tokens), requireRole(db, RoleAdmin), userHandler.ListUsers)
+		api.POST("/users/login", userHandler.Login)
+		api.POST("/users/refresh", userHandler.Refresh)
+		api.POST("/users/logout", authMiddleware(tokens), userHandler.Logout)
+		api.GET("/users/me/sessions", authMiddleware(tokens), userHandler.ListSessions)
+		api.DELETE("/users/me/sessions", authMiddleware(tokens), userHandler.RevokeAllSessions)
+		api.DELETE("/users/me/sessions/:id", authMiddleware(tokens), userHandler.RevokeSession)
+		api.PUT("/users/:id/role", authMiddleware(tokens), requireRole(db, RoleAdmin), userHandler.UpdateUserRole)
+
+		// Item routes
+		api.POST("/items", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.CreateItem)
+		api.GET("/items", itemHandler.ListItems)
+		api.GET("/items/search", itemHandler.SearchItems)
+		api.GET("/items/:id", itemHandler.GetItem)
+		api.PUT("/items/:id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.UpdateItem)
+		api.PATCH("/items/:id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.UpdateItem)
+		api.DELETE("/items/:id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.DeleteItem)
+		api.POST("/items/:id/variants", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.CreateVariant)
+		api.PUT("/items/:id/variants/:variant_id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.UpdateVariant)
+		api.PATCH("/items/:id/variants/:variant_id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.UpdateVariant)
+		api.DELETE("/items/:id/variants/:variant_id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.DeleteVariant)
+		api.POST("/items/:id/images", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.UploadItemImage)
+		api.DELETE("/items/:id/images/:image_id", authMiddleware(tokens), requireRole(db, RoleAdmin), itemHandler.DeleteItemImage)
+		api.GET("/images/:key", itemHandler.ServeImage)
+
+		// Review routes (writing needs authentication; moderation is admin only)
+		api.GET("/items/:id/reviews", reviewHandler.ListReviews)
+		api.POST("/items/:id/reviews", authMiddleware(tokens), reviewHandler.CreateReview)
+		api.GET("/reviews/flagged", authMiddleware(tokens), requireRole(db, RoleAdmin), reviewHandler.ListFlaggedReviews)
+		api.PUT("/reviews/:id", authMiddleware(tokens), reviewHandler.UpdateReview)
+		api.PATCH("/reviews/:id", authMiddleware(tokens), reviewHandler.UpdateReview)
+		api.DELETE("/reviews/:id", authMiddleware(tokens), reviewHandler.DeleteReview)
+		api.POST("/reviews/:id/helpful", authMiddleware(tokens), reviewHandler.VoteHelpful)
+		api.DELETE("/reviews/:id/helpful", authMiddleware(tokens), reviewHandler.RemoveHelpfulVote)
+		api.POST("/reviews/:id/flag", authMiddleware(tokens), reviewHandler.FlagReview)
+		api.PUT("/reviews/:id/moderation", authMiddleware(tokens), requireRole(db, RoleAdmin), reviewHandler.ModerateReview)
+
+		// Category routes
+		api.POST("/categories", authMiddleware(tokens), requireRole(db, RoleAdmin), categoryHandler.CreateCategory)
+		api.GET("/categories", categoryHandler.ListCategories)
+
+		// Cart routes (signed-in users and guests; saving for later needs
+		// authentication)
+		api.POST("/carts", cartOwner(tokens), idempotent(db, idempotencyWindow), cartHandler.CreateCart)
+		api.GET("/carts", cartOwner(tokens), cartHandler.ListCarts)
+		api.PUT("/carts/items/:item_id", cartOwner(tokens), cartHandler.UpdateCartItem)
+		api.DELETE("/carts/items/:item_id", cartOwner(tokens), cartHandler.RemoveFromCart)
+		api.POST("/carts/coupon", cartOwner(tokens), cartHandler.ApplyCoupon)
+		api.DELETE("/carts/coupon", cartOwner(tokens), cartHandler.RemoveCoupon)
+		api.POST("/carts/acknowledge-prices", cartOwner(tokens), cartHandler.AcknowledgePrices)
+		api.GET("/carts/shipping-options", cartOwner(tokens), cartHandler.ShippingOptions)
+		api.POST("/carts/items/:item_id/move-to-wishlist", authMiddleware(tokens), wishlistHandler.SaveForLater)
+
+		// Promotion routes (admin only)
+		api.POST("/promotions", authMiddleware(tokens), requireRole(db, RoleAdmin), promotionHandler.CreatePromotion)
+		api.GET("/promotions", authMiddleware(tokens), requireRole(db, RoleAdmin), promotionHandler.ListPromotions)
+
+		// Address routes (require authentication)
+		api.POST("/addresses", authMiddleware(tokens), addressHandler.CreateAddress)
+		api.GET("/addresses", authMiddleware(tokens), addressHandler.ListAddresses)
+		api.GET("/addresses/:id", authMiddleware(tokens), addressHandler.GetAddress)
+		api.PUT("/addresses/:id", authMiddleware(tokens), addressHandler.UpdateAddress)
+		api.DELETE("/addresses/:id", authMiddleware(tokens), addressHandler.DeleteAddress)
+
+		// Wishlist routes (require authentication, except shared lists)
+		api.POST("/wishlists", authMiddleware(tokens), wishlistHandler.CreateWishlist)
+		api.GET("/wishlists", authMiddleware(tokens), wishlistHandler.ListWishlists)
+		api.GET("/wishlists/shared/:token", wishlistHandler.SharedWishlist)
+		api.GET("/wishlists/:id", authMiddleware(tokens), wishlistHandler.GetWishlist)
+		api.PUT("/wishlists/:id", authMiddleware(tokens), wishlistHandler.UpdateWishlist)
+		api.DELETE("/wishlists/:id", authMiddleware(tokens), wishlistHandler.DeleteWishlist)
+		api.POST("/wishlists/:id/items", authMiddleware(tokens), wishlistHandler.AddWishlistItem)
+		api.DELETE("/wishlists/:id/items/:item_id", authMiddleware(tokens), wishlistHandler.RemoveWishlistItem)
+		api.POST("/wishlists/:id/items/:item_id/move-to-cart", authMiddleware(tokens), wishlistHandler.MoveToCart)
+
+		// Order routes (require authentication; status changes are for staff)
+		api.POST("/orders", authMiddleware(tokens), idempotent(db, idempotencyWindow), orderHandler.CreateOrder)
+		api.GET("/orders", authMiddleware(tokens), orderHandler.ListOrders)
+		api.GET("/orders/:id", authMiddleware(tokens), orderHandler.GetOrder)
+		api.POST("/orders/:id/cancel", authMiddleware(tokens), orderHandler.CancelOrder)
+		api.POST("/orders/:id/payment", authMiddleware(tokens), orderHandler.ConfirmPayment)
+		api.PATCH("/orders/:id/status", authMiddleware(tokens), requireRole(db, RoleStaff, RoleAdmin), orderHandler.UpdateOrderStatus)
+	}
+}
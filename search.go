@@ -0,0 +1,276 @@
+package main
+
+import (
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Highlighted terms are wrapped in these markers while the text is still raw,
+// then the text is HTML-escaped and the markers become <mark> tags
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+// snippetLength is the number of words kept around matches in a description
+const snippetLength = 12
+
+// ItemSearchResult is a single search match. Highlight and Snippet are
+// HTML-escaped with the matched terms wrapped in <mark> tags.
+type ItemSearchResult struct {
+	Item      Item    `json:"item"`
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight"`
+	Snippet   string  `json:"snippet"`
+}
+
+// setupItemSearch creates the FTS5 index over item names, descriptions and
+// categories and fills it from the items table. It returns false when the
+// sqlite3 driver was built without FTS5 (the sqlite_fts5 build tag), in which
+// case searches fall back to LIKE queries.
+func setupItemSearch(db *gorm.DB) bool {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS items_fts USING fts5(name, description, category, tokenize = 'porter unicode61')").Error
+	if err != nil {
+		log.Println("Full-text search unavailable, falling back to LIKE queries:", err)
+		return false
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM items_fts").Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO items_fts (rowid, name, description, category) SELECT id, name, description, category FROM items WHERE deleted_at IS NULL").Error
+	})
+	if err != nil {
+		log.Println("Failed to build search index, falling back to LIKE queries:", err)
+		return false
+	}
+
+	return true
+}
+
+// indexItem adds or replaces an item in the search index
+func indexItem(db *gorm.DB, item Item) error {
+	if err := unindexItem(db, item.ID); err != nil {
+		return err
+	}
+	return db.Exec("INSERT INTO items_fts (rowid, name, description, category) VALUES (?, ?, ?, ?)", item.ID, item.Name, item.Description, item.Category).Error
+}
+
+// unindexItem removes an item from the search index
+func unindexItem(db *gorm.DB, itemID uint) error {
+	return db.Exec("DELETE FROM items_fts WHERE rowid = ?", itemID).Error
+}
+
+// searchTerms splits a search query into words
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchItemsFTS ranks matches with bm25, weighting names above categories
+// and categories above descriptions. Every term must match, and the last
+// term also matches as a prefix so results appear while the user is typing.
+func searchItemsFTS(db *gorm.DB, terms []string, limit int) ([]ItemSearchResult, error) {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	quoted[len(quoted)-1] += "*"
+
+	rows, err := db.Raw(`SELECT rowid, -bm25(items_fts, 10.0, 1.0, 5.0),
+			highlight(items_fts, 0, ?, ?),
+			snippet(items_fts, 1, ?, ?, '…', ?)
+		FROM items_fts WHERE items_fts MATCH ?
+		ORDER BY bm25(items_fts, 10.0, 1.0, 5.0) LIMIT ?`,
+		highlightStart, highlightEnd, highlightStart, highlightEnd, snippetLength, strings.Join(quoted, " "), limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ItemSearchResult
+	var ids []uint
+	for rows.Next() {
+		var result ItemSearchResult
+		if err := rows.Scan(&result.Item.ID, &result.Score, &result.Highlight, &result.Snippet); err != nil {
+			return nil, err
+		}
+		result.Highlight = renderHighlights(result.Highlight)
+		result.Snippet = renderHighlights(result.Snippet)
+		results = append(results, result)
+		ids = append(ids, result.Item.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachItems(db, results, ids)
+}
+
+// searchItemsLike is the fallback when FTS5 is not available. Every term must
+// appear in the name, description or category, and matches are scored by
+// where the terms were found.
+func searchItemsLike(db *gorm.DB, terms []string, limit int) ([]ItemSearchResult, error) {
+	query := db
+	for _, term := range terms {
+		pattern := "%" + escapeLike(term) + "%"
+		query = query.Where("name LIKE ? ESCAPE '\\' OR description LIKE ? ESCAPE '\\' OR category LIKE ? ESCAPE '\\'", pattern, pattern, pattern)
+	}
+
+	var items []Item
+	if err := query.Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]ItemSearchResult, 0, len(items))
+	for _, item := range items {
+		var score float64
+		for _, term := range terms {
+			term = strings.ToLower(term)
+			if strings.Contains(strings.ToLower(item.Name), term) {
+				score += 10
+			}
+			if strings.Contains(strings.ToLower(item.Category), term) {
+				score += 5
+			}
+			if strings.Contains(strings.ToLower(item.Description), term) {
+				score++
+			}
+		}
+
+		results = append(results, ItemSearchResult{
+			Item:      item,
+			Score:     score,
+			Highlight: renderHighlights(markTerms(item.Name, terms)),
+			Snippet:   renderHighlights(snippetAround(markTerms(item.Description, terms))),
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// attachItems loads the items for results that so far only carry an ID
+func attachItems(db *gorm.DB, results []ItemSearchResult, ids []uint) ([]ItemSearchResult, error) {
+	if len(ids) == 0 {
+		return []ItemSearchResult{}, nil
+	}
+
+	var items []Item
+	if err := db.Where("id IN (?)", ids).Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]Item, len(items))
+	for _, item := range items {
+		byID[item.ID] = item
+	}
+
+	found := results[:0]
+	for _, result := range results {
+		if item, ok := byID[result.Item.ID]; ok {
+			result.Item = item
+			found = append(found, result)
+		}
+	}
+
+	return found, nil
+}
+
+// markTerms wraps every case-insensitive occurrence of the terms in text with
+// the highlight markers
+func markTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	marked := make([]bool, len(text))
+	for _, term := range terms {
+		term = strings.ToLower(term)
+		if term == "" || len(lower) != len(text) {
+			continue
+		}
+		for start := 0; ; {
+			index := strings.Index(lower[start:], term)
+			if index < 0 {
+				break
+			}
+			for i := start + index; i < start+index+len(term); i++ {
+				marked[i] = true
+			}
+			start += index + len(term)
+		}
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			result.WriteString(highlightStart)
+		}
+		result.WriteByte(text[i])
+		if marked[i] && (i == len(text)-1 || !marked[i+1]) {
+			result.WriteString(highlightEnd)
+		}
+	}
+
+	return result.String()
+}
+
+// snippetAround trims marked text to the words around its first highlight
+func snippetAround(text string) string {
+	words := strings.Fields(text)
+	if len(words) <= snippetLength {
+		return text
+	}
+
+	first := 0
+	for i, word := range words {
+		if strings.Contains(word, highlightStart) {
+			first = i
+			break
+		}
+	}
+
+	start := first - snippetLength/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(words) {
+		end = len(words)
+		start = end - snippetLength
+	}
+
+	snippet := strings.Join(words[start:end], " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(words) {
+		snippet += "…"
+	}
+
+	return snippet
+}
+
+// renderHighlights HTML-escapes text and turns the highlight markers into
+// <mark> tags
+func renderHighlights(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, highlightStart, "<mark>")
+	return strings.ReplaceAll(text, highlightEnd, "</mark>")
+}
+
+// escapeLike escapes the LIKE wildcards in a search term
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Shipping rate types
+const (
+	// ShippingFlat costs the same for every shipment
+	ShippingFlat = "flat"
+	// ShippingWeight costs a base amount plus an amount per started kilogram
+	ShippingWeight = "weight"
+	// ShippingFreeOver costs a flat amount, or nothing once the order
+	// reaches a threshold
+	ShippingFreeOver = "free_over"
+)
+
+// ShippingRateProvider quotes the ways an order can be shipped
+type ShippingRateProvider interface {
+	// Options returns the options available for shipment, cheapest first.
+	// It returns a *ShippingError when nothing ships to the address.
+	Options(shipment Shipment) ([]ShippingOption, error)
+}
+
+// Shipment describes what is shipped where. Subtotal is what the items cost
+// after discounts, and FreeShipping is set when a coupon covers shipping.
+type Shipment struct {
+	Address      PostalAddress
+	WeightGrams  uint
+	Subtotal     Money
+	FreeShipping bool
+}
+
+// ShippingOption is one way to ship an order and what it costs
+type ShippingOption struct {
+	Method string `json:"method"`
+	Name   string `json:"name"`
+	Cost   Money  `json:"cost"`
+}
+
+// ShippingError explains why an order cannot be shipped as asked
+type ShippingError struct {
+	Message string
+}
+
+func (e *ShippingError) Error() string {
+	return e.Message
+}
+
+// ShippingMethod is a row of a ShippingTable. Type decides which of Cost,
+// PerKilogram and Threshold it uses. It only ships to Countries, or
+// everywhere when none are listed. Free shipping coupons do not cover
+// Express methods.
+type ShippingMethod struct {
+	Code        string
+	Name        string
+	Type        string
+	Cost        Money
+	PerKilogram Money
+	Threshold   Money
+	Countries   []string
+	Express     bool
+}
+
+// quote works out what the method charges for shipment
+func (m ShippingMethod) quote(shipment Shipment) (Money, error) {
+	if shipment.FreeShipping && !m.Express {
+		return Money{Amount: 0, Currency: m.Cost.currency()}, nil
+	}
+
+	switch m.Type {
+	case ShippingFlat:
+		return m.Cost, nil
+	case ShippingWeight:
+		kilograms := (shipment.WeightGrams + 999) / 1000
+		return m.Cost.Add(m.PerKilogram.Mul(kilograms))
+	case ShippingFreeOver:
+		if shipment.Subtotal.currency() == m.Threshold.currency() && shipment.Subtotal.Amount >= m.Threshold.Amount {
+			return Money{Amount: 0, Currency: m.Cost.currency()}, nil
+		}
+		return m.Cost, nil
+	}
+	return Money{}, fmt.Errorf("unknown shipping type %q", m.Type)
+}
+
+// shipsTo reports whether the method ships to country
+func (m ShippingMethod) shipsTo(country string) bool {
+	if len(m.Countries) == 0 {
+		return true
+	}
+	for _, c := range m.Countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// ShippingTable is the default ShippingRateProvider. It offers every method
+// that ships to the address.
+type ShippingTable struct {
+	Methods []ShippingMethod
+}
+
+// DefaultShippingTable returns the shipping methods the store offers out of
+// the box
+func DefaultShippingTable() *ShippingTable {
+	return &ShippingTable{Methods: []ShippingMethod{
+		{Code: "standard", Name: "Standard (free over $75)", Type: ShippingFreeOver, Cost: NewMoney(599, DefaultCurrency), Threshold: NewMoney(7500, DefaultCurrency), Countries: []string{"US"}},
+		{Code: "ground", Name: "Ground", Type: ShippingWeight, Cost: NewMoney(399, DefaultCurrency), PerKilogram: NewMoney(125, DefaultCurrency), Countries: []string{"US"}},
+		{Code: "express", Name: "Express", Type: ShippingFlat, Cost: NewMoney(1999, DefaultCurrency), Countries: []string{"US"}, Express: true},
+		{Code: "international", Name: "International", Type: ShippingWeight, Cost: NewMoney(1499, DefaultCurrency), PerKilogram: NewMoney(400, DefaultCurrency), Countries: []string{"CA", "GB", "DE"}},
+	}}
+}
+
+// Options quotes every method that ships to the address, cheapest first
+func (t *ShippingTable) Options(shipment Shipment) ([]ShippingOption, error) {
+	options := []ShippingOption{}
+	for _, method := range t.Methods {
+		if !method.shipsTo(shipment.Address.Country) {
+			continue
+		}
+		cost, err := method.quote(shipment)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, ShippingOption{Method: method.Code, Name: method.Name, Cost: cost})
+	}
+	if len(options) == 0 {
+		return nil, &ShippingError{Message: "We do not ship to " + shipment.Address.Country}
+	}
+
+	sort.SliceStable(options, func(a, b int) bool {
+		return options[a].Cost.Amount < options[b].Cost.Amount
+	})
+	return options, nil
+}
+
+// chooseShipping picks the option for method, or the cheapest option when
+// method is empty
+func chooseShipping(shipping ShippingRateProvider, shipment Shipment, method string) (ShippingOption, error) {
+	options, err := shipping.Options(shipment)
+	if err != nil {
+		return ShippingOption{}, err
+	}
+	if method == "" {
+		return options[0], nil
+	}
+	for _, option := range options {
+		if option.Method == method {
+			return option, nil
+		}
+	}
+	return ShippingOption{}, &ShippingError{Message: fmt.Sprintf("Shipping method %q is not available for this address", method)}
+}
+
+// newShipment describes shipping lines to address. Subtotal is what the
+// lines cost after discounts.
+func newShipment(lines []CartItem, address PostalAddress, subtotal Money, freeShipping bool) Shipment {
+	shipment := Shipment{Address: address, Subtotal: subtotal, FreeShipping: freeShipping}
+	for _, line := range lines {
+		shipment.WeightGrams += line.Item.WeightGrams * line.Quantity
+	}
+	return shipment
+}
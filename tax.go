@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TaxRate is a tax rate in thousandths of a percent, so 8.875% is 8875. It is
+// serialized as a decimal percentage such as "8.875".
+type TaxRate int64
+
+// taxRatePercent is one percent as a TaxRate
+const taxRatePercent = 1000
+
+// parseTaxRate parses a decimal percentage such as "7.25" with at most three
+// decimal places
+func parseTaxRate(text string) (TaxRate, error) {
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+	if whole == "" || len(fraction) > 3 || (strings.Contains(text, ".") && fraction == "") {
+		return 0, fmt.Errorf("invalid tax rate %q", text)
+	}
+	for _, r := range whole + fraction {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("invalid tax rate %q", text)
+		}
+	}
+
+	rate, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", 3-len(fraction)), 10, 64)
+	if err != nil || rate > 100*taxRatePercent {
+		return 0, fmt.Errorf("invalid tax rate %q", text)
+	}
+	return TaxRate(rate), nil
+}
+
+// String formats the rate as a percentage without the sign, such as "7.25"
+func (r TaxRate) String() string {
+	text := strconv.FormatInt(int64(r)/taxRatePercent, 10)
+	if fraction := int64(r) % taxRatePercent; fraction != 0 {
+		text += "." + strings.TrimRight(fmt.Sprintf("%03d", fraction), "0")
+	}
+	return text
+}
+
+// MarshalJSON writes the rate as a decimal string
+func (r TaxRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON accepts a decimal percentage as a string ("7.25") or number
+func (r *TaxRate) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(strings.TrimSpace(string(data)), `"`)
+	rate, err := parseTaxRate(text)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// Tax rounding modes
+const (
+	// TaxRoundPerLine rounds the tax of every line to the minor unit
+	TaxRoundPerLine = "per_line"
+	// TaxRoundPerOrder rounds the tax of the whole order once per rate and
+	// shares it out over the lines
+	TaxRoundPerOrder = "per_order"
+)
+
+// TaxCalculator works out the tax on the lines of a cart or order
+type TaxCalculator interface {
+	// Calculate returns the tax on lines for region, or for the default
+	// region when region is empty. It returns a *TaxRegionError for a region
+	// it does not know.
+	Calculate(region string, lines []TaxableLine) (TaxBreakdown, error)
+}
+
+// TaxableLine is a cart or order line to be taxed, for one variant of its
+// item when VariantID is set. Amount is what the line costs after discounts.
+type TaxableLine struct {
+	ItemID    uint
+	VariantID *uint
+	Category  string
+	Amount    Money
+}
+
+// TaxBreakdown is the tax on a set of lines. Lines holds the tax of each line
+// in the order they were given, and Taxes the totals per rate. When Inclusive
+// is set the tax is already part of the line amounts; otherwise it comes on
+// top of them.
+type TaxBreakdown struct {
+	Region    string
+	Inclusive bool
+	Lines     []LineTax
+	Taxes     []TaxLine
+	Total     Money
+}
+
+// LineTax is the tax on one line
+type LineTax struct {
+	Rate   TaxRate
+	Amount Money
+}
+
+// TaxLine is the total tax charged at one rate
+type TaxLine struct {
+	Name   string  `json:"name"`
+	Rate   TaxRate `json:"rate"`
+	Amount Money   `json:"amount"`
+}
+
+// TaxRegionError is returned for a tax region without a jurisdiction
+type TaxRegionError struct {
+	Region string
+}
+
+func (e *TaxRegionError) Error() string {
+	return fmt.Sprintf("unknown tax region %q", e.Region)
+}
+
+// TaxJurisdiction holds the tax rules of one region. Items are taxed at the
+// rate of their category in CategoryRates, or at Rate otherwise.
+type TaxJurisdiction struct {
+	Name             string             `json:"name"`
+	Rate             TaxRate            `json:"rate"`
+	CategoryRates    map[string]TaxRate `json:"category_rates"`
+	PricesIncludeTax bool               `json:"prices_include_tax"`
+	Rounding         string             `json:"rounding"`
+}
+
+// rate returns the rate an item of category is taxed at
+func (j TaxJurisdiction) rate(category string) TaxRate {
+	if rate, ok := j.CategoryRates[category]; ok {
+		return rate
+	}
+	return j.Rate
+}
+
+// TaxTable is the default TaxCalculator. It looks up rates in a table of
+// jurisdictions keyed by region code, such as "US-CA" or "DE". A region
+// without a jurisdiction of its own, such as "US-TX", falls back to its
+// country.
+type TaxTable struct {
+	DefaultRegion string                     `json:"default_region"`
+	Jurisdictions map[string]TaxJurisdiction `json:"regions"`
+}
+
+// DefaultTaxTable returns the jurisdictions the store sells to out of the box
+func DefaultTaxTable() *TaxTable {
+	return &TaxTable{
+		DefaultRegion: "US-CA",
+		Jurisdictions: map[string]TaxJurisdiction{
+			"US-CA": {Name: "Sales tax", Rate: 7250, Rounding: TaxRoundPerOrder},
+			"US-NY": {Name: "Sales tax", Rate: 8875, Rounding: TaxRoundPerOrder},
+			"US-OR": {Name: "Sales tax", Rate: 0, Rounding: TaxRoundPerOrder},
+			"US":    {Name: "Sales tax", Rate: 0, Rounding: TaxRoundPerOrder},
+			"CA":    {Name: "GST", Rate: 5000, Rounding: TaxRoundPerOrder},
+			"DE":    {Name: "VAT", Rate: 19000, CategoryRates: map[string]TaxRate{"Books": 7000}, PricesIncludeTax: true, Rounding: TaxRoundPerLine},
+			"GB":    {Name: "VAT", Rate: 20000, CategoryRates: map[string]TaxRate{"Books": 0}, PricesIncludeTax: true, Rounding: TaxRoundPerLine},
+		},
+	}
+}
+
+// taxTableFromEnv loads the tax table from the JSON file named by TAX_TABLE,
+// or uses DefaultTaxTable when it is unset. TAX_REGION overrides the default
+// region.
+func taxTableFromEnv() (*TaxTable, error) {
+	table := DefaultTaxTable()
+	if path := os.Getenv("TAX_TABLE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		table = &TaxTable{}
+		if err := json.Unmarshal(data, table); err != nil {
+			return nil, fmt.Errorf("invalid TAX_TABLE %s: %w", path, err)
+		}
+	}
+	if region := os.Getenv("TAX_REGION"); region != "" {
+		table.DefaultRegion = region
+	}
+
+	if err := table.normalize(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// normalize upper-cases the region codes and checks the table is usable
+func (t *TaxTable) normalize() error {
+	jurisdictions := make(map[string]TaxJurisdiction, len(t.Jurisdictions))
+	for region, jurisdiction := range t.Jurisdictions {
+		switch jurisdiction.Rounding {
+		case "":
+			jurisdiction.Rounding = TaxRoundPerLine
+		case TaxRoundPerLine, TaxRoundPerOrder:
+		default:
+			return fmt.Errorf("tax region %s: rounding must be %s or %s", region, TaxRoundPerLine, TaxRoundPerOrder)
+		}
+		jurisdictions[normalizeTaxRegion(region)] = jurisdiction
+	}
+	t.Jurisdictions = jurisdictions
+
+	t.DefaultRegion = normalizeTaxRegion(t.DefaultRegion)
+	if _, ok := t.Jurisdictions[t.DefaultRegion]; !ok {
+		return fmt.Errorf("default tax region %q has no jurisdiction", t.DefaultRegion)
+	}
+	return nil
+}
+
+// normalizeTaxRegion makes region codes case-insensitive
+func normalizeTaxRegion(region string) string {
+	return strings.ToUpper(strings.TrimSpace(region))
+}
+
+// Calculate taxes every line at the rate for its category. Per-line rounding
+// rounds each line's tax half away from zero. Per-order rounding rounds the
+// exact total of each rate once and shares it over the lines by largest
+// remainder, so the lines always add up to the total.
+func (t *TaxTable) Calculate(region string, lines []TaxableLine) (TaxBreakdown, error) {
+	region = normalizeTaxRegion(region)
+	if region == "" {
+		region = t.DefaultRegion
+	}
+	jurisdiction, ok := t.Jurisdictions[region]
+	if country, _, found := strings.Cut(region, "-"); !ok && found {
+		if jurisdiction, ok = t.Jurisdictions[country]; ok {
+			region = country
+		}
+	}
+	if !ok {
+		return TaxBreakdown{}, &TaxRegionError{Region: region}
+	}
+
+	breakdown := TaxBreakdown{
+		Region:    region,
+		Inclusive: jurisdiction.PricesIncludeTax,
+		Lines:     make([]LineTax, len(lines)),
+		Taxes:     []TaxLine{},
+	}
+
+	// Group the lines by rate, keeping the order rates first appear in
+	var rates []TaxRate
+	groups := make(map[TaxRate][]int)
+	for i, line := range lines {
+		rate := jurisdiction.rate(line.Category)
+		if _, ok := groups[rate]; !ok {
+			rates = append(rates, rate)
+		}
+		groups[rate] = append(groups[rate], i)
+	}
+
+	for _, rate := range rates {
+		exact := make([]*big.Rat, len(groups[rate]))
+		for k, i := range groups[rate] {
+			exact[k] = exactTax(lines[i].Amount.Amount, rate, jurisdiction.PricesIncludeTax)
+		}
+
+		var amounts []int64
+		if jurisdiction.Rounding == TaxRoundPerOrder {
+			amounts = allocateRounded(exact)
+		} else {
+			amounts = make([]int64, len(exact))
+			for k := range exact {
+				amounts[k] = roundHalfAwayFromZero(exact[k])
+			}
+		}
+
+		var total Money
+		for k, i := range groups[rate] {
+			tax := Money{Amount: amounts[k], Currency: lines[i].Amount.currency()}
+			breakdown.Lines[i] = LineTax{Rate: rate, Amount: tax}
+
+			sum, err := total.Add(tax)
+			if err != nil {
+				return TaxBreakdown{}, err
+			}
+			total = sum
+		}
+
+		sum, err := breakdown.Total.Add(total)
+		if err != nil {
+			return TaxBreakdown{}, err
+		}
+		breakdown.Total = sum
+
+		if rate != 0 {
+			breakdown.Taxes = append(breakdown.Taxes, TaxLine{Name: jurisdiction.Name, Rate: rate, Amount: total})
+		}
+	}
+
+	return breakdown, nil
+}
+
+// exactTax is the unrounded tax in minor units on amount. An inclusive amount
+// already contains the tax, so the tax is rate/(100%+rate) of it.
+func exactTax(amount int64, rate TaxRate, inclusive bool) *big.Rat {
+	denominator := int64(100 * taxRatePercent)
+	if inclusive {
+		denominator += int64(rate)
+	}
+	return new(big.Rat).SetFrac(big.NewInt(amount*int64(rate)), big.NewInt(denominator))
+}
+
+// roundHalfAwayFromZero rounds an exact amount to a whole minor unit
+func roundHalfAwayFromZero(r *big.Rat) int64 {
+	quotient, remainder := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(r.Sign())))
+	}
+	return quotient.Int64()
+}
+
+// allocateRounded rounds the sum of non-negative exact amounts once and
+// shares it out as whole minor units: every amount gets its floor, and the
+// units left over go to the largest fractions, earliest first.
+func allocateRounded(exact []*big.Rat) []int64 {
+	sum := new(big.Rat)
+	for _, r := range exact {
+		sum.Add(sum, r)
+	}
+	left := roundHalfAwayFromZero(sum)
+
+	amounts := make([]int64, len(exact))
+	fractions := make([]*big.Rat, len(exact))
+	order := make([]int, len(exact))
+	for i, r := range exact {
+		floor := new(big.Int).Quo(r.Num(), r.Denom())
+		amounts[i] = floor.Int64()
+		fractions[i] = new(big.Rat).Sub(r, new(big.Rat).SetInt(floor))
+		order[i] = i
+		left -= amounts[i]
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return fractions[order[a]].Cmp(fractions[order[b]]) > 0
+	})
+	for _, i := range order {
+		if left <= 0 {
+			break
+		}
+		amounts[i]++
+		left--
+	}
+	return amounts
+}
+
+// calculateTax taxes lines after taking discounts off them. A discount for an
+// item comes off the line of its variant when it names one, and is shared
+// over all of the item's lines otherwise; an order-wide discount is shared
+// over all lines. Shares are in proportion to what the lines cost.
+func calculateTax(taxes TaxCalculator, region string, lines []TaxableLine, discounts []Discount) (TaxBreakdown, error) {
+	var orderWide Money
+	for _, discount := range discounts {
+		if discount.ItemID == nil {
+			sum, err := orderWide.Add(discount.Amount)
+			if err != nil {
+				return TaxBreakdown{}, err
+			}
+			orderWide = sum
+			continue
+		}
+
+		var matching []int
+		for i, line := range lines {
+			if line.ItemID != *discount.ItemID {
+				continue
+			}
+			if discount.VariantID != nil && variantOf(line.VariantID) != *discount.VariantID {
+				continue
+			}
+			matching = append(matching, i)
+		}
+		if err := shareDiscount(lines, matching, discount.Amount); err != nil {
+			return TaxBreakdown{}, err
+		}
+	}
+
+	all := make([]int, len(lines))
+	for i := range lines {
+		all[i] = i
+	}
+	if err := shareDiscount(lines, all, orderWide); err != nil {
+		return TaxBreakdown{}, err
+	}
+
+	return taxes.Calculate(region, lines)
+}
+
+// shareDiscount takes amount off the lines at indexes in proportion to what
+// they cost. It never takes off more than they cost together, so no line
+// goes below zero.
+func shareDiscount(lines []TaxableLine, indexes []int, amount Money) error {
+	var base int64
+	for _, i := range indexes {
+		base += lines[i].Amount.Amount
+	}
+	if base <= 0 || !amount.IsPositive() {
+		return nil
+	}
+
+	off := min(amount.Amount, base)
+	shares := make([]*big.Rat, len(indexes))
+	for j, i := range indexes {
+		shares[j] = new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(off), big.NewInt(lines[i].Amount.Amount)), big.NewInt(base))
+	}
+	for j, share := range allocateRounded(shares) {
+		i := indexes[j]
+		discounted, err := lines[i].Amount.Sub(Money{Amount: share, Currency: amount.Currency})
+		if err != nil {
+			return err
+		}
+		lines[i].Amount = discounted
+	}
+	return nil
+}
+
+// taxCart works out the tax on a cart's lines after its discounts. The line
+// subtotals must have been calculated.
+func taxCart(taxes TaxCalculator, region string, cart *Cart) error {
+	lines := make([]TaxableLine, len(cart.Items))
+	for i, cartItem := range cart.Items {
+		lines[i] = TaxableLine{ItemID: cartItem.ItemID, VariantID: cartItem.VariantID, Category: cartItem.Item.Category, Amount: cartItem.Subtotal}
+	}
+
+	breakdown, err := calculateTax(taxes, region, lines, cart.Discounts)
+	if err != nil {
+		return err
+	}
+
+	for i := range cart.Items {
+		cart.Items[i].TaxRate = breakdown.Lines[i].Rate
+		cart.Items[i].Tax = breakdown.Lines[i].Amount
+	}
+	cart.TaxRegion = breakdown.Region
+	cart.PricesIncludeTax = breakdown.Inclusive
+	cart.Taxes = breakdown.Taxes
+	cart.TaxTotal = breakdown.Total
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token settings
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	GuestCartTTL    = 30 * 24 * time.Hour
+	TokenIssuer     = "ecommerce-store"
+	TokenAudience   = "ecommerce-store-api"
+)
+
+// Token types, carried in Claims.TokenType so a refresh token cannot be used
+// as an access token or the other way round. Guest cart tokens name a guest
+// in their subject instead of a user and session.
+const (
+	AccessToken    = "access"
+	RefreshToken   = "refresh"
+	GuestCartToken = "guest_cart"
+)
+
+// ErrInvalidToken is returned for any token that fails verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenService signs and verifies JWTs with HMAC keys. Every token names its
+// signing key in the kid header, so keys can be rotated by adding a new
+// active key while the old ones keep verifying tokens issued before.
+//
+// Access tokens are verified without a database lookup, so the service also
+// remembers which sessions were revoked while access tokens issued for them
+// may still be valid. The list is kept in memory: a revocation made by
+// another server process is only seen once the session's access tokens
+// expire, after at most AccessTokenTTL, as refreshing checks the database.
+type TokenService struct {
+	keys      map[string][]byte
+	activeKID string
+	now       func() time.Time
+
+	revokedMu sync.Mutex
+	revoked   map[uint]time.Time
+}
+
+// NewTokenService creates a TokenService that signs with the activeKID key
+// and verifies with any of keys
+func NewTokenService(keys map[string][]byte, activeKID string) (*TokenService, error) {
+	if len(keys[activeKID]) == 0 {
+		return nil, fmt.Errorf("no signing key for active kid %q", activeKID)
+	}
+
+	return &TokenService{keys: keys, activeKID: activeKID, now: time.Now, revoked: map[uint]time.Time{}}, nil
+}
+
+// NewTokenServiceFromEnv reads keys from JWT_KEYS as comma-separated
+// kid:secret pairs and signs with JWT_ACTIVE_KID, or the first key when it is
+// unset. Without JWT_KEYS a random key is generated, so tokens only stay
+// valid until the server restarts.
+func NewTokenServiceFromEnv() (*TokenService, error) {
+	keys := map[string][]byte{}
+	activeKID := os.Getenv("JWT_ACTIVE_KID")
+
+	for _, pair := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("JWT_KEYS must be comma-separated kid:secret pairs")
+		}
+		keys[parts[0]] = []byte(parts[1])
+		if activeKID == "" {
+			activeKID = parts[0]
+		}
+	}
+
+	if len(keys) == 0 {
+		log.Println("JWT_KEYS not set, using a random signing key; tokens will not survive a restart")
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		activeKID = "dev"
+		keys[activeKID] = secret
+	}
+
+	return NewTokenService(keys, activeKID)
+}
+
+// Issue signs a token of the given type for a session's user
+func (s *TokenService) Issue(session Session, tokenType string) (string, time.Time, error) {
+	ttl := AccessTokenTTL
+	if tokenType == RefreshToken {
+		ttl = RefreshTokenTTL
+	}
+
+	claims := Claims{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		TokenType: tokenType,
+	}
+	return s.sign(claims, fmt.Sprint(session.UserID), ttl)
+}
+
+// RevokeSessions stops access tokens issued for sessions revoked at revokedAt
+// from verifying. A session is remembered for AccessTokenTTL, after which
+// every access token issued before its revocation has expired.
+func (s *TokenService) RevokeSessions(revokedAt time.Time, sessionIDs ...uint) {
+	s.revokedMu.Lock()
+	defer s.revokedMu.Unlock()
+
+	now := s.now()
+	for id, until := range s.revoked {
+		if !now.Before(until) {
+			delete(s.revoked, id)
+		}
+	}
+
+	until := revokedAt.Add(AccessTokenTTL)
+	if !now.Before(until) {
+		return
+	}
+	for _, id := range sessionIDs {
+		s.revoked[id] = until
+	}
+}
+
+// SessionRevoked reports whether access tokens issued for a session have
+// been revoked
+func (s *TokenService) SessionRevoked(sessionID uint) bool {
+	s.revokedMu.Lock()
+	defer s.revokedMu.Unlock()
+
+	until, ok := s.revoked[sessionID]
+	return ok && s.now().Before(until)
+}
+
+// IssueGuestCart signs a token for a new guest and returns it with the
+// guest's ID, which names the guest's cart
+func (s *TokenService) IssueGuestCart() (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	guestID := hex.EncodeToString(id)
+
+	token, _, err := s.sign(Claims{TokenType: GuestCartToken}, guestID, GuestCartTTL)
+	if err != nil {
+		return "", "", err
+	}
+	return token, guestID, nil
+}
+
+// sign fills in the registered claims for subject and signs claims with the
+// active key
+func (s *TokenService) sign(claims Claims, subject string, ttl time.Duration) (string, time.Time, error) {
+	now := s.now()
+	expiresAt := now.Add(ttl)
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    TokenIssuer,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{TokenAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.activeKID
+
+	signed, err := token.SignedString(s.keys[s.activeKID])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiresAt, nil
+}
+
+// Parse verifies a token's signature, expiry, issuer, audience and type and
+// returns its claims
+func (s *TokenService) Parse(tokenString string, tokenType string) (*Claims, error) {
+	claims, err := s.verify(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.UserID == 0 || claims.SessionID == 0 || claims.TokenType != tokenType {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// ParseGuestCart verifies a guest cart token and returns the guest's ID
+func (s *TokenService) ParseGuestCart(tokenString string) (string, error) {
+	claims, err := s.verify(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	if claims.UserID != 0 || claims.TokenType != GuestCartToken || claims.Subject == "" {
+		return "", ErrInvalidToken
+	}
+
+	return claims.Subject, nil
+}
+
+// verify checks a token's signature, expiry, issuer and audience and returns
+// its claims
+func (s *TokenService) verify(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(TokenIssuer),
+		jwt.WithAudience(TokenAudience),
+		jwt.WithTimeFunc(s.now),
+	)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
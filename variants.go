@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// VariantOptions names the option values that set a variant apart, such as
+// {"size": "M", "colour": "Black"}. It is stored as JSON.
+type VariantOptions map[string]string
+
+// Value implements driver.Valuer
+func (options VariantOptions) Value() (driver.Value, error) {
+	if options == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (options *VariantOptions) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*options = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into VariantOptions", value)
+	}
+	if len(data) == 0 {
+		*options = nil
+		return nil
+	}
+	return json.Unmarshal(data, options)
+}
+
+// String lists the option values in option name order, such as
+// "colour: Black, size: M"
+func (options VariantOptions) String() string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + ": " + options[name]
+	}
+	return strings.Join(parts, ", ")
+}
+
+// normalizeVariantOptions trims option names and values and lower-cases the
+// names. A variant needs at least one option and no blank names or values.
+func normalizeVariantOptions(options VariantOptions) (VariantOptions, error) {
+	if len(options) == 0 {
+		return nil, errors.New("Options must name at least one option value")
+	}
+
+	normalized := VariantOptions{}
+	for name, value := range options {
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "" || value == "" {
+			return nil, errors.New("Option names and values cannot be empty")
+		}
+		normalized[name] = value
+	}
+	return normalized, nil
+}
+
+// checkPriceOverride validates a variant's price override against its item.
+// A zero amount means the variant costs what the item costs.
+func checkPriceOverride(item Item, price Money) error {
+	if price.Amount == 0 {
+		return nil
+	}
+	if !price.IsPositive() {
+		return errors.New("Price override must be positive")
+	}
+	if price.currency() != item.Price.currency() {
+		return errors.New("Price override must be in " + item.Price.currency())
+	}
+	return nil
+}
+
+// variantConflict explains why variant cannot be saved: its SKU is taken, or
+// another variant of its item has the same options. It returns "" when there
+// is no conflict. Archived variants keep their SKUs.
+func variantConflict(db *gorm.DB, variant ItemVariant) (string, error) {
+	var taken int
+	if err := db.Unscoped().Model(&ItemVariant{}).Where("sku = ? AND id <> ?", variant.SKU, variant.ID).Count(&taken).Error; err != nil {
+		return "", err
+	}
+	if taken > 0 {
+		return "SKU " + variant.SKU + " is already in use", nil
+	}
+
+	var others []ItemVariant
+	if err := db.Where("item_id = ? AND id <> ?", variant.ItemID, variant.ID).Find(&others).Error; err != nil {
+		return "", err
+	}
+	for _, other := range others {
+		if reflect.DeepEqual(other.Options, variant.Options) {
+			return "Another variant of this item has the options " + variant.Options.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// fillVariantPrices sets the price of each of the item's variants
+func (item *Item) fillVariantPrices() {
+	for i := range item.Variants {
+		item.Variants[i].Price = item.Variants[i].priceFor(*item)
+	}
+}
+
+// VariantError explains why a cart line cannot take the variant it asked
+// for. Variants lists the item's variants to choose from.
+type VariantError struct {
+	Message  string
+	Variants []ItemVariant
+}
+
+func (e *VariantError) Error() string {
+	return e.Message
+}
+
+// findVariant loads the variant of item a line asks for. An item with
+// variants needs one and returns a *VariantError without it; a variant that
+// is not the item's returns gorm.ErrRecordNotFound. Items without variants
+// return nil.
+func findVariant(db *gorm.DB, item Item, variantID *uint) (*ItemVariant, error) {
+	if variantID != nil {
+		var variant ItemVariant
+		if err := db.Where("id = ? AND item_id = ?", *variantID, item.ID).First(&variant).Error; err != nil {
+			return nil, err
+		}
+		variant.Price = variant.priceFor(item)
+		return &variant, nil
+	}
+
+	if err := db.Where("item_id = ?", item.ID).Order("id").Find(&item.Variants).Error; err != nil {
+		return nil, err
+	}
+	if len(item.Variants) > 0 {
+		item.fillVariantPrices()
+		return nil, &VariantError{Message: "Choose a variant of " + item.Name, Variants: item.Variants}
+	}
+	return nil, nil
+}
+
+// sameVariant scopes cart or wishlist lines to those of variantID, or to
+// lines without a variant when it is nil
+func sameVariant(db *gorm.DB, variantID *uint) *gorm.DB {
+	if variantID == nil {
+		return db.Where("variant_id IS NULL")
+	}
+	return db.Where("variant_id = ?", *variantID)
+}
+
+// variantOf returns a line's variant ID, or 0 for a line without a variant
+func variantOf(variantID *uint) uint {
+	if variantID == nil {
+		return 0
+	}
+	return *variantID
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultWishlistName names the list cart lines are saved to when no
+// wishlist is chosen. It is created the first time it is needed.
+const DefaultWishlistName = "Saved for later"
+
+// setWishlistSharing makes a wishlist public with a new share token, or
+// private without one. A list that is already public keeps its token.
+func setWishlistSharing(wishlist *Wishlist, public bool) error {
+	wishlist.IsPublic = public
+	if !public {
+		wishlist.ShareToken = nil
+		return nil
+	}
+	if wishlist.ShareToken != nil {
+		return nil
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	shareToken := hex.EncodeToString(token)
+	wishlist.ShareToken = &shareToken
+	return nil
+}
+
+// reportWishlistStock fills in the current price and the units available of
+// every item on a wishlist. The items and variants must have been preloaded.
+func reportWishlistStock(db *gorm.DB, wishlist *Wishlist) error {
+	for i := range wishlist.Items {
+		line := &wishlist.Items[i]
+		line.Price = line.Item.Price
+		if line.Variant != nil {
+			line.Variant.Price = line.Variant.priceFor(line.Item)
+			line.Price = line.Variant.Price
+		}
+		line.Available = 0
+
+		// Archived items and variants are not preloaded
+		if line.Item.ID != 0 && (line.VariantID == nil || line.Variant != nil) {
+			available, err := availableStock(db, line.ItemID, line.VariantID, 0)
+			if err != nil {
+				return err
+			}
+			line.Available = available
+		}
+		line.InStock = line.Available > 0
+	}
+	return nil
+}
+
+// savedForLater returns the user's DefaultWishlistName list, creating it
+// when they have none
+func savedForLater(tx *gorm.DB, userID uint) (Wishlist, error) {
+	var wishlist Wishlist
+	err := tx.Where(Wishlist{UserID: userID, Name: DefaultWishlistName}).FirstOrCreate(&wishlist).Error
+	return wishlist, err
+}
+
+// addToWishlist puts quantity units of an item, or of one of its variants,
+// on a wishlist, adding them to the units already saved
+func addToWishlist(tx *gorm.DB, wishlistID uint, itemID uint, variantID *uint, quantity uint) error {
+	line := WishlistItem{WishlistID: wishlistID, ItemID: itemID, VariantID: variantID}
+	err := sameVariant(tx, variantID).Where("wishlist_id = ? AND item_id = ?", wishlistID, itemID).First(&line).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	line.Quantity += quantity
+	if tx.NewRecord(&line) {
+		return tx.Create(&line).Error
+	}
+	return tx.Model(&line).Update("quantity", line.Quantity).Error
+}